@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reopenableFile is an append-only log file that can be reopened, so that
+// it keeps being written to once logrotate moved it away.
+type reopenableFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openReopenableFile(path string) (*reopenableFile, error) {
+	rf := &reopenableFile{path: path}
+	if err := rf.reopen(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// reopen opens the file at its path again, closing the previous handle
+// once the new one is in place.
+func (rf *reopenableFile) reopen() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	rf.mu.Lock()
+	old := rf.f
+	rf.f = f
+	rf.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (rf *reopenableFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Write(p)
+}
+
+// handleReopenSignal reopens rf on every SIGUSR1.
+func handleReopenSignal(rf *reopenableFile) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	go func() {
+		for range sigCh {
+			if err := rf.reopen(); err != nil {
+				logError("Unable to reopen the log file", "path", rf.path, "err", err)
+			}
+		}
+	}()
+}
+
+// statusRecorder records the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Formats of the access log selected with -access-log-format.
+const (
+	// accessLogCommon is the Apache common log format.
+	accessLogCommon = "common"
+	// accessLogCombined is the Apache combined log format, followed by
+	// the request ID.
+	accessLogCombined = "combined"
+	// accessLogJSON is a JSON object per line.
+	accessLogJSON = "json"
+)
+
+// accessLogClientCN logs the common name of the verified client
+// certificate of TLS requests, as the user of those that did not
+// authenticate otherwise.
+var accessLogClientCN bool
+
+type accessUserKey struct{}
+
+// accessUser is the user a request authenticated as.
+type accessUser struct {
+	name string
+}
+
+// setAccessUser records that r authenticated as the user name, which
+// withAccessLog logs. It does nothing for requests that did not go
+// through withAccessLog.
+func setAccessUser(r *http.Request, name string) {
+	if u, ok := r.Context().Value(accessUserKey{}).(*accessUser); ok {
+		u.name = name
+	}
+}
+
+// clientCN returns the common name of the verified client certificate
+// of r, if any.
+func clientCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// accessLogEntry is a line of the access log in the JSON format.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	ClientCN  string    `json:"clientCN,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMs float64   `json:"latencyMs"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// parseAccessLogFormat checks format is one of the access log formats.
+func parseAccessLogFormat(format string) (string, error) {
+	switch format = strings.ToLower(strings.TrimSpace(format)); format {
+	case accessLogCommon, accessLogCombined, accessLogJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("access log format %q must be 'common', 'combined' or 'json'", format)
+}
+
+// withAccessLog writes a line in format to out for every request, with
+// the user the handlers down the chain authenticated it as with
+// setAccessUser.
+func withAccessLog(out io.Writer, format string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		u := &accessUser{}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessUserKey{}, u)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		user := u.name
+		var cn string
+		if accessLogClientCN {
+			cn = clientCN(r)
+		}
+
+		switch format {
+		case accessLogJSON:
+			line, err := json.Marshal(accessLogEntry{
+				Time:      start,
+				Remote:    host,
+				User:      user,
+				ClientCN:  cn,
+				Method:    r.Method,
+				Path:      r.RequestURI,
+				Proto:     r.Proto,
+				Status:    rec.status,
+				Bytes:     rec.bytes,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+				RequestID: requestIDFromContext(r.Context()),
+			})
+			if err != nil {
+				logError("Unable to write the access log", "err", err)
+				return
+			}
+			out.Write(append(line, '\n'))
+			return
+		}
+
+		if user == "" {
+			user = cn
+		}
+		if user == "" {
+			user = "-"
+		}
+		common := fmt.Sprintf("%s - %s [%s] %q %d %d",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, rec.status, rec.bytes)
+		if format == accessLogCommon {
+			fmt.Fprintln(out, common)
+			return
+		}
+		fmt.Fprintf(out, "%s %q %q %s\n", common, r.Referer(), r.UserAgent(), requestIDFromContext(r.Context()))
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readLog returns the lines of the log file at path.
+func readLog(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "access.log")
+	rf, err := openReopenableFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleReopenSignal(rf)
+	h := withAccessLog(rf, accessLogCommon, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	get := func(target string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	get("/before")
+	// logrotate moves the file away, then signals s3www.
+	rotated := filepath.Join(dir, "access.log.1")
+	if err := os.Rename(logPath, rotated); err != nil {
+		t.Fatal(err)
+	}
+	get("/moved")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(logPath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the log file was not reopened on SIGUSR1")
+		}
+	}
+	get("/after")
+
+	old := readLog(t, rotated)
+	if len(old) != 2 || !strings.Contains(old[0], "GET /before") || !strings.Contains(old[1], "GET /moved") {
+		t.Errorf("rotated file has lines %q, want those of /before and /moved", old)
+	}
+	current := readLog(t, logPath)
+	if len(current) != 1 || !strings.Contains(current[0], "GET /after") {
+		t.Errorf("new file has lines %q, want the one of /after", current)
+	}
+}
+
+func TestAccessLogUser(t *testing.T) {
+	basic, err := newBasicAuth("s3www", "alice", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newFakeStore()
+	store.put("index.html", "home")
+	h := withAuth(basic, newTestS3(t, store))
+
+	var out bytes.Buffer
+	for _, tc := range []struct {
+		format string
+		user   string
+		pass   string
+		want   string
+	}{
+		{accessLogCommon, "alice", "secret", " - alice ["},
+		{accessLogCombined, "alice", "secret", " - alice ["},
+		// A refused user is not the user of the request.
+		{accessLogCommon, "alice", "wrong", " - - ["},
+		{accessLogJSON, "alice", "secret", `"user":"alice"`},
+	} {
+		out.Reset()
+		r := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		r.SetBasicAuth(tc.user, tc.pass)
+		withAccessLog(&out, tc.format, h).ServeHTTP(httptest.NewRecorder(), r)
+		if !strings.Contains(out.String(), tc.want) {
+			t.Errorf("%s %s:%s: logged %q, want %q", tc.format, tc.user, tc.pass, out.String(), tc.want)
+		}
+	}
+}
+
+func TestAccessLogClientCN(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			setAccessUser(r, "bob")
+		}
+	})
+	withCert := func(authorization string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "client.example.com"}}}}}
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return r
+	}
+
+	var out bytes.Buffer
+	withAccessLog(&out, accessLogCommon, next).ServeHTTP(httptest.NewRecorder(), withCert(""))
+	if strings.Contains(out.String(), "client.example.com") {
+		t.Errorf("logged %q, with the client CN without -access-log-client-cn", out.String())
+	}
+
+	setGlobal(t, &accessLogClientCN, true)
+	for _, tc := range []struct {
+		format, authorization, want string
+	}{
+		{accessLogCommon, "", " - client.example.com ["},
+		// The authenticated user comes first.
+		{accessLogCommon, "Bearer token", " - bob ["},
+	} {
+		out.Reset()
+		withAccessLog(&out, tc.format, next).ServeHTTP(httptest.NewRecorder(), withCert(tc.authorization))
+		if !strings.Contains(out.String(), tc.want) {
+			t.Errorf("%s %q: logged %q, want %q", tc.format, tc.authorization, out.String(), tc.want)
+		}
+	}
+
+	out.Reset()
+	withAccessLog(&out, accessLogJSON, next).ServeHTTP(httptest.NewRecorder(), withCert("Bearer token"))
+	var entry accessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.User != "bob" || entry.ClientCN != "client.example.com" {
+		t.Errorf("logged user %q and client CN %q, want bob and client.example.com", entry.User, entry.ClientCN)
+	}
+}
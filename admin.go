@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readyzCacheTime is how long the result of a readiness check is reused,
+// so that frequent probes do not each reach S3.
+const readyzCacheTime = 2 * time.Second
+
+// readinessCheck probes S3 on demand, remembering the last result for
+// readyzCacheTime.
+type readinessCheck struct {
+	s3  *S3
+	key string
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (c *readinessCheck) check(ctx context.Context) error {
+	if atomic.LoadInt32(&draining) == 1 {
+		return errors.New("shutting down")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < readyzCacheTime {
+		return c.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	c.err = probe(ctx, c.s3, c.key)
+	c.checked = time.Now()
+	return c.err
+}
+
+// serveAdmin serves the health endpoints on a separate listener at addr,
+// where they cannot collide with the paths of the bucket: /healthz
+// answers 200 OK while the process is alive, /readyz only while the
+// bucket can be reached with the current credentials, checked with the
+// same request as -startup-probe, and the server is not shutting down.
+func serveAdmin(addr string, s3 *S3, probeKey string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", addr, err)
+	}
+	readiness := &readinessCheck{s3: s3, key: probeKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if err := readiness.check(r.Context()); err != nil {
+			logWarn("Not ready", "err", err)
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ready")
+	})
+	logInfo("Serving health checks", "url", "http://"+ln.Addr().String())
+	go func() {
+		if err := setTimeouts(&http.Server{Handler: mux}).Serve(ln); err != nil {
+			logError("Admin listener stopped", "err", err)
+		}
+	}()
+	return nil
+}
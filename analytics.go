@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// prefixCount is the number of requests seen for a top-level prefix.
+type prefixCount struct {
+	Prefix string `json:"prefix"`
+	Count  int64  `json:"count"`
+}
+
+// prefixCounter counts requests by top-level path prefix, tracking at
+// most max prefixes. When full, the least requested prefix is evicted
+// and the newcomer inherits its count, so heavy prefixes are never lost
+// while counts of late arrivals may be overestimated.
+type prefixCounter struct {
+	mu     sync.Mutex
+	max    int
+	counts map[string]int64
+}
+
+func newPrefixCounter(max int) *prefixCounter {
+	return &prefixCounter{max: max, counts: make(map[string]int64)}
+}
+
+// topPrefix returns the first segment of the path with its slashes, or
+// "/" for objects at the root of the bucket.
+func topPrefix(p string) string {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return "/" + p[:i+1]
+	}
+	return "/"
+}
+
+func (c *prefixCounter) add(p string) {
+	prefix := topPrefix(p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counts[prefix]; !ok && len(c.counts) >= c.max {
+		var minPrefix string
+		var minCount int64 = -1
+		for k, n := range c.counts {
+			if minCount < 0 || n < minCount {
+				minPrefix, minCount = k, n
+			}
+		}
+		delete(c.counts, minPrefix)
+		c.counts[prefix] = minCount
+	}
+	c.counts[prefix]++
+}
+
+// top returns the tracked prefixes, most requested first.
+func (c *prefixCounter) top() []prefixCount {
+	c.mu.Lock()
+	top := make([]prefixCount, 0, len(c.counts))
+	for k, n := range c.counts {
+		top = append(top, prefixCount{Prefix: k, Count: n})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Prefix < top[j].Prefix
+	})
+	return top
+}
+
+func (c *prefixCounter) reset() {
+	c.mu.Lock()
+	c.counts = make(map[string]int64)
+	c.mu.Unlock()
+}
+
+// withAnalytics counts every request by its top-level path prefix.
+func withAnalytics(c *prefixCounter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.add(r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// archiveEntry is a file of an archive.
+type archiveEntry struct {
+	size     int64
+	modified time.Time
+	// open returns the content of the file.
+	open func() ([]byte, error)
+}
+
+// archiveIndex is a loaded archive, with its files by name and the sorted
+// names for listings.
+type archiveIndex struct {
+	etag    string
+	entries map[string]archiveEntry
+	names   []string
+}
+
+// archiveFile is a file of an archive served from memory.
+type archiveFile struct {
+	*bytes.Reader
+	info minio.ObjectInfo
+}
+
+func (a *archiveFile) Close() error {
+	return nil
+}
+
+func (a *archiveFile) Stat() (minio.ObjectInfo, error) {
+	return a.info, nil
+}
+
+// archiveStore is an objectStore serving the files of a single .zip, .tar
+// or .tar.gz archive object as the objects of the bucket, so that a whole
+// site is deployed atomically by replacing one object. The archive is
+// fetched and indexed once, then again whenever its ETag changes.
+type archiveStore struct {
+	store  objectStore
+	bucket string
+	key    string
+	index  atomic.Value // *archiveIndex
+	// onSwap is called after a new version of the archive is loaded.
+	onSwap func()
+}
+
+// newArchiveStore loads the archive key of bucket from store.
+func newArchiveStore(ctx context.Context, store objectStore, bucket, key string) (*archiveStore, error) {
+	a := &archiveStore{store: store, bucket: bucket, key: key}
+	if _, err := a.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// refresh loads the archive again if its ETag changed, reporting whether
+// it did.
+func (a *archiveStore) refresh(ctx context.Context) (bool, error) {
+	info, err := a.store.StatObject(ctx, a.bucket, a.key, minio.StatObjectOptions{})
+	if err != nil {
+		return false, err
+	}
+	if cur, ok := a.index.Load().(*archiveIndex); ok && cur.etag == info.ETag {
+		return false, nil
+	}
+
+	opts := minio.GetObjectOptions{}
+	opts.SetMatchETag(info.ETag)
+	obj, err := a.store.GetObject(ctx, a.bucket, a.key, opts)
+	if err != nil {
+		return false, err
+	}
+	defer obj.Close()
+	data, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return false, err
+	}
+	idx, err := indexArchive(a.key, data)
+	if err != nil {
+		return false, fmt.Errorf("unable to read archive %q: %v", a.key, err)
+	}
+	idx.etag = info.ETag
+	a.index.Store(idx)
+	return true, nil
+}
+
+// watch checks the archive for a new version every interval, swapping it
+// in once loaded.
+func (a *archiveStore) watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			swapped, err := a.refresh(context.Background())
+			if err != nil {
+				logWarn("Unable to refresh the archive, serving the current version", "key", a.key, "err", err)
+				continue
+			}
+			if swapped {
+				logInfo("Loaded a new version of the archive", "key", a.key)
+				if a.onSwap != nil {
+					a.onSwap()
+				}
+			}
+		}
+	}()
+}
+
+// indexArchive indexes the archive stored as key in data, its format
+// is derived from the extension of key.
+func indexArchive(key string, data []byte) (*archiveIndex, error) {
+	idx := &archiveIndex{entries: make(map[string]archiveEntry)}
+	add := func(name string, e archiveEntry) {
+		name = cleanKey(name)
+		if name == "" {
+			return
+		}
+		if _, ok := idx.entries[name]; !ok {
+			idx.names = append(idx.names, name)
+		}
+		idx.entries[name] = e
+	}
+
+	lower := strings.ToLower(key)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			f := f
+			add(f.Name, archiveEntry{
+				size:     int64(f.UncompressedSize64),
+				modified: f.Modified,
+				open: func() ([]byte, error) {
+					rc, err := f.Open()
+					if err != nil {
+						return nil, err
+					}
+					defer rc.Close()
+					return ioutil.ReadAll(rc)
+				},
+			})
+		}
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		var r io.Reader = bytes.NewReader(data)
+		if !strings.HasSuffix(lower, ".tar") {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			add(hdr.Name, archiveEntry{
+				size:     int64(len(content)),
+				modified: hdr.ModTime,
+				open: func() ([]byte, error) {
+					return content, nil
+				},
+			})
+		}
+	default:
+		return nil, errors.New("unsupported archive format, expected .zip, .tar, .tar.gz or .tgz")
+	}
+	sort.Strings(idx.names)
+	return idx, nil
+}
+
+// current returns the archive currently served.
+func (a *archiveStore) current() *archiveIndex {
+	return a.index.Load().(*archiveIndex)
+}
+
+// info returns the info of the file name of idx.
+func (idx *archiveIndex) info(name string, e archiveEntry) minio.ObjectInfo {
+	return minio.ObjectInfo{
+		Key:          name,
+		Size:         e.size,
+		LastModified: e.modified,
+		// Every file changes along with the archive.
+		ETag: idx.etag,
+	}
+}
+
+func noSuchKey(key string) error {
+	return minio.ErrorResponse{Code: "NoSuchKey", StatusCode: http.StatusNotFound, Key: key}
+}
+
+func (a *archiveStore) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	return a.store.BucketExists(ctx, bucket)
+}
+
+func (a *archiveStore) GetObject(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (s3Object, error) {
+	idx := a.current()
+	e, ok := idx.entries[key]
+	if !ok {
+		return nil, noSuchKey(key)
+	}
+	content, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{Reader: bytes.NewReader(content), info: idx.info(key, e)}, nil
+}
+
+func (a *archiveStore) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	idx := a.current()
+	e, ok := idx.entries[key]
+	if !ok {
+		return minio.ObjectInfo{}, noSuchKey(key)
+	}
+	return idx.info(key, e), nil
+}
+
+// ListObjects lists the files of the archive under opts.Prefix after
+// opts.StartAfter, grouping those below a further "/" into directories
+// unless opts.Recursive.
+func (a *archiveStore) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	idx := a.current()
+	ch := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(ch)
+		i := sort.SearchStrings(idx.names, opts.Prefix)
+		var lastDir string
+		for ; i < len(idx.names); i++ {
+			name := idx.names[i]
+			if !strings.HasPrefix(name, opts.Prefix) {
+				return
+			}
+			if name <= opts.StartAfter {
+				continue
+			}
+			info := idx.info(name, idx.entries[name])
+			if !opts.Recursive {
+				if j := strings.Index(name[len(opts.Prefix):], pathSeparator); j >= 0 {
+					dir := name[:len(opts.Prefix)+j+1]
+					if dir == lastDir || dir <= opts.StartAfter {
+						continue
+					}
+					lastDir = dir
+					info = minio.ObjectInfo{Key: dir}
+				}
+			}
+			select {
+			case ch <- info:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
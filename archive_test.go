@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// zipped returns a zip archive of files by name.
+func zipped(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// tarGzipped returns a gzipped tar archive of files by name.
+func tarGzipped(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), ModTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestArchiveObject(t *testing.T) {
+	site := map[string]string{
+		"index.html":      "home",
+		"about.html":      "about",
+		"docs/index.html": "docs",
+		"./css/site.css":  "body{}",
+		"404.html":        "not found page",
+	}
+	for _, tc := range []struct {
+		key  string
+		data string
+	}{
+		{"site.zip", zipped(t, site)},
+		{"site.tar.gz", tarGzipped(t, site)},
+	} {
+		store := newFakeStore()
+		store.put(tc.key, tc.data)
+		// Objects of the bucket outside the archive are not served.
+		store.put("secret.txt", "secret")
+		a, err := newArchiveStore(context.Background(), store, "bucket", tc.key)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.key, err)
+		}
+		s3 := newTestS3(t, a)
+
+		for _, req := range []struct {
+			path string
+			code int
+			body string
+		}{
+			{"/", http.StatusOK, "home"},
+			{"/about.html", http.StatusOK, "about"},
+			{"/docs/", http.StatusOK, "docs"},
+			{"/docs", http.StatusMovedPermanently, ""},
+			{"/css/site.css", http.StatusOK, "body{}"},
+			{"/missing.html", http.StatusNotFound, "not found page"},
+			{"/secret.txt", http.StatusNotFound, "not found page"},
+		} {
+			w := serve(s3, req.path)
+			if w.Code != req.code {
+				t.Errorf("%s %s: got status %d, want %d", tc.key, req.path, w.Code, req.code)
+				continue
+			}
+			if req.body != "" && w.Body.String() != req.body {
+				t.Errorf("%s %s: got body %q, want %q", tc.key, req.path, w.Body.String(), req.body)
+			}
+		}
+	}
+}
+
+func TestArchiveObjectNewVersion(t *testing.T) {
+	store := newFakeStore()
+	store.put("site.zip", zipped(t, map[string]string{"index.html": "v1", "old.html": "old"}))
+	a, err := newArchiveStore(context.Background(), store, "bucket", "site.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := newTestS3(t, a)
+
+	if swapped, err := a.refresh(context.Background()); err != nil || swapped {
+		t.Errorf("unchanged ETag: got swapped %v, %v, want the archive kept", swapped, err)
+	}
+	if gets := store.count(&store.gets); gets != 1 {
+		t.Errorf("unchanged ETag: %d GETs, want the archive fetched once", gets)
+	}
+
+	store.put("site.zip", zipped(t, map[string]string{"index.html": "v2", "new.html": "new"}))
+	if swapped, err := a.refresh(context.Background()); err != nil || !swapped {
+		t.Fatalf("changed ETag: got swapped %v, %v, want the new archive", swapped, err)
+	}
+	for p, want := range map[string]int{"/": http.StatusOK, "/new.html": http.StatusOK, "/old.html": http.StatusNotFound} {
+		if w := serve(s3, p); w.Code != want {
+			t.Errorf("%s: got status %d, want %d", p, w.Code, want)
+		}
+	}
+	if w := serve(s3, "/"); w.Body.String() != "v2" {
+		t.Errorf("got %q, want the new version", w.Body.String())
+	}
+
+	// A broken new version leaves the current one in place.
+	store.put("site.zip", "not a zip")
+	if _, err := a.refresh(context.Background()); err == nil {
+		t.Error("loaded a broken archive")
+	}
+	if w := serve(s3, "/"); w.Body.String() != "v2" {
+		t.Errorf("got %q after a broken version, want v2 still served", w.Body.String())
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// authorizer decides whether a request may be served, letting an
+// external service authenticate end users in place of the single
+// credential s3www reads the bucket with.
+type authorizer interface {
+	authorize(r *http.Request) (authDecision, error)
+}
+
+// authDecision is the outcome of authorizing a request.
+type authDecision struct {
+	// status refuses the request with this status code when non zero,
+	// along with header, e.g. WWW-Authenticate.
+	status int
+	header http.Header
+	// prefix is the key prefix the request is served under, isolating
+	// the tenants of a shared bucket.
+	prefix string
+	// redirect sends the client elsewhere, e.g. to a presigned URL of
+	// the object, instead of serving the request.
+	redirect string
+	// user is the user the request authenticated as, for the access log.
+	user string
+}
+
+// Headers of the auth service response.
+const (
+	authPrefixHeader   = "X-Auth-Prefix"
+	authRedirectHeader = "X-Auth-Redirect"
+)
+
+// authForwardedHeaders are the headers of the request passed on to the
+// auth service.
+var authForwardedHeaders = []string{"Authorization", "Cookie"}
+
+// authService is the reference authorizer, asking an HTTP service with
+// a GET request carrying the credentials of the original request as well
+// as its method and URI in X-Original-Method and X-Original-URI. A 2xx
+// answer allows the request, optionally with the X-Auth-Prefix and
+// X-Auth-Redirect headers, 401 and 403 refuse it and anything else is
+// an error.
+type authService struct {
+	url    string
+	client *http.Client
+}
+
+func newAuthService(url string, timeout time.Duration) *authService {
+	return &authService{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+			// The redirects of the auth service are its answer.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (a *authService) authorize(r *http.Request) (authDecision, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, a.url, nil)
+	if err != nil {
+		return authDecision{}, err
+	}
+	for _, name := range authForwardedHeaders {
+		for _, v := range r.Header.Values(name) {
+			req.Header.Add(name, v)
+		}
+	}
+	req.Header.Set("X-Original-Method", r.Method)
+	req.Header.Set("X-Original-URI", r.URL.RequestURI())
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+	if id := requestIDFromContext(r.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return authDecision{}, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return authDecision{
+			prefix:   cleanKey(resp.Header.Get(authPrefixHeader)),
+			redirect: resp.Header.Get(authRedirectHeader),
+		}, nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		header := make(http.Header)
+		for _, v := range resp.Header.Values("WWW-Authenticate") {
+			header.Add("WWW-Authenticate", v)
+		}
+		return authDecision{status: resp.StatusCode, header: header}, nil
+	default:
+		return authDecision{}, fmt.Errorf("auth service answered %s", resp.Status)
+	}
+}
+
+type authPrefixKey struct{}
+
+// authPrefix returns the key prefix the request is served under, as
+// decided by withAuth.
+func authPrefix(ctx context.Context) string {
+	prefix, _ := ctx.Value(authPrefixKey{}).(string)
+	return prefix
+}
+
+// prefixedKey returns the key name, a clean absolute path, under the
+// key prefix of the request.
+func prefixedKey(ctx context.Context, name string) string {
+	prefix := authPrefix(ctx)
+	if prefix == "" {
+		return name
+	}
+	return path.Join(pathSeparator, prefix, name)
+}
+
+// unprefixedKey returns key, under the key prefix of the request, as the
+// client sees it: relative to the prefix, which is never disclosed.
+func unprefixedKey(ctx context.Context, key string) string {
+	prefix := cleanKey(authPrefix(ctx))
+	if prefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, prefix+pathSeparator)
+}
+
+// withAuth serves only the requests allowed by a, under the key prefix
+// it chose. Failing to authorize a request refuses it, responses depend
+// on the credentials of the request so they vary on them.
+func withAuth(a authorizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		varyOn(r, authForwardedHeaders...)
+		d, err := a.authorize(r)
+		if err != nil {
+			logError("Unable to authorize", "path", r.URL.Path, "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if d.status != 0 {
+			for name, v := range d.header {
+				w.Header()[name] = v
+			}
+			http.Error(w, http.StatusText(d.status), d.status)
+			return
+		}
+		if d.redirect != "" {
+			w.Header().Set("Cache-Control", "private, no-store")
+			http.Redirect(w, r, d.redirect, http.StatusFound)
+			return
+		}
+		setAccessUser(r, d.user)
+		if d.prefix != "" {
+			r = r.WithContext(context.WithValue(r.Context(), authPrefixKey{}, d.prefix))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
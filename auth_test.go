@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAuthService returns the URL of an auth service serving the
+// bearer token of each tenant under its own prefix, redirecting the
+// token "presigned" and refusing anything else.
+func newTestAuthService(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Original-Method") == "" || r.Header.Get("X-Original-URI") == "" {
+			http.Error(w, "missing the original request", http.StatusBadRequest)
+			return
+		}
+		switch token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token {
+		case "a", "b":
+			w.Header().Set(authPrefixHeader, "tenants/"+token)
+		case "presigned":
+			w.Header().Set(authRedirectHeader, "https://s3.example.com/bucket"+r.Header.Get("X-Original-URI")+"?X-Amz-Signature=sig")
+		case "broken":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="s3www"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestAuthService(t *testing.T) {
+	store := newFakeStore()
+	store.put("tenants/a/index.html", "tenant a")
+	store.put("tenants/b/index.html", "tenant b")
+	store.put("index.html", "shared")
+	h := withAuth(newAuthService(newTestAuthService(t), time.Second), newTestS3(t, store))
+
+	for _, tc := range []struct {
+		token    string
+		path     string
+		code     int
+		body     string
+		location string
+	}{
+		{"a", "/", http.StatusOK, "tenant a", ""},
+		{"b", "/index.html", http.StatusOK, "tenant b", ""},
+		// A tenant cannot climb out of its prefix.
+		{"a", "/../b/index.html", http.StatusNotFound, "", ""},
+		{"a", "/b/index.html", http.StatusNotFound, "", ""},
+		{"", "/", http.StatusUnauthorized, "", ""},
+		{"presigned", "/video.mp4", http.StatusFound, "", "https://s3.example.com/bucket/video.mp4?X-Amz-Signature=sig"},
+		{"broken", "/", http.StatusInternalServerError, "", ""},
+	} {
+		w := serve(h, tc.path, "Authorization", "Bearer "+tc.token)
+		if w.Code != tc.code {
+			t.Errorf("%q %s: got status %d, want %d", tc.token, tc.path, w.Code, tc.code)
+			continue
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%q %s: got body %q, want %q", tc.token, tc.path, w.Body.String(), tc.body)
+		}
+		if got := w.Header().Get("Location"); got != tc.location {
+			t.Errorf("%q %s: got Location %q, want %q", tc.token, tc.path, got, tc.location)
+		}
+		if tc.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q %s: no WWW-Authenticate challenge passed on", tc.token, tc.path)
+		}
+	}
+}
+
+func TestAuthPrefixHiddenFromListings(t *testing.T) {
+	store := newFakeStore()
+	for i := 0; i < 5; i++ {
+		store.put(fmt.Sprintf("tenants/a/docs/f%d.txt", i), "x")
+	}
+	store.put("tenants/a/docs/sub/g.txt", "x")
+	setGlobal(t, &enableListing, true)
+	setGlobal(t, &listingPageSize, 4)
+	h := withAuth(newAuthService(newTestAuthService(t), time.Second), newTestS3(t, store))
+
+	w := serve(h, "/docs/?format=json", "Authorization", "Bearer a")
+	if strings.Contains(w.Body.String(), "tenants") {
+		t.Errorf("JSON listing discloses the key prefix: %s", w.Body.String())
+	}
+	var page listing
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Prefix != "docs/" || len(page.Entries) != 4 || page.Entries[0].Key != "docs/f0.txt" {
+		t.Errorf("got prefix %q and entries %+v, want docs/ and keys relative to the tenant", page.Prefix, page.Entries)
+	}
+
+	// The continuation leads to the rest of the directory.
+	w = serve(h, "/docs/?format=json&continuation="+page.Continuation, "Authorization", "Bearer a")
+	if strings.Contains(w.Body.String(), "tenants") {
+		t.Errorf("second JSON page discloses the key prefix: %s", w.Body.String())
+	}
+	var next listing
+	if err := json.Unmarshal(w.Body.Bytes(), &next); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Entries) != 2 || next.Entries[0].Key != "docs/f4.txt" || next.Entries[1].Key != "docs/sub/" {
+		t.Errorf("got second page %+v, want docs/f4.txt and docs/sub/", next.Entries)
+	}
+
+	w = serve(h, "/docs/", "Authorization", "Bearer a")
+	if body := html.UnescapeString(w.Body.String()); strings.Contains(body, "tenants") || !strings.Contains(body, "Index of /docs/") {
+		t.Errorf("HTML listing discloses the key prefix: %s", body)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuth is an authorizer gating the whole site behind HTTP Basic
+// authentication, for users set with -auth-user and -auth-pass or listed
+// in an htpasswd file.
+type basicAuth struct {
+	realm string
+	// users maps each user to its password hash, as stored in htpasswd
+	// files, or to its password prefixed with "plain:".
+	users map[string]string
+
+	// verified remembers the credentials that matched a bcrypt hash,
+	// which is far too slow to check on every request of a page.
+	verified sync.Map
+}
+
+// newBasicAuth returns the authorizer of the users of the htpasswd file,
+// if any, and of user with the password pass, if set.
+func newBasicAuth(realm, user, pass, file string) (*basicAuth, error) {
+	a := &basicAuth{realm: realm, users: make(map[string]string)}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err = a.parseHtpasswd(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if user != "" {
+		if pass == "" {
+			return nil, fmt.Errorf("-auth-user %q needs a password set with -auth-pass", user)
+		}
+		a.users[user] = "plain:" + pass
+	}
+	if len(a.users) == 0 {
+		return nil, fmt.Errorf("basic authentication has no users")
+	}
+	return a, nil
+}
+
+// parseHtpasswd reads the USER:HASH lines of an htpasswd file, with
+// bcrypt or {SHA} hashes.
+func (a *basicAuth) parseHtpasswd(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return fmt.Errorf("line %d is not of the form USER:HASH", n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("line %d: the hash of %q is not supported, create it with htpasswd -B", n, user)
+		}
+		a.users[user] = hash
+	}
+	return scanner.Err()
+}
+
+// verify reports whether pass is the password of user.
+func (a *basicAuth) verify(user, pass string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "plain:"):
+		want := sha256.Sum256([]byte(strings.TrimPrefix(hash, "plain:")))
+		got := sha256.Sum256([]byte(pass))
+		return subtle.ConstantTimeCompare(want[:], got[:]) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		got := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(got)) == 1
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + pass))
+	if _, ok := a.verified.Load(key); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	a.verified.Store(key, true)
+	return true
+}
+
+func (a *basicAuth) authorize(r *http.Request) (authDecision, error) {
+	if user, pass, ok := r.BasicAuth(); ok && a.verify(user, pass) {
+		return authDecision{user: user}, nil
+	}
+	header := make(http.Header)
+	header.Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.realm))
+	return authDecision{status: http.StatusUnauthorized, header: header}, nil
+}
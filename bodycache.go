@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// bodyCache is an in-memory LRU cache of small object bodies, keyed by
+// object name and remembering the ETag they were fetched with. Expired
+// entries are either revalidated with a cheap StatObject, keeping the
+// body when the ETag did not change, or simply fetched again.
+type bodyCache struct {
+	maxSize       int64
+	maxObjectSize int64
+	ttl           time.Duration
+	revalidate    bool
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type bodyCacheEntry struct {
+	key     string
+	body    []byte
+	info    minio.ObjectInfo
+	fetched time.Time
+	ttl     time.Duration
+}
+
+// memoryObject is an object body served from the body cache.
+type memoryObject struct {
+	*bytes.Reader
+	info   minio.ObjectInfo
+	status string
+}
+
+func (m *memoryObject) Close() error {
+	return nil
+}
+
+func (m *memoryObject) Stat() (minio.ObjectInfo, error) {
+	return m.info, nil
+}
+
+func (m *memoryObject) isStale() bool {
+	return m.status == cacheStale
+}
+
+func (m *memoryObject) cacheStatus() string {
+	return m.status
+}
+
+func newBodyCache(maxSize, maxObjectSize int64, ttl time.Duration, revalidate bool) *bodyCache {
+	return &bodyCache{
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		ttl:           ttl,
+		revalidate:    revalidate,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+}
+
+// lookup returns the entry for key, marking it as recently used. The
+// returned entry must not be modified.
+func (c *bodyCache) lookup(key string) (bodyCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return bodyCacheEntry{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return *elem.Value.(*bodyCacheEntry), true
+}
+
+// refresh resets the age of the entry for key if it still holds etag.
+func (c *bodyCache) refresh(key, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		if e := elem.Value.(*bodyCacheEntry); e.info.ETag == etag {
+			e.fetched = time.Now()
+		}
+	}
+}
+
+func (c *bodyCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *bodyCache) removeElement(elem *list.Element) {
+	e := c.lru.Remove(elem).(*bodyCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.body))
+}
+
+// flush drops every entry.
+func (c *bodyCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = 0
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// add stores body for the TTL of its content type, evicting the least
+// recently used entries to stay within maxSize. Bodies with a zero TTL
+// are not stored.
+func (c *bodyCache) add(key string, body []byte, info minio.ObjectInfo) {
+	ttl := cacheTTLFor(key, info.ContentType, c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&bodyCacheEntry{
+		key:     key,
+		body:    body,
+		info:    info,
+		fetched: time.Now(),
+		ttl:     ttl,
+	})
+	c.size += int64(len(body))
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// object returns the cached body as an object served with the X-Cache
+// status.
+func (e bodyCacheEntry) object(status string) *memoryObject {
+	return &memoryObject{Reader: bytes.NewReader(e.body), info: e.info, status: status}
+}
+
+// get returns the object stored under key from memory when a valid copy
+// is cached, and from next otherwise, keeping its body when it is small
+// enough. An expired copy is served stale when S3 is failing, as long as
+// allowed by maxStale.
+func (c *bodyCache) get(ctx context.Context, s3 *S3, key string, next func(context.Context, *S3, string) (s3Object, error)) (s3Object, error) {
+	e, cached := c.lookup(key)
+	if cached && time.Since(e.fetched) < e.ttl {
+		return e.object(cacheHit), nil
+	}
+	if cached && c.revalidate {
+		info, err := statObject(ctx, s3, key)
+		switch {
+		case err == nil && info.ETag == e.info.ETag:
+			c.refresh(key, e.info.ETag)
+			return e.object(cacheRevalidated), nil
+		case canServeStale(e.fetched, e.ttl, err):
+			return e.object(cacheStale), nil
+		case err != nil:
+			if isNotFound(err) {
+				c.remove(key)
+			}
+			return nil, err
+		}
+	}
+
+	obj, err := next(ctx, s3, key)
+	if err != nil {
+		if cached && canServeStale(e.fetched, e.ttl, err) {
+			return e.object(cacheStale), nil
+		}
+		if cached && isNotFound(err) {
+			c.remove(key)
+		}
+		return nil, err
+	}
+	info, err := obj.Stat()
+	if err != nil || info.Size > c.maxObjectSize || info.Size > c.maxSize {
+		if cached {
+			c.remove(key)
+		}
+		return obj, nil
+	}
+	body, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, body, info)
+	return &memoryObject{Reader: bytes.NewReader(body), info: info, status: cacheStatusOf(obj)}, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// readBodyCache gets key through c, returning the body and X-Cache status.
+func readBodyCache(t *testing.T, c *bodyCache, s3 *S3, key string) (string, string) {
+	t.Helper()
+	obj, err := c.get(context.Background(), s3, key, fetchUncachedObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	data, err := ioutil.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), cacheStatusOf(obj)
+}
+
+func TestBodyCacheRevalidation(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.css", "body{}")
+	s3 := newTestS3(t, store)
+	c := newBodyCache(1<<20, 1<<20, time.Millisecond, true)
+
+	readBodyCache(t, c, s3, "a.css")
+	time.Sleep(2 * time.Millisecond)
+	body, status := readBodyCache(t, c, s3, "a.css")
+	if body != "body{}" || status != cacheRevalidated {
+		t.Errorf("unchanged ETag: got %q %s, want %q %s", body, status, "body{}", cacheRevalidated)
+	}
+	if gets, stats := store.count(&store.gets), store.count(&store.stats); gets != 1 || stats != 1 {
+		t.Errorf("unchanged ETag: %d GETs and %d stats, want 1 and 1", gets, stats)
+	}
+
+	store.put("a.css", "p{}")
+	time.Sleep(2 * time.Millisecond)
+	body, status = readBodyCache(t, c, s3, "a.css")
+	if body != "p{}" || status != cacheMiss {
+		t.Errorf("changed ETag: got %q %s, want %q %s", body, status, "p{}", cacheMiss)
+	}
+	if gets := store.count(&store.gets); gets != 2 {
+		t.Errorf("changed ETag: %d GETs, want 2", gets)
+	}
+}
+
+func TestBodyCacheHitAndRefetch(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.css", "body{}")
+	s3 := newTestS3(t, store)
+
+	c := newBodyCache(1<<20, 1<<20, time.Hour, false)
+	for i, want := range []string{cacheMiss, cacheHit} {
+		if _, status := readBodyCache(t, c, s3, "a.css"); status != want {
+			t.Errorf("read %d: got %s, want %s", i, status, want)
+		}
+	}
+
+	// Without -revalidate expired bodies are fetched again.
+	c = newBodyCache(1<<20, 1<<20, time.Millisecond, false)
+	readBodyCache(t, c, s3, "a.css")
+	time.Sleep(2 * time.Millisecond)
+	readBodyCache(t, c, s3, "a.css")
+	if stats := store.count(&store.stats); stats != 0 {
+		t.Errorf("%d stats without revalidation, want none", stats)
+	}
+	if gets := store.count(&store.gets); gets != 3 {
+		t.Errorf("%d GETs, want 3", gets)
+	}
+}
+
+func TestBodyCacheSizeLimits(t *testing.T) {
+	store := newFakeStore()
+	store.put("big.bin", "0123456789")
+	s3 := newTestS3(t, store)
+	c := newBodyCache(1<<20, 4, time.Hour, false)
+
+	readBodyCache(t, c, s3, "big.bin")
+	if _, ok := c.lookup("big.bin"); ok {
+		t.Error("cached a body over the maximum object size")
+	}
+}
+
+func TestXCacheHeader(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.css", "body{}")
+	s3 := newTestS3(t, store)
+	s3.bodyCache = newBodyCache(1<<20, 1<<20, 20*time.Millisecond, true)
+
+	if w := serve(s3, "/a.css"); w.Header().Get("X-Cache") != "" {
+		t.Errorf("got X-Cache %q without -x-cache-header", w.Header().Get("X-Cache"))
+	}
+	s3.bodyCache = newBodyCache(1<<20, 1<<20, 20*time.Millisecond, true)
+	setGlobal(t, &xCacheHeader, true)
+	for i, want := range []string{cacheMiss, cacheHit, cacheHit} {
+		if got := serve(s3, "/a.css").Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: got X-Cache %q, want %q", i+1, got, want)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if got := serve(s3, "/a.css").Header().Get("X-Cache"); got != cacheRevalidated {
+		t.Errorf("expired entry with the same ETag: got X-Cache %q, want %q", got, cacheRevalidated)
+	}
+	store.put("a.css", "body{color:red}")
+	time.Sleep(30 * time.Millisecond)
+	if got := serve(s3, "/a.css").Header().Get("X-Cache"); got != cacheMiss {
+		t.Errorf("expired entry with another ETag: got X-Cache %q, want %q", got, cacheMiss)
+	}
+	// Without a body cache every object comes from S3.
+	s3.bodyCache = nil
+	if got := serve(s3, "/a.css").Header().Get("X-Cache"); got != cacheMiss {
+		t.Errorf("no body cache: got X-Cache %q, want %q", got, cacheMiss)
+	}
+}
+
+func TestCacheKeyIgnoresQuery(t *testing.T) {
+	store := newFakeStore()
+	store.put("app.js", "let a")
+	s3 := newTestS3(t, store)
+	s3.bodyCache = newBodyCache(1<<20, 1<<20, time.Hour, false)
+
+	for _, target := range []string{"/app.js?v=1", "/app.js?v=2", "/app.js?v=3&x=y", "/app.js"} {
+		if w := serve(s3, target); w.Code != http.StatusOK || w.Body.String() != "let a" {
+			t.Errorf("%s: got status %d and body %q, want app.js", target, w.Code, w.Body.String())
+		}
+	}
+	if gets := store.count(&store.gets); gets != 1 {
+		t.Errorf("%d GETs, want 1 for every query", gets)
+	}
+	s3.bodyCache.mu.Lock()
+	defer s3.bodyCache.mu.Unlock()
+	if len(s3.bodyCache.entries) != 1 {
+		t.Errorf("got %d body cache entries, want 1 for every query", len(s3.bodyCache.entries))
+	}
+}
+
+func TestCacheTTLByContentType(t *testing.T) {
+	rules, err := parseCacheTTLs("text/html=20ms, image/*=1h, .woff2=0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &cacheTTLs, rules)
+	store := newFakeStore()
+	store.put("page.html", "<p>")
+	store.put("logo.png", "\x89PNG")
+	// The extension is unknown, the stored type applies.
+	store.put("photo.raw", "raw").ContentType = "image/x-raw"
+	store.put("font.woff2", "font")
+	store.put("data.csv", "a,b")
+	s3 := newTestS3(t, store)
+	c := newBodyCache(1<<20, 1<<20, time.Hour, false)
+
+	for _, key := range []string{"page.html", "logo.png", "photo.raw", "font.woff2", "data.csv"} {
+		readBodyCache(t, c, s3, key)
+	}
+	time.Sleep(30 * time.Millisecond)
+	for key, want := range map[string]string{
+		// HTML expired, images and the rest keep the default hour.
+		"page.html": cacheMiss,
+		"logo.png":  cacheHit,
+		"photo.raw": cacheHit,
+		"data.csv":  cacheHit,
+		// A zero TTL is never cached.
+		"font.woff2": cacheMiss,
+	} {
+		if _, status := readBodyCache(t, c, s3, key); status != want {
+			t.Errorf("%s: got %s, want %s", key, status, want)
+		}
+	}
+
+	for _, invalid := range []string{"html=1s", "text/html", "text/html=soon", ".css=-1s"} {
+		if _, err := parseCacheTTLs(invalid); err == nil {
+			t.Errorf("accepted -cache-ttl %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// cacheControlRule sets the Cache-Control of the responses to request
+// paths matching match.
+type cacheControlRule struct {
+	pattern string
+	match   *regexp.Regexp
+	value   string
+}
+
+// parseCacheControlRule parses a rule of the form PATTERN=VALUE, e.g.
+// "/assets/*=max-age=31536000, immutable". PATTERN is an absolute path
+// where '*' matches any characters, or a regular expression when it
+// starts with '~' as in "~\.html$=no-cache".
+func parseCacheControlRule(value string) (cacheControlRule, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return cacheControlRule{}, fmt.Errorf("cache control %q is not of the form PATTERN=VALUE", value)
+	}
+	rule := cacheControlRule{pattern: value, value: strings.TrimSpace(value[i+1:])}
+
+	match, err := compilePathPattern(value[:i])
+	if err != nil {
+		return cacheControlRule{}, fmt.Errorf("cache control %q %v", value, err)
+	}
+	rule.match = match
+	return rule, nil
+}
+
+// cacheControlsFlag implements flag.Value for the repeatable
+// -cache-control flag.
+type cacheControlsFlag []cacheControlRule
+
+func (c *cacheControlsFlag) String() string {
+	var rules []string
+	for _, rule := range *c {
+		rules = append(rules, rule.pattern)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (c *cacheControlsFlag) repeatable() {}
+
+func (c *cacheControlsFlag) Set(value string) error {
+	rule, err := parseCacheControlRule(value)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, rule)
+	return nil
+}
+
+// compilePathPattern compiles a pattern of request paths, an absolute path
+// where '*' matches any characters or a regular expression after '~'.
+func compilePathPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "~") {
+		match, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			return nil, fmt.Errorf("has an invalid pattern: %v", err)
+		}
+		return match, nil
+	}
+	if !strings.HasPrefix(pattern, pathSeparator) {
+		return nil, errors.New("must match an absolute path")
+	}
+	parts := strings.Split(pattern, "*")
+	for k := range parts {
+		parts[k] = regexp.QuoteMeta(parts[k])
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$"), nil
+}
+
+// setCacheControl sets the Cache-Control of the response to r, immutable
+// when its path matches -immutable-pattern, which overrides any other
+// setting, or else from the first -cache-control rule matching its
+// canonical path.
+func setCacheControl(w http.ResponseWriter, r *http.Request) {
+	if setImmutable(w, r) {
+		return
+	}
+	p := canonicalPath(r.URL.Path)
+	for _, rule := range rules().cacheControls {
+		if rule.match.MatchString(p) {
+			w.Header().Set("Cache-Control", rule.value)
+			return
+		}
+	}
+}
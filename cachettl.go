@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"time"
+)
+
+// cacheTTLRule keeps the cached bodies of the objects it matches for ttl.
+// It matches a media type such as "text/html", every subtype of a type
+// with "image/*", or an extension such as ".html".
+type cacheTTLRule struct {
+	match string
+	ttl   time.Duration
+}
+
+// cacheTTLs is the parsed -cache-ttl, the first matching rule wins.
+var cacheTTLs []cacheTTLRule
+
+// parseCacheTTLs parses a comma separated list of MATCH=TTL rules, e.g.
+// "text/html=30s,image/*=24h,.woff2=168h".
+func parseCacheTTLs(list string) ([]cacheTTLRule, error) {
+	var rules []cacheTTLRule
+	for _, rule := range strings.Split(list, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("cache TTL %q is not of the form TYPE=TTL", rule)
+		}
+		match := strings.ToLower(strings.TrimSpace(rule[:i]))
+		if !strings.HasPrefix(match, ".") && !strings.Contains(match, "/") {
+			return nil, fmt.Errorf("cache TTL %q must match a media type or an extension", rule)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(rule[i+1:]))
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("cache TTL %q has an invalid duration", rule)
+		}
+		rules = append(rules, cacheTTLRule{match: match, ttl: ttl})
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule applies to an object with the
+// extension ext and the media type mediaType.
+func (rule cacheTTLRule) matches(ext, mediaType string) bool {
+	switch {
+	case strings.HasPrefix(rule.match, "."):
+		return rule.match == ext
+	case strings.HasSuffix(rule.match, "/*"):
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(rule.match, "*"))
+	default:
+		return rule.match == mediaType
+	}
+}
+
+// cacheTTLFor returns how long the body of the object stored under key
+// with contentType is cached, def unless a rule of cacheTTLs matches. The
+// media type is the one the object is served with, derived from the
+// extension before the stored one.
+func cacheTTLFor(key, contentType string, def time.Duration) time.Duration {
+	if len(cacheTTLs) == 0 {
+		return def
+	}
+	ext := strings.ToLower(path.Ext(key))
+	if ctype := mime.TypeByExtension(ext); ctype != "" {
+		contentType = ctype
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	for _, rule := range cacheTTLs {
+		if rule.matches(ext, mediaType) {
+			return rule.ttl
+		}
+	}
+	return def
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// certStore holds the certificate served over TLS, with its latest OCSP
+// response stapled when enabled. It is handed out to connections through
+// tls.Config.GetCertificate so that it can be swapped at runtime, either
+// by a reload or by a fresh staple.
+type certStore struct {
+	certFile, keyFile string
+	cert              atomic.Value // *tls.Certificate
+
+	// mu serializes the swaps of cert.
+	mu sync.Mutex
+	// restaple is signalled when the certificate was reloaded and needs
+	// a new OCSP response, nil unless stapling.
+	restaple chan struct{}
+}
+
+// certReloadAttempts is the number of times a reload tries to load the
+// certificate and key pair, certReloadDelay apart, since rotations
+// commonly replace the files one after the other.
+const certReloadAttempts = 5
+
+var certReloadDelay = time.Second
+
+// loadKeyPair loads a certificate and its matching private key.
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &certStore{certFile: certFile, keyFile: keyFile}
+	c.cert.Store(cert)
+	return c, nil
+}
+
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load().(*tls.Certificate), nil
+}
+
+// reload loads the certificate and key files again and swaps them in
+// atomically, connections get either the previous or the new certificate.
+// The previous certificate is kept when the new pair fails to load, does
+// not match or has expired.
+func (c *certStore) reload() error {
+	var (
+		cert *tls.Certificate
+		err  error
+	)
+	for attempt := 1; ; attempt++ {
+		if cert, err = loadKeyPair(c.certFile, c.keyFile); err == nil {
+			break
+		}
+		if attempt == certReloadAttempts {
+			return err
+		}
+		time.Sleep(certReloadDelay)
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("the certificate %q expired on %s", c.certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	c.mu.Lock()
+	c.cert.Store(cert)
+	c.mu.Unlock()
+	if c.restaple != nil {
+		select {
+		case c.restaple <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// handleReloadSignal reloads the certificate on every SIGHUP.
+func (c *certStore) handleReloadSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			if err := c.reload(); err != nil {
+				logError("Unable to reload the TLS certificate, keeping the current one", "err", err)
+				continue
+			}
+			logInfo("Reloaded the TLS certificate", "file", c.certFile)
+		}
+	}()
+}
+
+// ocspClient fetches OCSP responses.
+var ocspClient = &http.Client{Timeout: 10 * time.Second}
+
+// staple fetches a fresh OCSP response for the current certificate from
+// its responder and staples it, returning when to refresh it: halfway to
+// its next update.
+func (c *certStore) staple() (time.Time, error) {
+	cur := c.cert.Load().(*tls.Certificate)
+	if len(cur.Leaf.OCSPServer) == 0 {
+		return time.Time{}, errors.New("the certificate names no OCSP responder")
+	}
+	if len(cur.Certificate) < 2 {
+		return time.Time{}, errors.New("the certificate file has no issuer certificate")
+	}
+	issuer, err := x509.ParseCertificate(cur.Certificate[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	req, err := ocsp.CreateRequest(cur.Leaf, issuer, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := ocspClient.Post(cur.Leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("OCSP responder answered %s", resp.Status)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return time.Time{}, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(raw, cur.Leaf, issuer)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if parsed.Status == ocsp.Revoked {
+		logWarn("The OCSP responder reports the certificate as revoked", "file", c.certFile)
+	}
+
+	c.mu.Lock()
+	// The certificate may have been reloaded in the meantime, the
+	// response is only good for the one it was fetched for.
+	if c.cert.Load().(*tls.Certificate) == cur {
+		stapled := *cur
+		stapled.OCSPStaple = raw
+		c.cert.Store(&stapled)
+	}
+	c.mu.Unlock()
+
+	if parsed.NextUpdate.IsZero() {
+		return time.Now().Add(time.Hour), nil
+	}
+	return parsed.ThisUpdate.Add(parsed.NextUpdate.Sub(parsed.ThisUpdate) / 2), nil
+}
+
+// keepStapled staples an OCSP response to the certificate and keeps it
+// fresh, retrying every few minutes when the responder fails, and staples
+// a reloaded certificate right away.
+func (c *certStore) keepStapled() {
+	c.restaple = make(chan struct{}, 1)
+	go func() {
+		for {
+			next, err := c.staple()
+			if err != nil {
+				logWarn("Unable to staple an OCSP response", "err", err)
+				next = time.Now().Add(5 * time.Minute)
+			}
+			wait := time.Until(next)
+			if wait < time.Minute {
+				wait = time.Minute
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-c.restaple:
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// maxSessionTicketKeys is the number of session ticket keys kept, tickets
+// issued with a retired key are still accepted until it falls off.
+const maxSessionTicketKeys = 3
+
+// rotateSessionTickets makes srv encrypt session tickets with a new random
+// key every interval. Since servers work on a copy of their TLS config,
+// connections get the current keys through GetConfigForClient.
+func rotateSessionTickets(srv *http.Server, interval time.Duration) error {
+	base := srv.TLSConfig.Clone()
+	var current atomic.Value
+	var keys [][32]byte
+
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > maxSessionTicketKeys {
+			keys = keys[:maxSessionTicketKeys]
+		}
+		config := base.Clone()
+		config.SetSessionTicketKeys(keys)
+		current.Store(config)
+		return nil
+	}
+	if err := rotate(); err != nil {
+		return err
+	}
+
+	srv.TLSConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return current.Load().(*tls.Config), nil
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := rotate(); err != nil {
+				logError("Unable to rotate the session ticket keys", "err", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// writeKeyPair writes a certificate for 127.0.0.1 issued by ca, naming
+// ocspServer as its OCSP responder, followed by the certificate of ca,
+// and its key to PEM files, returning their paths.
+func writeKeyPair(t *testing.T, ca tls.Certificate, ocspServer string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{ocspServer},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})...)
+	if err := os.WriteFile(certFile, chain, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsGet gets url with client, returning the state of the connection.
+func tlsGet(t *testing.T, client *http.Client, url string) *tls.ConnectionState {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.TLS
+}
+
+func TestOCSPStapling(t *testing.T) {
+	ca := testCert(t, "test CA", true, nil)
+	var requests int
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca.Leaf, ca.Leaf, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, ca.PrivateKey.(crypto.Signer))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	c, err := newCertStore(writeKeyPair(t, ca, responder.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := c.staple()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("asked the responder %d times, want once", requests)
+	}
+	if until := time.Until(next); until < 20*time.Minute || until > 40*time.Minute {
+		t.Errorf("refreshing in %s, want halfway to the next update", until)
+	}
+
+	srv := &http.Server{
+		TLSConfig: &tls.Config{GetCertificate: c.getCertificate},
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	state := tlsGet(t, client, "https://"+ln.Addr().String())
+	if len(state.OCSPResponse) == 0 {
+		t.Fatal("no OCSP response stapled")
+	}
+	resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, state.PeerCertificates[0], ca.Leaf)
+	if err != nil || resp.Status != ocsp.Good {
+		t.Errorf("stapled response %+v, %v, want a good status", resp, err)
+	}
+}
+
+func TestSessionTicketRotation(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	srv := newTLSServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), true, nil, false)
+	srv.TLSConfig.Certificates = []tls.Certificate{testCert(t, "127.0.0.1", false, nil)}
+	if err := rotateSessionTickets(srv, interval); err != nil {
+		t.Fatal(err)
+	}
+	url := serveTLS(t, srv, srv.TLSConfig.Certificates[0])
+
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+	}}
+	if tlsGet(t, client, url).DidResume {
+		t.Fatal("resumed the first session")
+	}
+	if !tlsGet(t, client, url).DidResume {
+		t.Error("did not resume with a current ticket")
+	}
+	// Every key the ticket could have been encrypted with is retired.
+	time.Sleep((maxSessionTicketKeys + 2) * interval)
+	if tlsGet(t, client, url).DidResume {
+		t.Error("resumed with a ticket of a retired key")
+	}
+}
+
+func TestCertReloadKeepsWorkingCertificate(t *testing.T) {
+	setGlobal(t, &certReloadDelay, time.Millisecond)
+	ca := testCert(t, "test CA", true, nil)
+	certFile, keyFile := writeKeyPair(t, ca, "")
+	c, err := newCertStore(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	working, _ := c.getCertificate(nil)
+
+	// A certificate written over the working one, half way or for
+	// another key, is refused.
+	otherCert, otherKey := writeKeyPair(t, ca, "")
+	other, err := os.ReadFile(otherCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range [][]byte{[]byte("-----BEGIN CERTIFICATE-----\ntruncat"), other} {
+		if err := os.WriteFile(certFile, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.reload(); err == nil {
+			t.Error("reloaded a broken key pair")
+		}
+		if got, _ := c.getCertificate(nil); got != working {
+			t.Error("the working certificate was replaced by a broken one")
+		}
+	}
+
+	// A complete new pair replaces it.
+	for src, dst := range map[string]string{otherCert: certFile, otherKey: keyFile} {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.getCertificate(nil); got == working {
+		t.Error("the new key pair was not swapped in")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// checkConfig validates the resolved configuration against the backend
+// without serving anything: the credentials must be able to reach the
+// bucket, the objects the configuration refers to must exist and the
+// TLS material must load.
+func checkConfig(ctx context.Context, s3 *S3) error {
+	found, err := s3.Client.BucketExists(ctx, s3.bucket)
+	if err != nil {
+		return fmt.Errorf("unable to access bucket %q: %v", s3.bucket, err)
+	}
+	if !found {
+		return fmt.Errorf("bucket %q does not exist", s3.bucket)
+	}
+
+	if warmupFile != "" {
+		if _, err = s3.Client.StatObject(ctx, s3.bucket, warmupFile, minio.StatObjectOptions{}); err != nil {
+			return fmt.Errorf("unable to read warmup file %q: %v", warmupFile, err)
+		}
+	}
+
+	for code, object := range errorPages {
+		if _, err = s3.Client.StatObject(ctx, s3.bucket, object, minio.StatObjectOptions{}); err != nil {
+			// Missing error pages fall back to plain text errors.
+			logError("Error page is not usable", "status", code, "object", object, "err", err)
+		}
+	}
+
+	if tlsCert != "" || tlsKey != "" {
+		if _, err = tls.LoadX509KeyPair(tlsCert, tlsKey); err != nil {
+			return fmt.Errorf("unable to load TLS certificate: %v", err)
+		}
+	}
+	if clientCA != "" {
+		if _, err = loadCertPool(ctx, s3, clientCA); err != nil {
+			return fmt.Errorf("unable to load client CA: %v", err)
+		}
+	}
+	return nil
+}
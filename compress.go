@@ -0,0 +1,259 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress enables the compression of responses on the fly with -compress.
+var compress bool
+
+// compressMinSize is the size of the smallest object compressed, smaller
+// ones gain too little to be worth it.
+var compressMinSize int64 = 1 << 10
+
+// compressTypes are the media types compressed, a trailing "/*" matches
+// every subtype.
+var compressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// compressWriter is a compressing writer that can be reused for another
+// response once reset.
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// compressor creates the writers of a content encoding at its level,
+// pooling them since some are costly to allocate.
+type compressor struct {
+	pool sync.Pool
+}
+
+// pooledWriter returns its writer to the pool of c once closed.
+type pooledWriter struct {
+	compressWriter
+	c *compressor
+}
+
+func (w pooledWriter) Close() error {
+	err := w.compressWriter.Close()
+	w.c.pool.Put(w.compressWriter)
+	return err
+}
+
+// writer returns a writer compressing into w.
+func (c *compressor) writer(w io.Writer) io.WriteCloser {
+	cw := c.pool.Get().(compressWriter)
+	cw.Reset(w)
+	return pooledWriter{cw, c}
+}
+
+// compressLevels are the levels of the encodings applied on the fly, the
+// defaults trade some ratio for speed since responses are compressed
+// on every request.
+var compressLevels = map[string]int{
+	"br":   4,
+	"gzip": gzip.DefaultCompression,
+	"zstd": 3,
+}
+
+// newCompressWriter returns a writer of the content encoding enc at level,
+// failing when the level is out of range for the encoding.
+func newCompressWriter(enc string, level int) (compressWriter, error) {
+	switch enc {
+	case "br":
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return nil, fmt.Errorf("br level %d must be between %d and %d", level, brotli.BestSpeed, brotli.BestCompression)
+		}
+		return brotli.NewWriterLevel(nil, level), nil
+	case "gzip":
+		if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+			return nil, fmt.Errorf("gzip level %d must be between %d and %d", level, gzip.BestSpeed, gzip.BestCompression)
+		}
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w, nil
+	case "zstd":
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("zstd level %d must be between 1 and 22", level)
+		}
+		// Browsers refuse windows larger than 8MiB.
+		return zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(8<<20))
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q, expected 'br', 'gzip' or 'zstd'", enc)
+}
+
+// compressors create the writers of each content encoding applied on the
+// fly.
+var compressors = map[string]*compressor{}
+
+// compressEncodings are the keys of compressors, in order of preference.
+var compressEncodings []string
+
+// setupCompressors sets up the compressors of the comma separated list of
+// encodings, in order of preference, at the levels of the comma separated
+// ENCODING=LEVEL pairs of levelList.
+func setupCompressors(list, levelList string) error {
+	for _, pair := range strings.Split(levelList, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("compression level %q is not of the form ENCODING=LEVEL", pair)
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return fmt.Errorf("compression level %q is not a number", pair)
+		}
+		compressLevels[strings.ToLower(strings.TrimSpace(pair[:i]))] = level
+	}
+
+	for _, enc := range strings.Split(list, ",") {
+		if enc = strings.ToLower(strings.TrimSpace(enc)); enc == "" {
+			continue
+		}
+		enc, level := enc, compressLevels[enc]
+		// Fail early on an invalid level rather than on the first
+		// response.
+		w, err := newCompressWriter(enc, level)
+		if err != nil {
+			return err
+		}
+		c := &compressor{}
+		c.pool.New = func() interface{} {
+			w, _ := newCompressWriter(enc, level)
+			return w
+		}
+		c.pool.Put(w)
+		compressors[enc] = c
+		compressEncodings = append(compressEncodings, enc)
+	}
+	return nil
+}
+
+// parseCompressTypes parses a comma separated list of media types.
+func parseCompressTypes(list string) []string {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// compressible reports whether the media type ctype is one of
+// compressTypes.
+func compressible(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	for _, t := range compressTypes {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressEncoding returns the content encoding the object info is
+// compressed with on the fly in the response to r, empty to serve it as
+// stored. Objects stored compressed are left alone, and so are range
+// requests since ranges have to count the bytes of the stored object.
+// Responses of unknown length, with a negative size, are compressed
+// whatever their size.
+func compressEncoding(w http.ResponseWriter, r *http.Request, info objectInfo) string {
+	if !compress || (info.Size() >= 0 && info.Size() < compressMinSize) || info.Metadata.Get("Content-Encoding") != "" {
+		return ""
+	}
+	ctype := w.Header().Get("Content-Type")
+	if ctype == "" {
+		ctype = mime.TypeByExtension(path.Ext(info.Key))
+	}
+	if !compressible(ctype) {
+		return ""
+	}
+	varyOn(r, "Accept-Encoding")
+	if r.Header.Get("Range") != "" {
+		return ""
+	}
+	for _, enc := range rankEncodings(r.Header.Get("Accept-Encoding"), compressEncodings) {
+		if enc == "identity" {
+			return ""
+		}
+		return enc
+	}
+	return ""
+}
+
+// compressResponseWriter compresses the body of a 200 OK response with
+// encoding, leaving any other response as is.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	head        bool
+	wroteHeader bool
+	cw          io.WriteCloser
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		// The compressed bytes differ from those of the object, and
+		// Not Modified answers have to carry the same ETag.
+		if code == http.StatusOK || code == http.StatusNotModified {
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+		if code == http.StatusOK {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", w.encoding)
+			if !w.head {
+				w.cw = compressors[w.encoding].writer(w.ResponseWriter)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.cw != nil {
+		return w.cw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// close flushes the end of the compressed body.
+func (w *compressResponseWriter) close() error {
+	if w.cw == nil {
+		return nil
+	}
+	return w.cw.Close()
+}
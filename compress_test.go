@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gzipped returns s compressed with gzip.
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// setupCompression enables on the fly compression with encodings for the
+// duration of the test.
+func setupCompression(t *testing.T, encodings string) {
+	t.Helper()
+	setGlobal(t, &compress, true)
+	setGlobal(t, &compressMinSize, 0)
+	setGlobal(t, &compressors, map[string]*compressor{})
+	setGlobal(t, &compressEncodings, nil)
+	if err := setupCompressors(encodings, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRangeDisablesCompression(t *testing.T) {
+	setupCompression(t, "gzip")
+	text := strings.Repeat("0123456789", 100)
+	store := newFakeStore()
+	store.put("page.html", text)
+	s3 := withVary(newTestS3(t, store))
+
+	w := serve(s3, "/page.html", "Accept-Encoding", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got Content-Encoding %q without a range, want gzip", w.Header().Get("Content-Encoding"))
+	}
+
+	for _, rng := range []string{"bytes=10-19", "bytes=-5", "bytes=990-"} {
+		w := serve(s3, "/page.html", "Accept-Encoding", "gzip", "Range", rng)
+		if w.Code != http.StatusPartialContent {
+			t.Errorf("%s: got status %d, want %d", rng, w.Code, http.StatusPartialContent)
+			continue
+		}
+		// The range counts bytes of the object as stored, served as is.
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: got Content-Encoding %q, want identity", rng, got)
+		}
+		if got := w.Body.String(); got == "" || !strings.Contains(text, got) {
+			t.Errorf("%s: got body %q, not a slice of the object", rng, got)
+		}
+		if !hasVary(w.Header(), "Accept-Encoding") {
+			t.Errorf("%s: got Vary %q, want Accept-Encoding", rng, varyNames(w.Header()))
+		}
+	}
+	if w := serve(s3, "/page.html", "Accept-Encoding", "gzip", "Range", "bytes=10-19"); w.Body.String() != "0123456789" {
+		t.Errorf("got body %q, want 0123456789", w.Body.String())
+	}
+}
+
+func TestRangeOfPrecompressed(t *testing.T) {
+	setGlobal(t, &precompressed, []string{"gzip"})
+	text := strings.Repeat("precompressed ", 50)
+	compressed := gzipped(t, text)
+	store := newFakeStore()
+	store.put("app.js", text)
+	store.put("app.js.gz", compressed)
+	s3 := newTestS3(t, store)
+
+	w := serve(s3, "/app.js", "Accept-Encoding", "gzip", "Range", "bytes=0-9")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("got Content-Encoding %q, want gzip", got)
+	}
+	// Content-Range counts compressed bytes.
+	if got, want := w.Header().Get("Content-Range"), "bytes 0-9/"+strconv.Itoa(len(compressed)); got != want {
+		t.Errorf("got Content-Range %q, want %q", got, want)
+	}
+	if got := w.Body.String(); got != compressed[:10] {
+		t.Errorf("got body %q, want the first compressed bytes %q", got, compressed[:10])
+	}
+
+	// Without gzip the range is one of the uncompressed object.
+	w = serve(s3, "/app.js", "Range", "bytes=0-9")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != text[:10] {
+		t.Errorf("identity: got Content-Encoding %q and body %q, want %q", w.Header().Get("Content-Encoding"), w.Body.String(), text[:10])
+	}
+	if got, want := w.Header().Get("Content-Range"), "bytes 0-9/"+strconv.Itoa(len(text)); got != want {
+		t.Errorf("identity: got Content-Range %q, want %q", got, want)
+	}
+}
+
+// TestRangeWithCompressionAndPrecompressed checks that with both enabled,
+// a range of an object with a sibling is served from the sibling rather
+// than compressed on the fly.
+func TestRangeWithCompressionAndPrecompressed(t *testing.T) {
+	setupCompression(t, "gzip")
+	setGlobal(t, &precompressed, []string{"gzip"})
+	text := strings.Repeat("both ", 300)
+	compressed := gzipped(t, text)
+	store := newFakeStore()
+	store.put("app.js", text)
+	store.put("app.js.gz", compressed)
+	s3 := newTestS3(t, store)
+
+	w := serve(s3, "/app.js", "Accept-Encoding", "gzip", "Range", "bytes=5-14")
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got status %d and Content-Encoding %q, want %d and gzip", w.Code, w.Header().Get("Content-Encoding"), http.StatusPartialContent)
+	}
+	if w.Body.String() != compressed[5:15] {
+		t.Errorf("got body %q, want bytes 5-14 of the sibling", w.Body.String())
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// redacted replaces the value of secret settings in the logs.
+const redacted = "***"
+
+// loggedFlags are the settings always logged at startup, the others only
+// when they differ from their default.
+var loggedFlags = map[string]bool{
+	"endpoint":   true,
+	"provider":   true,
+	"bucket":     true,
+	"address":    true,
+	"cache-time": true,
+}
+
+// isSecretFlag reports whether the value of the flag name must never be
+// logged.
+func isSecretFlag(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"secret", "token", "pass"} {
+		if strings.Contains(name, s) && !strings.HasSuffix(name, "file") {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue returns the value of the flag name as it may be logged,
+// without secrets, or the password and query parameter values of URLs,
+// which often carry tokens.
+func redactValue(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if isSecretFlag(name) {
+		return redacted
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" || (u.RawQuery == "" && u.User == nil) {
+		return value
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			if j := strings.Index(param, "="); j >= 0 {
+				params[i] = param[:j+1] + redacted
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			// The userinfo escapes the marker, spell it out instead.
+			u.User = url.User(u.User.Username())
+			user := u.User.String() + "@"
+			return strings.Replace(u.String(), user, user[:len(user)-1]+":"+redacted+"@", 1)
+		}
+	}
+	return u.String()
+}
+
+// tlsMode describes how the server is secured.
+func tlsMode() string {
+	switch {
+	case letsEncrypt:
+		return "lets-encrypt"
+	case tlsCert != "" && tlsKey != "":
+		return "certificate"
+	default:
+		return "off"
+	}
+}
+
+// logConfig logs the effective configuration, that is the settings of fs
+// given by flags or env vars along with the essential ones, with their
+// secrets redacted.
+func logConfig(fs *flag.FlagSet) {
+	var settings []string
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if !loggedFlags[f.Name] && value == f.DefValue {
+			return
+		}
+		settings = append(settings, "-"+f.Name+"="+redactValue(f.Name, value))
+	})
+	logInfo("Configuration", "settings", strings.Join(settings, " "), "tls", tlsMode())
+}
+
+// startupSettings are the settings of the config file as loaded at
+// startup, by flag name.
+var startupSettings map[string][]string
+
+// loadConfigFile sets the flags of fs from the YAML or TOML file path,
+// told apart by its extension. Its keys are flag names, optionally grouped
+// in sections of any name, e.g.
+//
+//	bucket: mysite
+//	tls:
+//	  ssl-cert: public.crt
+//	error-page:
+//	  404: errors/404.html
+//
+// Lists set repeatable flags once per item and are comma separated for
+// the others, maps set repeatable flags as KEY=VALUE pairs. Flags given on
+// the command line or through their env var take precedence over the
+// file, so it has to be loaded once they are parsed.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	settings, err := readConfigFile(fs, path)
+	if err != nil {
+		return err
+	}
+	startupSettings = settings
+	return applySettings(fs, explicitFlags(fs), settings)
+}
+
+// readConfigFile returns the values of the settings of the config file
+// path by the name of the flag of fs they set.
+func readConfigFile(fs *flag.FlagSet, path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]interface{})
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &settings)
+	case ".toml":
+		err = toml.Unmarshal(data, &settings)
+	default:
+		return nil, fmt.Errorf("config file %q must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config file %q: %v", path, err)
+	}
+	flat := make(map[string][]string)
+	if err = flattenSettings(fs, settings, flat); err != nil {
+		return nil, err
+	}
+	return flat, nil
+}
+
+// flattenSettings adds the values of settings to flat by flag name of fs,
+// recursing into the sections.
+func flattenSettings(fs *flag.FlagSet, settings map[string]interface{}, flat map[string][]string) error {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := settings[key]
+		f := fs.Lookup(key)
+		if f == nil {
+			section, ok := toStringMap(value)
+			if !ok {
+				return fmt.Errorf("unknown setting %q in config file", key)
+			}
+			if err := flattenSettings(fs, section, flat); err != nil {
+				return err
+			}
+			continue
+		}
+		values, err := settingValues(f, value)
+		if err != nil {
+			return err
+		}
+		flat[key] = append(flat[key], values...)
+	}
+	return nil
+}
+
+// explicitFlags returns the names of the flags of fs given on the command
+// line or through their env var, which the config file does not override.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := os.LookupEnv(envName(f.Name)); ok {
+			explicit[f.Name] = true
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// applySettings sets the flags of fs to the values of settings, except
+// those in explicit.
+func applySettings(fs *flag.FlagSet, explicit map[string]bool, settings map[string][]string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if explicit[name] {
+			continue
+		}
+		if err := setValues(fs.Lookup(name).Value, name, settings[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setValues sets v, the value of the flag name, to each of values.
+func setValues(v flag.Value, name string, values []string) error {
+	for _, value := range values {
+		if err := v.Set(value); err != nil {
+			return fmt.Errorf("invalid value %q for setting %q in config file: %v", value, name, err)
+		}
+	}
+	return nil
+}
+
+// settingValues returns the values value sets the flag f with.
+func settingValues(f *flag.Flag, value interface{}) ([]string, error) {
+	_, repeatable := f.Value.(repeatableFlag)
+	if m, ok := toStringMap(value); ok {
+		if !repeatable {
+			return nil, fmt.Errorf("setting %q in config file does not take a map", f.Name)
+		}
+		var values []string
+		for k, v := range m {
+			values = append(values, k+"="+fmt.Sprint(v))
+		}
+		sort.Strings(values)
+		return values, nil
+	}
+	if list, ok := value.([]interface{}); ok {
+		values := make([]string, len(list))
+		for i, v := range list {
+			values[i] = fmt.Sprint(v)
+		}
+		if repeatable {
+			return values, nil
+		}
+		return []string{strings.Join(values, ",")}, nil
+	}
+	return []string{fmt.Sprint(value)}, nil
+}
+
+// toStringMap returns value as a map with string keys, YAML decodes maps
+// with keys of any type.
+func toStringMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		sm := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			sm[fmt.Sprint(k)] = v
+		}
+		return sm, true
+	}
+	return nil, false
+}
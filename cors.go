@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy lets pages of the origins it allows read responses
+// cross-origin, as described by the Fetch standard.
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     []*regexp.Regexp
+	methods     string
+	headers     string
+	expose      string
+	credentials bool
+	maxAge      time.Duration
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newCORSPolicy returns the policy allowing the comma separated origins,
+// where '*' matches any characters as in "https://*.example.com" and a
+// lone "*" any origin, to use methods and send headers, exposing the
+// response headers expose.
+func newCORSPolicy(origins, methods, headers, expose string, credentials bool, maxAge time.Duration) (*corsPolicy, error) {
+	p := &corsPolicy{
+		methods:     strings.Join(splitList(methods), ", "),
+		headers:     strings.Join(splitList(headers), ", "),
+		expose:      strings.Join(splitList(expose), ", "),
+		credentials: credentials,
+		maxAge:      maxAge,
+	}
+	for _, origin := range splitList(origins) {
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return nil, fmt.Errorf("CORS origin %q must start with http:// or https://", origin)
+		}
+		parts := strings.Split(strings.ToLower(strings.TrimSuffix(origin, "/")), "*")
+		for k := range parts {
+			parts[k] = regexp.QuoteMeta(parts[k])
+		}
+		p.origins = append(p.origins, regexp.MustCompile("^"+strings.Join(parts, ".*")+"$"))
+	}
+	if !p.anyOrigin && len(p.origins) == 0 {
+		return nil, fmt.Errorf("CORS needs at least one origin")
+	}
+	return p, nil
+}
+
+// allows reports whether pages of origin may read the responses.
+func (p *corsPolicy) allows(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, o := range p.origins {
+		if o.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS sets the CORS headers of the responses to requests from the
+// origins allowed by p, and answers their preflight requests itself. Any
+// other request, such as one from an origin that is not allowed, goes on
+// to next without CORS headers, which browsers then refuse to expose.
+func withCORS(p *corsPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses differ by origin unless every origin gets the
+		// same "*".
+		if !p.anyOrigin || p.credentials {
+			varyOn(r, "Origin")
+		}
+		origin := r.Header.Get("Origin")
+		if origin == "" || !p.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		if p.anyOrigin && !p.credentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// Credentialed requests are refused a wildcard.
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			if p.expose != "" {
+				h.Set("Access-Control-Expose-Headers", p.expose)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", p.methods)
+		allowHeaders := p.headers
+		if allowHeaders == "*" && p.credentials {
+			// "*" is taken literally with credentials, allow the
+			// requested headers instead.
+			allowHeaders = r.Header.Get("Access-Control-Request-Headers")
+			varyOn(r, "Access-Control-Request-Headers")
+		}
+		if allowHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", allowHeaders)
+		}
+		if p.maxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
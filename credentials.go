@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// errNoCredentials is returned at startup when no credentials are found
+// and anonymous access was not allowed.
+var errNoCredentials = errors.New("no credentials found, set -accessKey and -secretKey or pass -allow-anonymous to serve a public bucket")
+
+// checkCredentials makes sure creds resolve to usable credentials, or that
+// anonymous access is allowed when they do not, rather than having every
+// request to a private bucket denied.
+func checkCredentials(creds *credentials.Credentials, allowAnonymous bool) error {
+	if v, err := creds.Get(); err != nil || v.SignerType.IsAnonymous() {
+		if !allowAnonymous {
+			return errNoCredentials
+		}
+		logWarn("No credentials found, accessing the bucket anonymously")
+	}
+	return nil
+}
+
+// credentialFailures counts the failed refreshes of credentials that were
+// previously retrieved, updated atomically.
+var credentialFailures int64
+
+// loggedProvider wraps a credentials provider to log its failures. The
+// credentials chain silently falls back to the next provider, down to
+// anonymous access, so that an expired credential otherwise only shows as
+// requests denied by S3. Failures of a provider that never had any
+// credentials, such as unset env vars, are the chain working as intended
+// and are not logged.
+type loggedProvider struct {
+	credentials.Provider
+	name string
+
+	mu        sync.Mutex
+	retrieved bool
+	failing   bool
+}
+
+// logCredentials wraps every provider of a credentials chain.
+func logCredentials(providers []credentials.Provider) []credentials.Provider {
+	logged := make([]credentials.Provider, len(providers))
+	for i, p := range providers {
+		logged[i] = &loggedProvider{
+			Provider: p,
+			name:     strings.TrimPrefix(fmt.Sprintf("%T", p), "*credentials."),
+		}
+	}
+	return logged
+}
+
+func (p *loggedProvider) Retrieve() (credentials.Value, error) {
+	v, err := p.Provider.Retrieve()
+	if err == nil && v.AccessKeyID == "" && v.SecretAccessKey == "" {
+		err = errors.New("no credentials")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case err != nil && p.retrieved && !p.failing:
+		p.failing = true
+		atomic.AddInt64(&credentialFailures, 1)
+		logError("Unable to refresh the credentials, S3 may deny requests", "provider", p.name, "err", err)
+	case err != nil && p.failing:
+		atomic.AddInt64(&credentialFailures, 1)
+	case err == nil && p.failing:
+		p.failing = false
+		logInfo("Refreshed the credentials again", "provider", p.name)
+	case err == nil && !p.retrieved:
+		p.retrieved = true
+		logInfo("Using the credentials", "provider", p.name)
+	}
+	return v, err
+}
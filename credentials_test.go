@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	static := func(access, secret string) *credentials.Credentials {
+		return credentials.NewChainCredentials(logCredentials([]credentials.Provider{
+			&credentials.Static{Value: credentials.Value{AccessKeyID: access, SecretAccessKey: secret}},
+		}))
+	}
+	for _, tc := range []struct {
+		creds          *credentials.Credentials
+		allowAnonymous bool
+		err            error
+	}{
+		{static("access", "secret"), false, nil},
+		{static("access", "secret"), true, nil},
+		{static("", ""), false, errNoCredentials},
+		{static("", ""), true, nil},
+	} {
+		v, _ := tc.creds.Get()
+		if err := checkCredentials(tc.creds, tc.allowAnonymous); err != tc.err {
+			t.Errorf("access key %q, -allow-anonymous=%v: got %v, want %v", v.AccessKeyID, tc.allowAnonymous, err, tc.err)
+		}
+	}
+}
+
+func TestAnonymousPublicBucket(t *testing.T) {
+	var signed bool
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.URL.Query().Get("X-Amz-Signature") != "" {
+			signed = true
+		}
+		if r.URL.Path != "/bucket/index.html" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", fakeTime.Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "public page")
+	}))
+	defer s3Server.Close()
+
+	creds := credentials.NewChainCredentials(logCredentials([]credentials.Provider{&credentials.Static{}}))
+	if err := checkCredentials(creds, true); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(s3Server.URL)
+	client, err := minio.New(u.Host, &minio.Options{Creds: creds, Region: "us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := minioStore{client}.GetObject(context.Background(), "bucket", "index.html", minio.GetObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	body, err := io.ReadAll(obj)
+	if err != nil || !strings.Contains(string(body), "public page") {
+		t.Errorf("got body %q, %v, want the public page", body, err)
+	}
+	if signed {
+		t.Error("signed a request without credentials")
+	}
+}
+
+// fakeProvider returns its values and errors in turn, expiring at once.
+type fakeProvider struct {
+	results []error
+}
+
+func (p *fakeProvider) Retrieve() (credentials.Value, error) {
+	err := p.results[0]
+	p.results = p.results[1:]
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	return credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+}
+
+func (p *fakeProvider) IsExpired() bool { return true }
+
+func TestCredentialRefreshFailureLogged(t *testing.T) {
+	var logged bytes.Buffer
+	setGlobal(t, &std.out, io.Writer(&logged))
+	setGlobal(t, &std.level, levelInfo)
+	setGlobal(t, &credentialFailures, 0)
+
+	expired := errors.New("ExpiredToken: the security token expired")
+	p := &fakeProvider{results: []error{nil, expired, expired, nil}}
+	creds := credentials.NewChainCredentials(logCredentials([]credentials.Provider{p}))
+
+	if _, err := creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "Using the credentials") {
+		t.Errorf("logged %q, want the credentials in use", logged.String())
+	}
+
+	logged.Reset()
+	for i := 0; i < 2; i++ {
+		creds.Get()
+	}
+	out := logged.String()
+	if !strings.Contains(out, "ERROR Unable to refresh the credentials") || !strings.Contains(out, "ExpiredToken") {
+		t.Errorf("logged %q, want the failed refresh as an error", out)
+	}
+	// A failing provider is logged once, not on every attempt.
+	if n := strings.Count(out, "Unable to refresh"); n != 1 {
+		t.Errorf("logged the failure %d times, want once", n)
+	}
+	if n := atomic.LoadInt64(&credentialFailures); n != 2 {
+		t.Errorf("counted %d failures, want 2", n)
+	}
+
+	logged.Reset()
+	if _, err := creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "Refreshed the credentials again") {
+		t.Errorf("logged %q, want the recovery", logged.String())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultObject is content served for a well-known path when the bucket
+// has no object for it, a noContent one is answered with 204 No Content.
+type defaultObject struct {
+	content     []byte
+	contentType string
+	noContent   bool
+}
+
+// wellKnownIcons are the icons browsers request on their own.
+var wellKnownIcons = []string{
+	"/favicon.ico",
+	"/apple-touch-icon.png",
+	"/apple-touch-icon-precomposed.png",
+}
+
+// defaultObjects maps request paths to their built-in defaults.
+var defaultObjects = map[string]defaultObject{}
+
+// robotsTxt returns the robots.txt served by -default-robots, either one
+// of the canned "allow" and "disallow" policies or the given content,
+// where "\n" stands for a line break.
+func robotsTxt(value string) []byte {
+	switch strings.ToLower(value) {
+	case "allow":
+		return []byte("User-agent: *\nAllow: /\n")
+	case "disallow":
+		return []byte("User-agent: *\nDisallow: /\n")
+	}
+	content := strings.Replace(value, `\n`, "\n", -1)
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return []byte(content)
+}
+
+// serveDefault serves the built-in default for name, if there is one.
+func serveDefault(w http.ResponseWriter, r *http.Request, name string) bool {
+	d, ok := defaultObjects[name]
+	if !ok {
+		return false
+	}
+	if d.noContent {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	w.Header().Set("Content-Type", d.contentType)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(d.content))
+	return true
+}
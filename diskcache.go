@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+const diskCacheSuffix = ".s3www"
+
+// diskCache is a read-through cache of object bodies on local disk. Entries
+// younger than ttl are served straight from disk, older ones are
+// revalidated by comparing their ETag with S3. The least recently used
+// entries are evicted once the cache grows over maxSize.
+type diskCache struct {
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	key     string
+	path    string
+	info    minio.ObjectInfo
+	fetched time.Time
+}
+
+// cachedObject is an object body served from the disk cache.
+type cachedObject struct {
+	*os.File
+	info   minio.ObjectInfo
+	status string
+}
+
+func (c *cachedObject) Stat() (minio.ObjectInfo, error) {
+	return c.info, nil
+}
+
+func (c *cachedObject) isStale() bool {
+	return c.status == cacheStale
+}
+
+func (c *cachedObject) cacheStatus() string {
+	return c.status
+}
+
+// newDiskCache creates dir if needed and removes cache files left behind
+// by a previous run, their metadata only ever lives in memory.
+func newDiskCache(dir string, maxSize int64, ttl time.Duration) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+diskCacheSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stale {
+		os.Remove(p)
+	}
+	return &diskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}, nil
+}
+
+// lookup returns a copy of the entry for key, marking it as recently used.
+func (c *diskCache) lookup(key string) (diskCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return diskCacheEntry{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return *elem.Value.(*diskCacheEntry), true
+}
+
+// refresh resets the age of the entry for key if it still holds etag.
+func (c *diskCache) refresh(key, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		if e := elem.Value.(*diskCacheEntry); e.info.ETag == etag {
+			e.fetched = time.Now()
+		}
+	}
+}
+
+func (c *diskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// flush drops every entry along with its file.
+func (c *diskCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *diskCache) removeElement(elem *list.Element) {
+	e := c.lru.Remove(elem).(*diskCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.info.Size
+	os.Remove(e.path)
+}
+
+// add records a body already written to path, evicting the least recently
+// used entries to stay within maxSize.
+func (c *diskCache) add(key, path string, info minio.ObjectInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		// The body of the previous entry was overwritten in place.
+		c.lru.Remove(elem)
+		c.size -= elem.Value.(*diskCacheEntry).info.Size
+	}
+	c.entries[key] = c.lru.PushFront(&diskCacheEntry{
+		key:     key,
+		path:    path,
+		info:    info,
+		fetched: time.Now(),
+	})
+	c.size += info.Size
+	for c.size > c.maxSize && c.lru.Len() > 1 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *diskCache) pathFor(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+diskCacheSuffix)
+}
+
+// open opens the cached body of the entry to be served with the X-Cache
+// status, dropping the entry when its file is gone.
+func (c *diskCache) open(e diskCacheEntry, status string) (*cachedObject, bool) {
+	f, err := os.Open(e.path)
+	if err != nil {
+		c.remove(e.key)
+		return nil, false
+	}
+	return &cachedObject{File: f, info: e.info, status: status}, true
+}
+
+// get returns the object stored under key, from disk when a valid copy
+// is cached and from S3 otherwise, storing it on disk on the way. An
+// expired copy is served stale when S3 is failing, as long as allowed by
+// maxStale.
+func (c *diskCache) get(ctx context.Context, s3 *S3, key string) (s3Object, error) {
+	e, cached := c.lookup(key)
+	if cached && time.Since(e.fetched) < c.ttl {
+		if obj, ok := c.open(e, cacheHit); ok {
+			return obj, nil
+		}
+		cached = false
+	}
+	if cached {
+		info, err := statObject(ctx, s3, key)
+		switch {
+		case err == nil && info.ETag == e.info.ETag:
+			if obj, ok := c.open(e, cacheRevalidated); ok {
+				c.refresh(key, e.info.ETag)
+				return obj, nil
+			}
+			cached = false
+		case canServeStale(e.fetched, c.ttl, err):
+			if obj, ok := c.open(e, cacheStale); ok {
+				return obj, nil
+			}
+			return nil, err
+		case err != nil:
+			if isNotFound(err) {
+				c.remove(key)
+			}
+			return nil, err
+		}
+	}
+
+	obj, err := openObject(ctx, s3, key)
+	if err != nil {
+		if cached && canServeStale(e.fetched, c.ttl, err) {
+			if obj, ok := c.open(e, cacheStale); ok {
+				return obj, nil
+			}
+		}
+		if cached && isNotFound(err) {
+			c.remove(key)
+		}
+		return nil, err
+	}
+	info, _ := obj.Stat()
+	if info.Size > c.maxSize {
+		if cached {
+			c.remove(key)
+		}
+		return obj, nil
+	}
+
+	f, err := c.store(key, obj)
+	if err != nil {
+		logWarn("Unable to cache on disk", "key", key, "err", err)
+		if _, err = obj.Seek(0, io.SeekStart); err != nil {
+			obj.Close()
+			return nil, err
+		}
+		return obj, nil
+	}
+	obj.Close()
+	c.add(key, c.pathFor(key), info)
+	return &cachedObject{File: f, info: info, status: cacheMiss}, nil
+}
+
+// store writes the body of obj to the cache file for key and returns it
+// opened and rewound for reading.
+func (c *diskCache) store(key string, obj io.Reader) (*os.File, error) {
+	tmp, err := ioutil.TempFile(c.dir, "tmp-*"+diskCacheSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(tmp, obj); err == nil {
+		err = os.Rename(tmp.Name(), c.pathFor(key))
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// readDiskCache gets key through c, returning the body and X-Cache status.
+func readDiskCache(t *testing.T, c *diskCache, s3 *S3, key string) (string, string) {
+	t.Helper()
+	obj, err := c.get(context.Background(), s3, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	data, err := ioutil.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), obj.(*cachedObject).status
+}
+
+func TestDiskCacheHitAndMiss(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.txt", "hello")
+	s3 := newTestS3(t, store)
+	c, err := newDiskCache(t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []string{cacheMiss, cacheHit, cacheHit} {
+		body, status := readDiskCache(t, c, s3, "a.txt")
+		if body != "hello" || status != want {
+			t.Errorf("read %d: got %q %s, want %q %s", i, body, status, "hello", want)
+		}
+	}
+	if gets := store.count(&store.gets); gets != 1 {
+		t.Errorf("fetched %d times from S3, want once", gets)
+	}
+}
+
+func TestDiskCacheRevalidation(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.txt", "hello")
+	s3 := newTestS3(t, store)
+	// Every entry is expired right away, and revalidated on each read.
+	c, err := newDiskCache(t.TempDir(), 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readDiskCache(t, c, s3, "a.txt")
+	body, status := readDiskCache(t, c, s3, "a.txt")
+	if body != "hello" || status != cacheRevalidated {
+		t.Errorf("unchanged: got %q %s, want %q %s", body, status, "hello", cacheRevalidated)
+	}
+	if gets := store.count(&store.gets); gets != 1 {
+		t.Errorf("fetched %d times from S3, want once", gets)
+	}
+
+	store.put("a.txt", "changed")
+	body, status = readDiskCache(t, c, s3, "a.txt")
+	if body != "changed" || status != cacheMiss {
+		t.Errorf("changed: got %q %s, want %q %s", body, status, "changed", cacheMiss)
+	}
+}
+
+func TestDiskCacheNotModified(t *testing.T) {
+	store := newFakeStore()
+	etag := store.put("a.txt", "hello").ETag
+	setGlobal(t, &xCacheHeader, true)
+	s3 := newTestS3(t, store)
+	var err error
+	if s3.diskCache, err = newDiskCache(t.TempDir(), 1<<20, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serve(s3, "/a.txt"); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("got %d %q, want 200 %q", w.Code, w.Body.String(), "hello")
+	}
+	w := serve(s3, "/a.txt", "If-None-Match", `"`+etag+`"`)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if got := w.Header().Get("X-Cache"); got != cacheRevalidated {
+		t.Errorf("got X-Cache %q, want %q", got, cacheRevalidated)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.txt", "aaaa")
+	store.put("b.txt", "bbbb")
+	store.put("c.txt", "cccc")
+	s3 := newTestS3(t, store)
+	c, err := newDiskCache(t.TempDir(), 8, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readDiskCache(t, c, s3, "a.txt")
+	readDiskCache(t, c, s3, "b.txt")
+	// a.txt becomes the most recently used, b.txt is evicted for c.txt.
+	readDiskCache(t, c, s3, "a.txt")
+	readDiskCache(t, c, s3, "c.txt")
+	if _, ok := c.lookup("b.txt"); ok {
+		t.Error("b.txt is still cached")
+	}
+	if _, ok := c.lookup("a.txt"); !ok {
+		t.Error("a.txt was evicted")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// parseExtensions parses a comma separated list of file extensions, with
+// or without the leading dot, into a lookup set of lower case ".ext".
+func parseExtensions(list string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts[ext] = true
+	}
+	return exts
+}
+
+// setContentDisposition sets the Content-Disposition response header for
+// an object. A Content-Disposition stored in the object metadata is
+// passed through as is, otherwise objects whose extension is one of
+// downloadTypes, or requested with ?download=1, are sent as attachments.
+func setContentDisposition(w http.ResponseWriter, r *http.Request, info objectInfo) {
+	if cd := info.Metadata.Get("Content-Disposition"); cd != "" {
+		w.Header().Set("Content-Disposition", cd)
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("download"))
+	if !force && !downloadTypes[strings.ToLower(path.Ext(info.Key))] {
+		return
+	}
+	cd := mime.FormatMediaType("attachment", map[string]string{
+		"filename": path.Base(info.Key),
+	})
+	if cd == "" {
+		cd = "attachment"
+	}
+	w.Header().Set("Content-Disposition", cd)
+}
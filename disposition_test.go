@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	store := newFakeStore()
+	store.put("docs/manual.pdf", "%PDF")
+	store.put("docs/page.html", "<p>page</p>")
+	store.put("docs/named.bin", "data").Metadata.Set("Content-Disposition", `attachment; filename="custom.bin"`)
+	setGlobal(t, &downloadTypes, parseExtensions("pdf,.zip"))
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/docs/manual.pdf", "attachment; filename=manual.pdf"},
+		{"/docs/page.html", ""},
+		{"/docs/page.html?download=1", "attachment; filename=page.html"},
+		{"/docs/page.html?download=0", ""},
+		{"/docs/named.bin", `attachment; filename="custom.bin"`},
+	} {
+		w := serve(s3, tc.path)
+		if got := w.Header().Get("Content-Disposition"); got != tc.want {
+			t.Errorf("%s: got Content-Disposition %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestParseExtensions(t *testing.T) {
+	got := parseExtensions(" PDF, .zip,,tar.gz ")
+	for _, ext := range []string{".pdf", ".zip", ".tar.gz"} {
+		if !got[ext] {
+			t.Errorf("missing %q in %v", ext, got)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("got %d extensions, want 3", len(got))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errNotAcceptable is returned when no encoding acceptable to the client
+// is available.
+var errNotAcceptable = errors.New("no acceptable content encoding")
+
+// encodingExts maps the content encodings of precompressed siblings to
+// the extension appended to the key of the uncompressed object.
+var encodingExts = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// parseEncodings parses a comma separated list of content encodings with
+// known sibling extensions, keeping their order.
+func parseEncodings(list string) ([]string, error) {
+	var encodings []string
+	for _, enc := range strings.Split(list, ",") {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if enc == "" {
+			continue
+		}
+		if _, ok := encodingExts[enc]; !ok {
+			return nil, fmt.Errorf("unsupported content encoding %q", enc)
+		}
+		encodings = append(encodings, enc)
+	}
+	return encodings, nil
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header into the quality
+// value of each coding, "*" included. Codings with an invalid quality
+// value are ignored.
+func parseAcceptEncoding(header string) map[string]float64 {
+	qvalues := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(strings.ToLower(param), "q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil || v < 0 || v > 1 {
+				q = -1
+			} else {
+				q = v
+			}
+		}
+		if q >= 0 {
+			qvalues[coding] = q
+		}
+	}
+	return qvalues
+}
+
+// rankEncodings returns the encodings among available and identity the
+// client accepts according to the Accept-Encoding header, best first.
+// Ties are broken by the order of available, identity coming last. An
+// empty result means none is acceptable.
+func rankEncodings(header string, available []string) []string {
+	qvalues := parseAcceptEncoding(header)
+	wildcard, hasWildcard := qvalues["*"]
+
+	quality := func(enc string) float64 {
+		if q, ok := qvalues[enc]; ok {
+			return q
+		}
+		if hasWildcard {
+			return wildcard
+		}
+		if enc == "identity" {
+			// identity is acceptable unless explicitly excluded, but
+			// only as a last resort when not listed.
+			return 0.001
+		}
+		return 0
+	}
+
+	var ranked []string
+	for _, enc := range append(append([]string(nil), available...), "identity") {
+		if quality(enc) > 0 {
+			ranked = append(ranked, enc)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return quality(ranked[i]) > quality(ranked[j])
+	})
+	return ranked
+}
+
+// openPrecompressed returns the precompressed sibling of key best matching
+// the Accept-Encoding of r and its encoding, or a nil object when the
+// uncompressed object is to be served. It fails with errNotAcceptable
+// when the client accepts neither.
+func (s3 *S3) openPrecompressed(r *http.Request, key string) (*httpMinioObject, string, error) {
+	for _, enc := range rankEncodings(r.Header.Get("Accept-Encoding"), precompressed) {
+		if enc == "identity" {
+			return nil, "", nil
+		}
+		obj, err := s3.openKeys(r.Context(), []string{key + encodingExts[enc]})
+		if err == nil {
+			return obj, enc, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+	}
+	return nil, "", errNotAcceptable
+}
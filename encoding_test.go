@@ -0,0 +1,141 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAcceptEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   map[string]float64
+	}{
+		{"", map[string]float64{}},
+		{"gzip", map[string]float64{"gzip": 1}},
+		{"gzip, br", map[string]float64{"gzip": 1, "br": 1}},
+		{"br;q=0.9, gzip;q=0.8", map[string]float64{"br": 0.9, "gzip": 0.8}},
+		{"GZIP;Q=0.5", map[string]float64{"gzip": 0.5}},
+		{" br ; q=1.0 , gzip ; q=0 ", map[string]float64{"br": 1, "gzip": 0}},
+		{"*;q=0.1, identity;q=0", map[string]float64{"*": 0.1, "identity": 0}},
+		{"gzip;level=1;q=0.4", map[string]float64{"gzip": 0.4}},
+		{"gzip;level=1", map[string]float64{"gzip": 1}},
+		// Invalid quality values drop the coding.
+		{"br;q=2, gzip", map[string]float64{"gzip": 1}},
+		{"br;q=-0.5, gzip", map[string]float64{"gzip": 1}},
+		{"br;q=high, gzip;q=", map[string]float64{}},
+		{",, gzip ,", map[string]float64{"gzip": 1}},
+	} {
+		if got := parseAcceptEncoding(tc.header); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestRankEncodings(t *testing.T) {
+	for _, tc := range []struct {
+		header    string
+		available []string
+		want      []string
+	}{
+		// No header accepts only identity.
+		{"", []string{"br", "gzip"}, []string{"identity"}},
+		{"gzip", []string{"br", "gzip"}, []string{"gzip", "identity"}},
+		// Ties follow the configured preference.
+		{"gzip, br", []string{"br", "gzip"}, []string{"br", "gzip", "identity"}},
+		{"gzip, br", []string{"gzip", "br"}, []string{"gzip", "br", "identity"}},
+		// Quality values beat the configured preference.
+		{"br;q=0.5, gzip;q=0.8", []string{"br", "gzip"}, []string{"gzip", "br", "identity"}},
+		{"br;q=0, gzip", []string{"br", "gzip"}, []string{"gzip", "identity"}},
+		{"*", []string{"br", "gzip"}, []string{"br", "gzip", "identity"}},
+		{"*;q=0.5, gzip", []string{"br", "gzip"}, []string{"gzip", "br", "identity"}},
+		// Listing identity makes it compete on quality.
+		{"identity, gzip;q=0.5", []string{"gzip"}, []string{"identity", "gzip"}},
+		{"gzip, identity;q=0", []string{"br", "gzip"}, []string{"gzip"}},
+		{"*;q=0", []string{"br", "gzip"}, nil},
+		{"br, identity;q=0", nil, nil},
+		{"zstd", []string{"br", "gzip"}, []string{"identity"}},
+	} {
+		if got := rankEncodings(tc.header, tc.available); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q of %q: got %q, want %q", tc.header, tc.available, got, tc.want)
+		}
+	}
+}
+
+func TestPrecompressedNegotiation(t *testing.T) {
+	setGlobal(t, &precompressed, []string{"br", "gzip"})
+	store := newFakeStore()
+	store.put("app.js", "plain")
+	store.put("app.js.br", "brotli")
+	store.put("app.js.gz", "gzip")
+	store.put("style.css", "plain")
+	store.put("style.css.gz", "gzip")
+	store.put("page.html", "plain")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path     string
+		accept   string
+		code     int
+		encoding string
+		body     string
+	}{
+		{"/app.js", "", http.StatusOK, "", "plain"},
+		{"/app.js", "gzip, br", http.StatusOK, "br", "brotli"},
+		{"/app.js", "br;q=0.9, gzip;q=1", http.StatusOK, "gzip", "gzip"},
+		// The best encoding without a sibling is skipped.
+		{"/style.css", "br, gzip;q=0.5", http.StatusOK, "gzip", "gzip"},
+		{"/style.css", "br", http.StatusOK, "", "plain"},
+		{"/page.html", "gzip, identity;q=0", http.StatusNotAcceptable, "", ""},
+		{"/style.css", "br, identity;q=0", http.StatusNotAcceptable, "", ""},
+		{"/style.css", "gzip, identity;q=0", http.StatusOK, "gzip", "gzip"},
+	} {
+		w := serve(s3, tc.path, "Accept-Encoding", tc.accept)
+		if w.Code != tc.code {
+			t.Errorf("%s, %q: got status %d, want %d", tc.path, tc.accept, w.Code, tc.code)
+			continue
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tc.encoding {
+			t.Errorf("%s, %q: got Content-Encoding %q, want %q", tc.path, tc.accept, got, tc.encoding)
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s, %q: got body %q, want %q", tc.path, tc.accept, w.Body.String(), tc.body)
+		}
+	}
+}
+
+// TestPrecompressedSibling checks the headers of a sibling served for its
+// object: the type of the object, the validator of the sibling, and that
+// it beats compressing the object on the fly.
+func TestPrecompressedSibling(t *testing.T) {
+	setupCompression(t, "br,gzip")
+	setGlobal(t, &precompressed, []string{"br", "gzip"})
+	text := strings.Repeat("console.log(1);", 100)
+	compressed := gzipped(t, text)
+	store := newFakeStore()
+	store.put("app.js", text)
+	sibling := store.put("app.js.gz", compressed)
+	s3 := newTestS3(t, store)
+
+	w := serve(s3, "/app.js", "Accept-Encoding", "gzip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got status %d and Content-Encoding %q, want 200 and gzip", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if w.Body.String() != compressed {
+		t.Error("got a body other than the stored sibling")
+	}
+	if got, want := w.Header().Get("Content-Type"), mime.TypeByExtension(".js"); got != want {
+		t.Errorf("got Content-Type %q, want the one of app.js %q", got, want)
+	}
+	if got, want := w.Header().Get("ETag"), `"`+sibling.ETag+`"`; got != want {
+		t.Errorf("got ETag %s, want the one of the sibling %s", got, want)
+	}
+
+	// Without a sibling for the accepted encoding, -compress applies.
+	w = serve(s3, "/app.js", "Accept-Encoding", "br")
+	if w.Header().Get("Content-Encoding") != "br" || w.Header().Get("ETag") == `"`+sibling.ETag+`"` {
+		t.Errorf("br: got Content-Encoding %q and ETag %s, want br compressed on the fly", w.Header().Get("Content-Encoding"), w.Header().Get("ETag"))
+	}
+}
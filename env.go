@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// envPrefix prefixes the env var bound to every flag.
+const envPrefix = "S3WWW_"
+
+// repeatableFlag is implemented by flags that may be given several times,
+// the env var of such a flag holds a comma separated list of values.
+type repeatableFlag interface {
+	flag.Value
+	repeatable()
+}
+
+// envName returns the env var bound to the flag name, e.g. S3WWW_ACCESS_KEY
+// for accessKey and S3WWW_SSL_CERT for ssl-cert.
+func envName(name string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	prev := rune(0)
+	for _, r := range name {
+		switch {
+		case r == '-':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+// bindEnv documents the S3WWW_* env var bound to every flag of fs in its
+// usage. It must be called once all flags are registered and before
+// parsing them.
+func bindEnv(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Usage += fmt.Sprintf(" [$%s]", envName(f.Name))
+	})
+}
+
+// applyEnv sets the flags of fs not given on the command line from their
+// S3WWW_* env var, so that each flag can also be set from the
+// environment while flags given on the command line replace rather than
+// add to the values of repeatable ones. It must be called once the flags
+// are parsed.
+func applyEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		key := envName(f.Name)
+		val, ok := os.LookupEnv(key)
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+
+		values := []string{val}
+		if _, ok := f.Value.(repeatableFlag); ok {
+			values = strings.Split(val, ",")
+			for i := range values {
+				values[i] = strings.TrimSpace(values[i])
+			}
+		}
+		for _, v := range values {
+			if serr := f.Value.Set(v); serr != nil {
+				err = fmt.Errorf("invalid value %q for env var %s: %v", v, key, serr)
+				return
+			}
+		}
+	})
+	return err
+}
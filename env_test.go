@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// recordedValue is a flag.Value remembering the values it was set to.
+type recordedValue struct {
+	values []string
+}
+
+func (v *recordedValue) String() string { return strings.Join(v.values, ",") }
+
+func (v *recordedValue) Set(s string) error {
+	v.values = append(v.values, s)
+	return nil
+}
+
+func TestEveryFlagHasAnEnvVar(t *testing.T) {
+	valid := regexp.MustCompile(`^S3WWW_[A-Z0-9]+(_[A-Z0-9]+)*$`)
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	recorded := make(map[string]*recordedValue)
+	owners := make(map[string]string)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			// Registered by the testing package.
+			return
+		}
+		key := envName(f.Name)
+		if !valid.MatchString(key) {
+			t.Errorf("-%s is bound to the malformed env var %q", f.Name, key)
+		}
+		if other, ok := owners[key]; ok {
+			t.Errorf("-%s and -%s are both bound to %s", f.Name, other, key)
+		}
+		owners[key] = f.Name
+		recorded[f.Name] = &recordedValue{}
+		fs.Var(recorded[f.Name], f.Name, f.Usage)
+		t.Setenv(key, "from-env")
+	})
+	if len(recorded) == 0 {
+		t.Fatal("no flags registered")
+	}
+
+	bindEnv(fs)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range recorded {
+		if got := v.String(); got != "from-env" {
+			t.Errorf("-%s was set to %q by %s, want %q", name, got, envName(name), "from-env")
+		}
+		if usage := fs.Lookup(name).Usage; !strings.HasSuffix(usage, "[$"+envName(name)+"]") {
+			t.Errorf("-%s does not document its env var: %q", name, usage)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for name, want := range map[string]string{
+		"accessKey":              "S3WWW_ACCESS_KEY",
+		"ssl-cert":               "S3WWW_SSL_CERT",
+		"client-ca":              "S3WWW_CLIENT_CA",
+		"require-client-cert":    "S3WWW_REQUIRE_CLIENT_CERT",
+		"lets-encrypt":           "S3WWW_LETS_ENCRYPT",
+		"max-concurrent-fetches": "S3WWW_MAX_CONCURRENT_FETCHES",
+	} {
+		if got := envName(name); got != want {
+			t.Errorf("envName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		env  string
+		args []string
+		want []string
+	}{
+		{"", nil, nil},
+		{"a=1, b=2", nil, []string{"a=1", "b=2"}},
+		{"a=1,b=2", []string{"-rule", "c=3"}, []string{"c=3"}},
+		{"", []string{"-rule", "c=3", "-rule", "d=4"}, []string{"c=3", "d=4"}},
+	} {
+		fs := flag.NewFlagSet("env", flag.ContinueOnError)
+		var rules claimRulesFlag
+		fs.Var(&rules, "rule", "")
+		single := fs.String("single", "default", "")
+		t.Setenv("S3WWW_RULE", tc.env)
+		t.Setenv("S3WWW_SINGLE", "from-env")
+		if tc.env == "" {
+			// Restored by t.Setenv once the test is done.
+			os.Unsetenv("S3WWW_RULE")
+		}
+		if err := fs.Parse(append(tc.args, "-single", "from-args")); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyEnv(fs); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rule := range rules {
+			got = append(got, rule.name+"="+rule.value)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("env %q args %q: got %q, want %q", tc.env, tc.args, got, tc.want)
+		}
+		if *single != "from-args" {
+			t.Errorf("env %q args %q: -single is %q, want from-args", tc.env, tc.args, *single)
+		}
+	}
+}
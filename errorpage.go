@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+//go:embed static/error.html
+var defaultErrorPageSource string
+
+// defaultErrorPage is the error page served when the bucket provides none
+// for a status code, unless disabled with -default-error-page=false.
+var defaultErrorPage = template.Must(template.New("error").Parse(defaultErrorPageSource))
+
+// serveDefaultErrorPage renders the built-in error page for code.
+func serveDefaultErrorPage(w http.ResponseWriter, r *http.Request, code int) {
+	var buf bytes.Buffer
+	err := defaultErrorPage.Execute(&buf, struct {
+		Code   int
+		Status string
+		Path   string
+	}{code, http.StatusText(code), r.URL.Path})
+	if err != nil {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if r.Method != http.MethodHead {
+		w.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestDefaultErrorPage(t *testing.T) {
+	store := newFakeStore()
+	store.errs["secret.txt"] = minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}
+	s3 := newTestS3(t, store)
+	h := withMethods(s3, s3)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodGet, "/missing.html", http.StatusNotFound},
+		{http.MethodGet, "/secret.txt", http.StatusForbidden},
+		{http.MethodPost, "/index.html", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/<script>alert(1)</script>", http.StatusNotFound},
+	} {
+		w := serveMethod(h, tc.method, tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.path, w.Code, tc.code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Errorf("%s: got Content-Type %q, want the HTML page", tc.path, got)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "<h1>"+strconv.Itoa(tc.code)+"</h1>") || !strings.Contains(body, http.StatusText(tc.code)) {
+			t.Errorf("%s: page %q does not show status %d", tc.path, body, tc.code)
+		}
+		if strings.Contains(body, "<script>") {
+			t.Errorf("%s: path not escaped in %q", tc.path, body)
+		}
+	}
+
+	// HEAD gets the headers of the page without its body.
+	w := serveMethod(h, http.MethodHead, "/missing.html")
+	if w.Code != http.StatusNotFound || w.Body.Len() != 0 || w.Header().Get("Content-Length") == "0" {
+		t.Errorf("HEAD: got status %d, body %q and Content-Length %q", w.Code, w.Body.String(), w.Header().Get("Content-Length"))
+	}
+}
+
+func TestDefaultErrorPageDisabled(t *testing.T) {
+	setGlobal(t, &useDefaultErrorPage, false)
+	s3 := newTestS3(t, newFakeStore())
+
+	w := serve(s3, "/missing.html")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if ctype := w.Header().Get("Content-Type"); !strings.HasPrefix(ctype, "text/plain") {
+		t.Errorf("got Content-Type %q, want plain text", ctype)
+	}
+	if strings.Contains(w.Body.String(), "<html") {
+		t.Errorf("got the built-in page %q", w.Body.String())
+	}
+}
+
+func TestBucketErrorPageWins(t *testing.T) {
+	store := newFakeStore()
+	store.put("404.html", "<h1>our own page</h1>")
+	s3 := newTestS3(t, store)
+
+	w := serve(s3, "/missing.html")
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>our own page</h1>" {
+		t.Errorf("got status %d and body %q, want the page of the bucket", w.Code, w.Body.String())
+	}
+}
+
+func TestErrorPagePerStatus(t *testing.T) {
+	pages := errorPagesFlag{http.StatusNotFound: "404.html"}
+	for _, v := range []string{"404=/errors/404.html", "403=errors/403.html", "500=/errors/500.html", "503=errors/503.html", "503="} {
+		if err := pages.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := pages.String(), "403=errors/403.html,404=errors/404.html,500=errors/500.html"; got != want {
+		t.Errorf("got pages %q, want %q", got, want)
+	}
+	for _, invalid := range []string{"404", "200=ok.html", "600=x.html", "abc=x.html"} {
+		if err := pages.Set(invalid); err == nil {
+			t.Errorf("accepted -error-page %q", invalid)
+		}
+	}
+	setGlobal(t, &errorPages, pages)
+
+	store := newFakeStore()
+	store.put("404.html", "root 404")
+	store.put("errors/404.html", "missing")
+	store.put("errors/403.html", "denied")
+	store.put("errors/500.html", "broken")
+	store.errs["secret.txt"] = minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}
+	store.errs["fail.txt"] = minio.ErrorResponse{Code: "InternalError", StatusCode: http.StatusInternalServerError}
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/nowhere.txt", http.StatusNotFound, "missing"},
+		{"/secret.txt", http.StatusForbidden, "denied"},
+		{"/fail.txt", http.StatusInternalServerError, "broken"},
+	} {
+		w := serve(s3, tc.path)
+		if w.Code != tc.code || w.Body.String() != tc.body {
+			t.Errorf("%s: got %d %q, want %d %q", tc.path, w.Code, w.Body.String(), tc.code, tc.body)
+		}
+	}
+	// A status without a page gets the built-in one.
+	if w := serveMethod(withMethods(s3, s3), http.MethodPost, "/nowhere.txt"); w.Code != http.StatusMethodNotAllowed || !strings.Contains(w.Body.String(), "405") {
+		t.Errorf("POST: got %d %q, want %d and the built-in page", w.Code, w.Body.String(), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// optionalString implements flag.Value for string flags where an
+// explicitly empty value has to be told apart from an unset one.
+type optionalString struct {
+	value string
+	set   bool
+}
+
+func (o *optionalString) String() string {
+	return o.value
+}
+
+func (o *optionalString) Set(value string) error {
+	o.value = value
+	o.set = true
+	return nil
+}
+
+// addressesFlag implements flag.Value for the repeatable -address flag,
+// the first address given replaces the default ones.
+type addressesFlag struct {
+	addrs []string
+	set   bool
+}
+
+func (a *addressesFlag) String() string {
+	return strings.Join(a.addrs, ",")
+}
+
+func (a *addressesFlag) repeatable() {}
+
+func (a *addressesFlag) Set(value string) error {
+	if !a.set {
+		a.addrs = nil
+		a.set = true
+	}
+	a.addrs = append(a.addrs, value)
+	return nil
+}
+
+// errorPagesFlag implements flag.Value mapping HTTP status codes to the
+// objects served as error pages, set as STATUS=OBJECT.
+type errorPagesFlag map[int]string
+
+func (e errorPagesFlag) String() string {
+	var pages []string
+	for code, object := range e {
+		pages = append(pages, strconv.Itoa(code)+"="+object)
+	}
+	sort.Strings(pages)
+	return strings.Join(pages, ",")
+}
+
+func (e errorPagesFlag) repeatable() {}
+
+func (e errorPagesFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("error page %q is not of the form STATUS=OBJECT", value)
+	}
+	code, err := strconv.Atoi(value[:i])
+	if err != nil || code < 400 || code > 599 {
+		return fmt.Errorf("error page %q has an invalid status code", value)
+	}
+	object := strings.TrimPrefix(value[i+1:], pathSeparator)
+	if object == "" {
+		delete(e, code)
+		return nil
+	}
+	e[code] = object
+	return nil
+}
+
+// iconsFlag implements flag.Value mapping icon request paths to the
+// objects served for them, set as PATH=OBJECT.
+type iconsFlag map[string]string
+
+func (i iconsFlag) String() string {
+	var icons []string
+	for p, object := range i {
+		icons = append(icons, p+"="+object)
+	}
+	sort.Strings(icons)
+	return strings.Join(icons, ",")
+}
+
+func (i iconsFlag) repeatable() {}
+
+func (i iconsFlag) Set(value string) error {
+	n := strings.Index(value, "=")
+	if n <= 0 || n == len(value)-1 {
+		return fmt.Errorf("icon %q is not of the form PATH=OBJECT", value)
+	}
+	i[pathSeparator+strings.TrimPrefix(value[:n], pathSeparator)] = strings.TrimPrefix(value[n+1:], pathSeparator)
+	return nil
+}
+
+// parseByteSize parses a size such as "512", "64KiB", "10M" or "1GB",
+// suffixes are powers of 1024.
+func parseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
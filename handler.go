@@ -0,0 +1,334 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// ServeHTTP - implements http.Handler, serving objects and directories
+// from the bucket and rendering the configured error pages.
+func (s3 *S3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The objects opened for the request share one fetch slot.
+	r = r.WithContext(withFetchScope(r.Context()))
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, pathSeparator) {
+		upath = pathSeparator + upath
+	}
+	name := path.Clean(upath)
+	// key is the path looked up in the bucket, and the key of the
+	// cached copies of the object. The query string takes no part in
+	// it, so cache busting parameters such as "?v=123" all share one
+	// copy.
+	key, rewritten, err := rewritePath(name)
+	if err != nil {
+		logWarn("Unable to rewrite the path", "path", name, "err", err)
+		s3.serveError(w, r, http.StatusBadRequest)
+		return
+	}
+	key = prefixedKey(r.Context(), key)
+
+	var f *httpMinioObject
+	if object, ok := icons[name]; ok {
+		f, err = s3.openKeys(r.Context(), []string{object})
+	} else {
+		f, err = s3.open(r.Context(), key)
+	}
+	if err != nil {
+		if os.IsNotExist(err) && serveDefault(w, r, name) {
+			return
+		}
+		s3.serveError(w, r, toHTTPStatus(err))
+		return
+	}
+	defer f.Close()
+
+	if f.isDir && !strings.HasSuffix(upath, pathSeparator) {
+		// An object named like the directory wins, otherwise redirect
+		// so that relative links in the index resolve below it. Other
+		// errors are no reason for a permanent redirect.
+		obj, err := s3.openKeys(r.Context(), []string{cleanKey(key)})
+		if os.IsNotExist(err) {
+			localRedirect(w, r, path.Base(upath)+pathSeparator)
+			return
+		}
+		if err != nil {
+			s3.serveError(w, r, toHTTPStatus(err))
+			return
+		}
+		defer obj.Close()
+		f = obj
+	}
+
+	if f.isDir {
+		index, err := s3.openKeys(r.Context(), indexKeys(cleanKey(key)))
+		if err == nil {
+			defer index.Close()
+			f = index
+		} else {
+			if !enableListing {
+				s3.serveError(w, r, http.StatusNotFound)
+				return
+			}
+			if wantsJSONListing(r) {
+				jsonDirList(w, r, s3, key)
+				return
+			}
+			dirList(w, r, s3, key)
+			return
+		}
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		s3.serveError(w, r, toHTTPStatus(err))
+		return
+	}
+	if s, ok := f.object.(staleObject); ok && s.isStale() {
+		w.Header().Set("Warning", staleWarning)
+	}
+	info, ok := fi.(objectInfo)
+	if !ok {
+		setXCache(w, f.object)
+		serveContent(w, r, fi, f)
+		return
+	}
+
+	var sibling *httpMinioObject
+	var encoding string
+	if len(precompressed) > 0 && info.Metadata.Get("Content-Encoding") == "" {
+		varyOn(r, "Accept-Encoding")
+		if sibling, encoding, err = s3.openPrecompressed(r, info.Key); err != nil {
+			s3.serveError(w, r, toHTTPStatus(err))
+			return
+		}
+	}
+
+	setContentEncoding(w, info)
+	if rewritten && w.Header().Get("Content-Type") == "" {
+		// The type follows the requested path, not the rewritten key.
+		if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		} else {
+			setContentType(w, objectInfo{ObjectInfo: minio.ObjectInfo{
+				Key:         cleanKey(name),
+				ContentType: info.ContentType,
+			}})
+		}
+	}
+	setContentType(w, info)
+	setETag(w, info)
+	setExposedMetadata(w, info)
+	setContentDisposition(w, r, info)
+	setCacheControl(w, r)
+	if sibling == nil {
+		setXCache(w, f.object)
+		if enc := compressEncoding(w, r, info); enc != "" {
+			cw := &compressResponseWriter{ResponseWriter: w, encoding: enc, head: r.Method == http.MethodHead}
+			defer cw.close()
+			serveContent(cw, r, fi, f)
+			return
+		}
+		serveContent(w, r, fi, f)
+		return
+	}
+
+	defer sibling.Close()
+	sfi, err := sibling.Stat()
+	if err != nil {
+		s3.serveError(w, r, toHTTPStatus(err))
+		return
+	}
+	// The sibling is validated by its own ETag, the one of the
+	// uncompressed object describes other bytes.
+	if sinfo, ok := sfi.(objectInfo); ok {
+		setETag(w, sinfo)
+	}
+	// The type of the sibling would be derived from its own extension.
+	if w.Header().Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(path.Ext(info.Key))
+		if ctype == "" {
+			ctype = info.ContentType
+		}
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+	// Ranges are satisfied from the stored sibling, so Content-Range
+	// and Content-Length count compressed bytes, matching the
+	// Content-Encoding of the partial response.
+	w.Header().Set("Content-Encoding", encoding)
+	setXCache(w, sibling.object)
+	serveContent(w, r, sfi, sibling)
+}
+
+// serveContent serves an object with http.ServeContent, which handles
+// range and conditional requests, advertising range support for every
+// object and keeping the headers describing the object body off error
+// responses such as 416 Range Not Satisfiable.
+func serveContent(w http.ResponseWriter, r *http.Request, fi os.FileInfo, content io.ReadSeeker) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	if fi.Size() == 0 {
+		// Ranges of an empty object can never be satisfied, serve
+		// it whole instead of failing with 416.
+		r.Header.Del("Range")
+	}
+	hw := &hookResponseWriter{
+		ResponseWriter: w,
+		beforeWrite: func(code int, h http.Header) {
+			if code >= http.StatusBadRequest {
+				h.Del("Content-Encoding")
+				h.Del("Content-Disposition")
+				h.Del("Cache-Control")
+			}
+			if code < http.StatusMultipleChoices {
+				setChangedValidators(h, fi, content)
+			}
+		},
+	}
+	http.ServeContent(hw, r, fi.Name(), fi.ModTime(), content)
+}
+
+// setChangedValidators updates the validators of h set from fi when the
+// object was found changed, and fetched again, once its body was
+// requested, so that they describe the body actually sent.
+func setChangedValidators(h http.Header, fi os.FileInfo, content io.ReadSeeker) {
+	f, ok := content.(*httpMinioObject)
+	if !ok {
+		return
+	}
+	before, ok := fi.(objectInfo)
+	if !ok {
+		return
+	}
+	cur, err := f.Stat()
+	if err != nil {
+		return
+	}
+	after, ok := cur.(objectInfo)
+	if !ok || after.ETag == before.ETag {
+		return
+	}
+	if after.ETag != "" {
+		h.Set("ETag", quoteETag(after.ETag))
+	}
+	h.Set("Last-Modified", after.ModTime().UTC().Format(http.TimeFormat))
+}
+
+// serveError writes the error page configured for code, or with
+// -nested-error-pages the nearest page of the same name above the
+// requested path, falling back to the built-in error page, or a plain
+// text error when it is disabled, when there is none or it cannot be
+// read. The error page is fetched by key, like any object through the
+// caches and the fetch limit, but never goes through the regular path
+// lookup so a missing or failing error page cannot recurse. With
+// -exact-only the bucket is never asked for an error page.
+func (s3 *S3) serveError(w http.ResponseWriter, r *http.Request, code int) {
+	if object, ok := rules().errorPages[code]; ok && !exactOnly {
+		for _, key := range errorPageKeys(r.URL.Path, object) {
+			if s3.writeErrorPage(w, r, code, key) {
+				return
+			}
+		}
+	}
+	if useDefaultErrorPage {
+		serveDefaultErrorPage(w, r, code)
+		return
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+// errorPageKeys returns the keys of the error page object looked up for
+// a request of urlPath, nearest first.
+func errorPageKeys(urlPath, object string) []string {
+	if !nestedErrorPages {
+		return []string{object}
+	}
+	dir := cleanKey(urlPath)
+	if !strings.HasSuffix(urlPath, pathSeparator) {
+		dir = cleanKey(path.Dir(dir))
+	}
+	var keys []string
+	for ; dir != ""; dir = cleanKey(path.Dir(dir)) {
+		keys = append(keys, dir+pathSeparator+path.Base(object))
+	}
+	return append(keys, object)
+}
+
+// writeErrorPage writes the object key as the body of an error response
+// with code, reporting whether it could. Missing objects are remembered
+// for a while in the missing pages cache.
+func (s3 *S3) writeErrorPage(w http.ResponseWriter, r *http.Request, code int, key string) bool {
+	if s3.missingPages != nil {
+		if _, missing := s3.missingPages.Get(key); missing {
+			return false
+		}
+	}
+	obj, err := fetchObject(r.Context(), s3, key)
+	if err == nil {
+		defer obj.Close()
+		var info minio.ObjectInfo
+		if info, err = obj.Stat(); err == nil {
+			ctype := mime.TypeByExtension(path.Ext(key))
+			if ctype == "" {
+				ctype = info.ContentType
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.WriteHeader(code)
+			if r.Method != http.MethodHead {
+				io.Copy(w, obj)
+			}
+			return true
+		}
+	}
+	if isNotFound(err) {
+		if s3.missingPages != nil {
+			s3.missingPages.SetDefault(key, true)
+		}
+	} else {
+		logError("Unable to serve the error page", "key", key, "err", err)
+	}
+	return false
+}
+
+// toHTTPStatus maps errors returned while looking up objects to the
+// HTTP status code reported to the client.
+func toHTTPStatus(err error) int {
+	switch {
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	case os.IsPermission(err):
+		return http.StatusForbidden
+	case err == errTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case err == errNotAcceptable:
+		return http.StatusNotAcceptable
+	case err == errTooBusy:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// localRedirect gives a Moved Permanently response, keeping the query.
+func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
+	if q := r.URL.RawQuery; q != "" {
+		newPath += "?" + q
+	}
+	w.Header().Set("Location", newPath)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+var htmlReplacer = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&#34;",
+	"'", "&#39;",
+)
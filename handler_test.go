@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/patrickmn/go-cache"
+)
+
+func TestAccessDeniedVersusNoSuchKey(t *testing.T) {
+	store := newFakeStore()
+	store.put("403.html", "<h1>forbidden</h1>").ContentType = "text/html"
+	store.errs["secret.txt"] = minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}
+	setGlobal(t, &errorPages, errorPagesFlag{403: "403.html"})
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/secret.txt", http.StatusForbidden, "<h1>forbidden</h1>"},
+		{"/missing.txt", http.StatusNotFound, ""},
+	} {
+		w := serve(s3, tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.path, w.Code, tc.code)
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s: got body %q, want %q", tc.path, w.Body.String(), tc.body)
+		}
+	}
+}
+
+func TestAccessDeniedListing(t *testing.T) {
+	store := newFakeStore()
+	store.listErrs["private/"] = minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}
+	s3 := newTestS3(t, store)
+
+	if w := serve(s3, "/private/"); w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	store := newFakeStore()
+	store.put("video.mp4", "0123456789")
+	store.put("empty.txt", "")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		method       string
+		path         string
+		rng          string
+		code         int
+		body         string
+		contentRange string
+	}{
+		{http.MethodGet, "/video.mp4", "", http.StatusOK, "0123456789", ""},
+		{http.MethodGet, "/video.mp4", "bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{http.MethodGet, "/video.mp4", "bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{http.MethodGet, "/video.mp4", "bytes=-2", http.StatusPartialContent, "89", "bytes 8-9/10"},
+		{http.MethodGet, "/video.mp4", "bytes=20-30", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{http.MethodHead, "/video.mp4", "", http.StatusOK, "", ""},
+		{http.MethodGet, "/empty.txt", "bytes=0-1", http.StatusOK, "", ""},
+	} {
+		w := serveMethod(s3, tc.method, tc.path, "Range", tc.rng)
+		if w.Code != tc.code {
+			t.Errorf("%s %s %q: got status %d, want %d", tc.method, tc.path, tc.rng, w.Code, tc.code)
+		}
+		if tc.code != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != tc.body {
+			t.Errorf("%s %s %q: got body %q, want %q", tc.method, tc.path, tc.rng, w.Body.String(), tc.body)
+		}
+		if got := w.Header().Get("Content-Range"); got != tc.contentRange {
+			t.Errorf("%s %s %q: got Content-Range %q, want %q", tc.method, tc.path, tc.rng, got, tc.contentRange)
+		}
+		if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+			t.Errorf("%s %s %q: got Accept-Ranges %q, want bytes", tc.method, tc.path, tc.rng, got)
+		}
+	}
+
+	w := serveMethod(s3, http.MethodHead, "/video.mp4")
+	if got := w.Header().Get("Content-Length"); got != "10" {
+		t.Errorf("HEAD: got Content-Length %q, want 10", got)
+	}
+}
+
+func TestDirectoryCacheDisabled(t *testing.T) {
+	for _, tc := range []struct {
+		cache *cache.Cache
+		lists int
+	}{
+		{nil, 3},
+		{cache.New(time.Hour, time.Hour), 1},
+	} {
+		store := newFakeStore()
+		store.put("docs/index.html", "docs")
+		s3 := newTestS3(t, store)
+		s3.cache = tc.cache
+		for i := 0; i < 3; i++ {
+			if isDir, err := pathIsDir(context.Background(), s3, "docs"); err != nil || !isDir {
+				t.Fatalf("docs: got %v %v, want a directory", isDir, err)
+			}
+		}
+		if lists := store.count(&store.lists); lists != tc.lists {
+			t.Errorf("cache %v: listed %d times, want %d", tc.cache != nil, lists, tc.lists)
+		}
+
+		// A directory gone from the bucket is noticed right away
+		// without a cache.
+		delete(store.objects, "docs/index.html")
+		isDir, _ := pathIsDir(context.Background(), s3, "docs")
+		if want := tc.cache != nil; isDir != want {
+			t.Errorf("cache %v: got isDir %v once deleted, want %v", tc.cache != nil, isDir, want)
+		}
+	}
+}
+
+func TestDirectoryTrailingSlash(t *testing.T) {
+	store := newFakeStore()
+	store.put("docs/index.html", "<h1>docs</h1>")
+	store.put("docs/guide.html", "<h1>guide</h1>")
+	store.put("files", "an object")
+	store.put("files/readme.txt", "below the object")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		target   string
+		code     int
+		location string
+		body     string
+	}{
+		{"/docs", http.StatusMovedPermanently, "docs/", ""},
+		{"/docs?lang=en", http.StatusMovedPermanently, "docs/?lang=en", ""},
+		{"/docs/", http.StatusOK, "", "<h1>docs</h1>"},
+		// An object named like a directory is served as is.
+		{"/files", http.StatusOK, "", "an object"},
+	} {
+		w := serve(s3, tc.target)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.target, w.Code, tc.code)
+		}
+		if got := w.Header().Get("Location"); got != tc.location {
+			t.Errorf("%s: got Location %q, want %q", tc.target, got, tc.location)
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s: got body %q, want %q", tc.target, w.Body.String(), tc.body)
+		}
+	}
+
+	// Failing to read the object named like the directory is no reason
+	// for a permanent redirect.
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}, http.StatusForbidden},
+		{minio.ErrorResponse{Code: "InternalError", StatusCode: http.StatusInternalServerError}, http.StatusInternalServerError},
+		{errTooBusy, http.StatusServiceUnavailable},
+	} {
+		store.errs["docs"] = tc.err
+		w := serve(s3, "/docs")
+		if w.Code != tc.code || w.Header().Get("Location") != "" {
+			t.Errorf("/docs with %v: got status %d to %q, want %d", tc.err, w.Code, w.Header().Get("Location"), tc.code)
+		}
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	setGlobal(t, &maxObjectSize, 8)
+	store := newFakeStore()
+	store.put("small.txt", "small")
+	store.put("large.bin", "far over the limit")
+	s3 := newTestS3(t, store)
+
+	for _, infoCache := range []*cache.Cache{nil, cache.New(time.Minute, time.Minute)} {
+		s3.infoCache = infoCache
+		// The second round goes through the info cache filled by the
+		// first.
+		for round := 0; round < 2; round++ {
+			if w := serve(s3, "/large.bin"); w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("info cache %v: got status %d for an oversized object, want %d", infoCache != nil, w.Code, http.StatusRequestEntityTooLarge)
+			} else if w.Body.String() == "far over the limit" {
+				t.Errorf("info cache %v: served the oversized object", infoCache != nil)
+			}
+			if w := serve(s3, "/small.txt"); w.Code != http.StatusOK || w.Body.String() != "small" {
+				t.Errorf("info cache %v: got status %d and body %q, want the small object", infoCache != nil, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestCacheCleanupInterval(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		ttl   time.Duration
+		want  time.Duration
+	}{
+		{"", 30 * time.Second, 30 * time.Second},
+		{"", time.Hour, 10 * time.Minute},
+		{"5s", time.Hour, 5 * time.Second},
+	} {
+		got, err := parseCleanupInterval(tc.value, tc.ttl)
+		if err != nil || got != tc.want {
+			t.Errorf("%q with a cache time of %s: got %s, %v, want %s", tc.value, tc.ttl, got, err, tc.want)
+		}
+	}
+	if _, err := parseCleanupInterval("often", time.Minute); err == nil {
+		t.Error("accepted an invalid interval")
+	}
+
+	// Expired entries are removed by the janitor without being looked up.
+	interval, _ := parseCleanupInterval("", 20*time.Millisecond)
+	c := cache.New(20*time.Millisecond, interval)
+	c.SetDefault("docs/", true)
+	for deadline := time.Now().Add(time.Second); c.ItemCount() > 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entry still cached after %s with a cleanup interval of %s", time.Second, interval)
+		}
+	}
+}
+
+func TestNoCachePattern(t *testing.T) {
+	setGlobal(t, &noCachePattern, regexp.MustCompile(`^/status\.json$|^/live/`))
+	store := newFakeStore()
+	store.put("status.json", `{"ok":true}`)
+	store.put("page.html", "<h1>page</h1>")
+	store.put("live/feed.json", "[]")
+	store.put("docs/guide.html", "guide")
+	s3 := newTestS3(t, store)
+	s3.cache = cache.New(time.Minute, time.Minute)
+	s3.infoCache = cache.New(time.Minute, time.Minute)
+	s3.bodyCache = newBodyCache(1<<20, 1<<20, time.Minute, false)
+
+	for _, tc := range []struct {
+		path     string
+		bypassed bool
+	}{
+		{"/status.json", true},
+		{"/page.html", false},
+		// Telling the directories apart from objects.
+		{"/live", true},
+		{"/docs", false},
+	} {
+		gets, lists := store.count(&store.gets), store.count(&store.lists)
+		for i := 0; i < 3; i++ {
+			if w := serve(s3, tc.path); w.Code >= http.StatusBadRequest {
+				t.Fatalf("%s: got status %d", tc.path, w.Code)
+			}
+		}
+		gets, lists = store.count(&store.gets)-gets, store.count(&store.lists)-lists
+		if fetched := gets + lists; tc.bypassed && fetched < 3 {
+			t.Errorf("%s: fetched %d times from S3 for 3 requests, want every time", tc.path, fetched)
+		} else if !tc.bypassed && fetched >= 3 {
+			t.Errorf("%s: fetched %d times from S3 for 3 requests, want it cached", tc.path, fetched)
+		}
+	}
+}
+
+func TestInfoCacheChangedObject(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.txt", "old")
+	store.put("b.txt", "0123456789")
+	s3 := newTestS3(t, store)
+	s3.infoCache = cache.New(time.Minute, time.Minute)
+	s3.limiter = newFetchLimiter(2, time.Second)
+
+	serve(s3, "/a.txt")
+	serve(s3, "/b.txt")
+	info := *store.put("a.txt", "new content")
+	store.put("b.txt", "abcdefghijklmnopqrstuvwxyz")
+
+	w := serve(s3, "/a.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "new content" {
+		t.Errorf("got status %d and body %q, want the new content", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Length"); got != "11" {
+		t.Errorf("got Content-Length %q, want 11", got)
+	}
+	if got, want := w.Header().Get("ETag"), `"`+info.ETag+`"`; got != want {
+		t.Errorf("got ETag %q, want the one of the new content %q", got, want)
+	}
+	w = serve(s3, "/b.txt", "Range", "bytes=20-")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "uvwxyz" {
+		t.Errorf("range: got status %d and body %q, want the end of the new content", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 20-25/26" {
+		t.Errorf("range: got Content-Range %q, want bytes 20-25/26", got)
+	}
+
+	// The refreshed info is cached again.
+	gets := store.count(&store.gets)
+	if w := serve(s3, "/a.txt"); w.Body.String() != "new content" {
+		t.Errorf("got body %q, want the new content", w.Body.String())
+	}
+	if got := store.count(&store.gets) - gets; got != 1 {
+		t.Errorf("%d GETs once the new info is cached, want 1", got)
+	}
+	if open := store.count(&store.open); open != 0 {
+		t.Errorf("%d objects left open", open)
+	}
+	if n := len(s3.limiter.slots); n != 0 {
+		t.Errorf("%d slots left taken", n)
+	}
+}
+
+func TestInfoCacheHitTakesSlot(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.txt", "content")
+	s3 := newTestS3(t, store)
+	s3.infoCache = cache.New(time.Minute, time.Minute)
+	s3.limiter = newFetchLimiter(1, 10*time.Millisecond)
+	serve(s3, "/a.txt")
+
+	if err := s3.limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(s3, "/a.txt"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with every slot taken, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	s3.limiter.release(context.Background())
+	if w := serve(s3, "/a.txt"); w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestInfoCacheCalls(t *testing.T) {
+	store := newFakeStore()
+	store.put("docs/index.html", "docs")
+	store.put("a.txt", "content")
+	s3 := newTestS3(t, store)
+	s3.infoCache = cache.New(time.Minute, time.Minute)
+
+	calls := func(target string) int {
+		before := store.count(&store.gets) + store.count(&store.stats)
+		serve(s3, target)
+		return store.count(&store.gets) + store.count(&store.stats) - before
+	}
+	for _, tc := range []struct {
+		path        string
+		first, next int
+	}{
+		// A single GET fetches the info and the body of an object,
+		// which is all that is left to fetch once its info is cached.
+		{"/a.txt", 1, 1},
+		{"/docs/", 1, 1},
+		// The object and the 404 page are looked up once, then known
+		// to be missing.
+		{"/missing.txt", 2, 0},
+	} {
+		if got := calls(tc.path); got != tc.first {
+			t.Errorf("%s: %d S3 calls, want %d", tc.path, got, tc.first)
+		}
+		if got := calls(tc.path); got != tc.next {
+			t.Errorf("%s: %d S3 calls once cached, want %d", tc.path, got, tc.next)
+		}
+	}
+}
+
+func TestDirectoryCheckListingError(t *testing.T) {
+	store := newFakeStore()
+	store.put("docs/index.html", "docs")
+	store.listErrs["docs/"] = minio.ErrorResponse{Code: "InternalError", StatusCode: http.StatusInternalServerError}
+	s3 := newTestS3(t, store)
+	s3.cache = cache.New(time.Minute, time.Minute)
+
+	if w := serve(s3, "/docs"); w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d while listing fails, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if _, cached := s3.cache.Get("docs/"); cached {
+		t.Error("cached the result of a failed listing")
+	}
+
+	store.mu.Lock()
+	delete(store.listErrs, "docs/")
+	store.mu.Unlock()
+	if w := serve(s3, "/docs"); w.Code != http.StatusMovedPermanently {
+		t.Errorf("got status %d once listing works again, want %d", w.Code, http.StatusMovedPermanently)
+	}
+}
+
+func TestNestedErrorPages(t *testing.T) {
+	setGlobal(t, &nestedErrorPages, true)
+	store := newFakeStore()
+	store.put("404.html", "root 404")
+	store.put("docs/404.html", "docs 404")
+	store.put("docs/api/v1/404.html", "api 404")
+	s3 := newTestS3(t, store)
+	s3.missingPages = cache.New(time.Minute, time.Minute)
+
+	for _, tc := range []struct {
+		path string
+		body string
+	}{
+		{"/missing.html", "root 404"},
+		{"/docs/missing.html", "docs 404"},
+		{"/docs/guide/missing.html", "docs 404"},
+		{"/docs/api/v1/missing.html", "api 404"},
+		{"/docs/api/v1/deep/", "api 404"},
+		{"/other/deep/missing.html", "root 404"},
+	} {
+		w := serve(s3, tc.path)
+		if w.Code != http.StatusNotFound || w.Body.String() != tc.body {
+			t.Errorf("%s: got status %d and body %q, want 404 and %q", tc.path, w.Code, w.Body.String(), tc.body)
+		}
+	}
+
+	// The missing pages looked up on the way are remembered.
+	gets := store.count(&store.gets)
+	serve(s3, "/other/deep/missing.html")
+	// The object, then the root 404 page.
+	if got := store.count(&store.gets) - gets; got != 2 {
+		t.Errorf("%d GETs once the missing pages are known, want 2", got)
+	}
+}
+
+func TestExactOnly(t *testing.T) {
+	setGlobal(t, &exactOnly, true)
+	setGlobal(t, &resolveOrder, []string{stageExact})
+	store := newFakeStore()
+	store.put("app.js", "app")
+	store.put("404.html", "not found page")
+	store.put("docs/index.html", "docs")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path string
+		code int
+		key  string
+	}{
+		{"/app.js", http.StatusOK, "app.js"},
+		{"/missing.js", http.StatusNotFound, "missing.js"},
+		{"/docs", http.StatusNotFound, "docs"},
+	} {
+		store.requested = nil
+		gets, lists := store.count(&store.gets), store.count(&store.lists)
+		w := serve(s3, tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.path, w.Code, tc.code)
+		}
+		if w.Code == http.StatusNotFound && strings.Contains(w.Body.String(), "not found page") {
+			t.Errorf("%s: served the 404 page of the bucket", tc.path)
+		}
+		if got := store.count(&store.gets) - gets; got != 1 || len(store.requested) != 1 || store.requested[0] != tc.key {
+			t.Errorf("%s: %d GETs of %q, want a single one of %q", tc.path, got, store.requested, tc.key)
+		}
+		if got := store.count(&store.lists) - lists; got != 0 {
+			t.Errorf("%s: listed %d times, want none", tc.path, got)
+		}
+	}
+}
+
+// TestMissingObjectStatus checks that missing objects are answered with
+// a real 404 status, even when the body is the error page of the bucket.
+func TestMissingObjectStatus(t *testing.T) {
+	store := newFakeStore()
+	store.put("index.html", "home")
+	store.put("404.html", "<h1>custom not found</h1>")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{http.MethodGet, "/index.html", http.StatusOK, "home"},
+		{http.MethodGet, "/missing.html", http.StatusNotFound, "<h1>custom not found</h1>"},
+		{http.MethodGet, "/missing/dir/", http.StatusNotFound, "<h1>custom not found</h1>"},
+		// The error page is an object like any other at its own path.
+		{http.MethodGet, "/404.html", http.StatusOK, "<h1>custom not found</h1>"},
+		{http.MethodHead, "/missing.html", http.StatusNotFound, ""},
+	} {
+		w := serveMethod(s3, tc.method, tc.path)
+		if w.Code != tc.code || w.Body.String() != tc.body {
+			t.Errorf("%s %s: got %d %q, want %d %q", tc.method, tc.path, w.Code, w.Body.String(), tc.code, tc.body)
+		}
+	}
+	if ctype := serve(s3, "/missing.html").Header().Get("Content-Type"); !strings.HasPrefix(ctype, "text/html") {
+		t.Errorf("got Content-Type %q for the error page, want text/html", ctype)
+	}
+
+	// Without the page in the bucket, the status is still 404.
+	store = newFakeStore()
+	if w := serve(newTestS3(t, store), "/missing.html"); w.Code != http.StatusNotFound {
+		t.Errorf("without 404.html: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// setContentEncoding passes through the Content-Encoding an object was
+// stored with, so that clients decode pre-compressed objects. Since the
+// bytes can no longer be sniffed the Content-Type is derived from the
+// extension, or taken from the object when it describes the decoded
+// content.
+func setContentEncoding(w http.ResponseWriter, info objectInfo) {
+	encoding := info.Metadata.Get("Content-Encoding")
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		return
+	}
+	w.Header().Set("Content-Encoding", encoding)
+
+	if w.Header().Get("Content-Type") != "" || mime.TypeByExtension(path.Ext(info.Key)) != "" {
+		return
+	}
+	switch ctype := info.ContentType; {
+	case ctype == "",
+		strings.HasPrefix(ctype, "application/octet-stream"),
+		strings.HasPrefix(ctype, "application/gzip"),
+		strings.HasPrefix(ctype, "application/x-gzip"):
+		w.Header().Set("Content-Type", "application/octet-stream")
+	default:
+		w.Header().Set("Content-Type", ctype)
+	}
+}
+
+// setETag passes through the ETag of the object, quoted as HTTP wants it
+// while S3 clients hand it out bare. ServeContent answers If-None-Match
+// and If-Range with it, and If-Modified-Since with the Last-Modified time
+// of the object, before any of the body is read from S3.
+func setETag(w http.ResponseWriter, info objectInfo) {
+	if info.ETag == "" {
+		return
+	}
+	w.Header().Set("ETag", quoteETag(info.ETag))
+}
+
+// quoteETag returns etag as an entity tag, quoted as S3 may omit it.
+func quoteETag(etag string) string {
+	if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, "W/") {
+		etag = `"` + etag + `"`
+	}
+	return etag
+}
+
+// mediaTypes are registered for extensions the system MIME tables may
+// lack, sniffing cannot tell most video containers apart and players
+// such as Safari refuse video served with a generic type.
+var mediaTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".ogv":  "video/ogg",
+	".ts":   "video/mp2t",
+	".webm": "video/webm",
+}
+
+func init() {
+	for ext, ctype := range mediaTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, ctype)
+		}
+	}
+}
+
+// setContentType sets the Content-Type of objects without a known
+// extension, which ServeContent would otherwise sniff: the one the object
+// was stored with when usable, and defaultContentType otherwise.
+func setContentType(w http.ResponseWriter, info objectInfo) {
+	if w.Header().Get("Content-Type") != "" {
+		return
+	}
+	ctype := info.ContentType
+	usable := ctype != "" &&
+		!strings.HasPrefix(ctype, "application/octet-stream") &&
+		!strings.HasPrefix(ctype, "binary/octet-stream")
+	if ext := path.Ext(info.Key); ext != "" {
+		// The stored type beats sniffing, defaultContentType is only
+		// meant for objects without an extension.
+		if usable && mime.TypeByExtension(ext) == "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+		return
+	}
+	switch {
+	case usable:
+		w.Header().Set("Content-Type", ctype)
+	case defaultContentType != "":
+		w.Header().Set("Content-Type", defaultContentType)
+	}
+}
+
+// parseMetaKeys parses a comma separated list of user metadata keys into
+// their canonical form, as found in ObjectInfo.UserMetadata.
+func parseMetaKeys(list string) []string {
+	var keys []string
+	for _, key := range strings.Split(list, ",") {
+		key = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(key)), "x-amz-meta-")
+		if key != "" {
+			keys = append(keys, http.CanonicalHeaderKey(key))
+		}
+	}
+	return keys
+}
+
+// setExposedMetadata copies the user metadata of the object listed in
+// exposeMeta to X-Amz-Meta-* response headers, any other metadata is
+// kept private.
+func setExposedMetadata(w http.ResponseWriter, info objectInfo) {
+	for _, key := range exposeMeta {
+		if value, ok := info.UserMetadata[key]; ok {
+			w.Header().Set("X-Amz-Meta-"+key, value)
+		}
+	}
+}
+
+// immutableCacheControl is sent for paths matching -immutable-pattern.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// setImmutable marks the response to r as cacheable forever when its
+// canonical path matches immutablePattern, such as the content hashed
+// file names of build tools, and reports whether it did.
+func setImmutable(w http.ResponseWriter, r *http.Request) bool {
+	if immutablePattern != nil && immutablePattern.MatchString(canonicalPath(r.URL.Path)) {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestStoredContentEncoding(t *testing.T) {
+	store := newFakeStore()
+	info := store.put("app.js", "\x1f\x8b compressed")
+	info.Metadata.Set("Content-Encoding", "gzip")
+	info.ContentType = "application/gzip"
+	info = store.put("data", "\x1f\x8b compressed")
+	info.Metadata.Set("Content-Encoding", "gzip")
+	info.ContentType = "application/json"
+	store.put("plain.txt", "plain")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path     string
+		encoding string
+		ctype    string
+	}{
+		{"/app.js", "gzip", mime.TypeByExtension(".js")},
+		{"/data", "gzip", "application/json"},
+		{"/plain.txt", "", mime.TypeByExtension(".txt")},
+	} {
+		w := serve(s3, tc.path, "Accept-Encoding", "gzip")
+		if got := w.Header().Get("Content-Encoding"); got != tc.encoding {
+			t.Errorf("%s: got Content-Encoding %q, want %q", tc.path, got, tc.encoding)
+		}
+		if got := w.Header().Get("Content-Type"); got != tc.ctype {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.path, got, tc.ctype)
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	setGlobal(t, &defaultContentType, "text/html; charset=utf-8")
+	store := newFakeStore()
+	store.put("about", "<!doctype html><h1>About</h1>").ContentType = "binary/octet-stream"
+	store.put("feed", "<rss></rss>").ContentType = "application/rss+xml"
+	store.put("untyped", "<h1>untyped</h1>")
+	store.put("notes.txt", "notes").ContentType = "application/octet-stream"
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path  string
+		ctype string
+	}{
+		{"/about", "text/html; charset=utf-8"},
+		{"/untyped", "text/html; charset=utf-8"},
+		// The stored type beats the default.
+		{"/feed", "application/rss+xml"},
+		// The default is only for objects without an extension.
+		{"/notes.txt", mime.TypeByExtension(".txt")},
+	} {
+		w := serve(s3, tc.path)
+		if got := w.Header().Get("Content-Type"); got != tc.ctype {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.path, got, tc.ctype)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != "" {
+			t.Errorf("%s: got Content-Disposition %q, want the page rendered inline", tc.path, got)
+		}
+	}
+}
+
+func TestImmutablePattern(t *testing.T) {
+	setGlobal(t, &immutablePattern, regexp.MustCompile(`\.[0-9a-f]{6,}\.(js|css)$`))
+	store := newFakeStore()
+	store.put("main.3f2a1b.js", "hashed")
+	store.put("main.js", "plain")
+	store.put("style.3f2a1b9c.css", "hashed")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path         string
+		cacheControl string
+	}{
+		{"/main.3f2a1b.js", immutableCacheControl},
+		{"/style.3f2a1b9c.css", immutableCacheControl},
+		{"/main.js", ""},
+		// Error responses are never cached forever.
+		{"/missing.3f2a1b.js", ""},
+	} {
+		w := serve(s3, tc.path)
+		if got := w.Header().Get("Cache-Control"); got != tc.cacheControl {
+			t.Errorf("%s: got Cache-Control %q, want %q", tc.path, got, tc.cacheControl)
+		}
+	}
+}
+
+func TestCacheControlPrecedence(t *testing.T) {
+	var controls cacheControlsFlag
+	for _, rule := range []string{"~\\.html$=no-cache", "/assets/*=max-age=3600", "/*=max-age=60"} {
+		if err := controls.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setGlobal(t, &cacheControls, controls)
+	setGlobal(t, &immutablePattern, regexp.MustCompile(`\.[0-9a-f]{6,}\.(js|css|html)$`))
+	store := newFakeStore()
+	for _, key := range []string{"index.html", "page.3f2a1b.html", "assets/site.css", "assets/site.3f2a1b.css", "robots.txt"} {
+		store.put(key, "content")
+	}
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path         string
+		cacheControl string
+	}{
+		// Fingerprinted paths are immutable whatever the rules say.
+		{"/page.3f2a1b.html", immutableCacheControl},
+		{"/assets/site.3f2a1b.css", immutableCacheControl},
+		// The others get the first matching rule.
+		{"/index.html", "no-cache"},
+		{"/assets/site.css", "max-age=3600"},
+		{"/robots.txt", "max-age=60"},
+	} {
+		if got := serve(s3, tc.path).Header().Get("Cache-Control"); got != tc.cacheControl {
+			t.Errorf("%s: got Cache-Control %q, want %q", tc.path, got, tc.cacheControl)
+		}
+	}
+}
+
+func TestPatternsMatchCanonicalPath(t *testing.T) {
+	var controls cacheControlsFlag
+	if err := controls.Set("/assets/*=max-age=60"); err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &cacheControls, controls)
+	setGlobal(t, &immutablePattern, regexp.MustCompile(`^/dist/`))
+	rule, err := parseHeaderRule("/private/*=X-Robots-Tag: noindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &headers, headersFlag{rule})
+	store := newFakeStore()
+	store.put("assets/site.css", "body{}")
+	store.put("dist/main.js", "main")
+	store.put("private/index.html", "private")
+	h := withHeaders(newTestS3(t, store))
+
+	for _, tc := range []struct {
+		path, header, value string
+	}{
+		{"/assets/site.css", "Cache-Control", "max-age=60"},
+		{"/x/../assets/site.css", "Cache-Control", "max-age=60"},
+		{"//assets/site.css", "Cache-Control", "max-age=60"},
+		{"/dist/main.js", "Cache-Control", immutableCacheControl},
+		{"/./dist/main.js", "Cache-Control", immutableCacheControl},
+		{"//dist/main.js", "Cache-Control", immutableCacheControl},
+		{"/private/index.html", "X-Robots-Tag", "noindex"},
+		{"/public/../private/index.html", "X-Robots-Tag", "noindex"},
+		{"//private/index.html", "X-Robots-Tag", "noindex"},
+	} {
+		w := serve(h, tc.path)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d", tc.path, w.Code)
+			continue
+		}
+		if got := w.Header().Get(tc.header); got != tc.value {
+			t.Errorf("%s: got %s %q, want %q", tc.path, tc.header, got, tc.value)
+		}
+	}
+}
+
+// TestSafariVideoProbe replays the requests Safari makes before playing a
+// video: a probe of the first two bytes, then ranges of the rest.
+func TestSafariVideoProbe(t *testing.T) {
+	video := strings.Repeat("\x00\x00\x00\x18ftypmp42", 1000)
+	size := len(video)
+	store := newFakeStore()
+	store.put("movie.mp4", video)
+	store.put("clip", video).ContentType = "video/quicktime"
+	store.put("film.mkv", video).ContentType = "video/x-matroska"
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path, ctype string
+	}{
+		{"/movie.mp4", "video/mp4"},
+		{"/clip", "video/quicktime"},
+		{"/film.mkv", mime.TypeByExtension(".mkv")},
+	} {
+		if tc.ctype == "" {
+			// An extension unknown to the system takes the stored type.
+			tc.ctype = "video/x-matroska"
+		}
+		for _, step := range []struct {
+			rng, contentRange, body string
+		}{
+			{"bytes=0-1", fmt.Sprintf("bytes 0-1/%d", size), video[:2]},
+			{fmt.Sprintf("bytes=0-%d", size-1), fmt.Sprintf("bytes 0-%d/%d", size-1, size), video},
+			{"bytes=1000-", fmt.Sprintf("bytes 1000-%d/%d", size-1, size), video[1000:]},
+		} {
+			w := serve(s3, tc.path, "Range", step.rng, "User-Agent", "AppleCoreMedia/1.0.0 (Macintosh; U; Intel Mac OS X 10_15_7)")
+			if w.Code != http.StatusPartialContent {
+				t.Errorf("%s %s: got status %d, want %d", tc.path, step.rng, w.Code, http.StatusPartialContent)
+				continue
+			}
+			if got := w.Header().Get("Content-Range"); got != step.contentRange {
+				t.Errorf("%s %s: got Content-Range %q, want %q", tc.path, step.rng, got, step.contentRange)
+			}
+			if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("%s %s: got Accept-Ranges %q, want bytes", tc.path, step.rng, got)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.ctype {
+				t.Errorf("%s %s: got Content-Type %q, want %q", tc.path, step.rng, got, tc.ctype)
+			}
+			if w.Body.String() != step.body {
+				t.Errorf("%s %s: got %d bytes, want %d", tc.path, step.rng, w.Body.Len(), len(step.body))
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//go:build http3
+// +build http3
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startHTTP3 starts a QUIC listener on the same address as srv, reusing
+// its handler and its TLS config, and makes srv advertise it to clients
+// through the Alt-Svc header. Sharing the TLS config keeps client
+// certificate verification, reloaded certificates, OCSP staples and
+// rotated session tickets in effect over QUIC as well.
+func startHTTP3(srv *http.Server) {
+	h3 := &http3.Server{
+		Addr:    srv.Addr,
+		Handler: srv.Handler,
+		// Wrapped with http3.ConfigureTLSConfig by the listener, which
+		// negotiates h3 on top of what GetConfigForClient returns.
+		TLSConfig: srv.TLSConfig,
+	}
+
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := h3.SetQUICHeaders(w.Header()); err != nil {
+			logError("Unable to set the QUIC headers", "err", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+
+	// Stopped along with srv, draining requests for as long.
+	srv.RegisterOnShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := h3.Shutdown(ctx); err != nil {
+			h3.Close()
+		}
+	})
+
+	go func() {
+		logInfo("Started listening", "url", "https://"+srv.Addr, "proto", "HTTP/3")
+		if err := h3.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+}
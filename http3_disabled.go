@@ -0,0 +1,14 @@
+//go:build !http3
+// +build !http3
+
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// startHTTP3 is a stub for binaries built without the http3 tag.
+func startHTTP3(srv *http.Server) {
+	log.Fatalln("HTTP/3 support is not compiled in, rebuild s3www with '-tags http3'")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cidrsFlag implements flag.Value for repeatable flags taking comma
+// separated CIDR ranges, where a bare address is a range of its own.
+type cidrsFlag []*net.IPNet
+
+func (c *cidrsFlag) String() string {
+	var ranges []string
+	for _, n := range *c {
+		ranges = append(ranges, n.String())
+	}
+	return strings.Join(ranges, ",")
+}
+
+func (c *cidrsFlag) repeatable() {}
+
+func (c *cidrsFlag) Set(value string) error {
+	for _, item := range splitList(value) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("%q is neither an IP address nor a CIDR range", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			*c = append(*c, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return fmt.Errorf("%q is neither an IP address nor a CIDR range", item)
+		}
+		*c = append(*c, n)
+	}
+	return nil
+}
+
+// contains reports whether ip is in one of the ranges.
+func (c cidrsFlag) contains(ip net.IP) bool {
+	for _, n := range c {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of r. Requests coming from
+// trusted proxies are attributed to the address they forwarded the
+// request for, that is the last address of X-Forwarded-For that is not a
+// trusted proxy itself, since the ones before could be spoofed.
+func clientIP(r *http.Request, trusted cidrsFlag) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted.contains(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trusted.contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// withIPFilter refuses with 403 Forbidden the requests of clients in the
+// deny ranges, and when allow is not empty of those outside its ranges.
+func withIPFilter(allow, deny, trusted cidrsFlag, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trusted)
+		if ip == nil || deny.contains(ip) || (len(allow) > 0 && !allow.contains(ip)) {
+			logDebug("Refused client", "ip", ip, "path", r.URL.Path)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
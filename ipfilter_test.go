@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// cidrs returns the ranges of value, as given to -allow-cidr.
+func cidrs(t *testing.T, value string) cidrsFlag {
+	t.Helper()
+	var c cidrsFlag
+	if value != "" {
+		if err := c.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// requestFrom returns a request from the peer remoteAddr with the
+// X-Forwarded-For header xff, if any.
+func requestFrom(remoteAddr, xff string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	if xff != "" {
+		r.Header.Set("X-Forwarded-For", xff)
+	}
+	return r
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := cidrs(t, "10.0.0.0/8")
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"direct", "203.0.113.7:51000", "", "203.0.113.7"},
+		{"untrusted peer", "203.0.113.7:51000", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:51000", "203.0.113.7", "203.0.113.7"},
+		{"spoofed leading hop", "10.0.0.1:51000", "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{"chained proxies", "10.0.0.1:51000", "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"repeated headers", "10.0.0.1:51000", "", "203.0.113.7"},
+		{"trusted proxy without header", "10.0.0.1:51000", "", "10.0.0.1"},
+		{"invalid hop", "10.0.0.1:51000", "unknown, 10.0.0.2", "10.0.0.2"},
+	} {
+		r := requestFrom(tc.remoteAddr, tc.xff)
+		if tc.name == "repeated headers" {
+			r.Header.Add("X-Forwarded-For", "198.51.100.1")
+			r.Header.Add("X-Forwarded-For", "203.0.113.7")
+		}
+		if got := clientIP(r, trusted); got.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	for _, tc := range []struct {
+		name        string
+		allow, deny string
+		remoteAddr  string
+		xff         string
+		code        int
+	}{
+		{"no ranges", "", "", "203.0.113.7:1", "", http.StatusOK},
+		{"allowed range", "203.0.113.0/24", "", "203.0.113.7:1", "", http.StatusOK},
+		{"outside the allowed range", "203.0.113.0/24", "", "198.51.100.1:1", "", http.StatusForbidden},
+		{"denied range", "", "203.0.113.0/24", "203.0.113.7:1", "", http.StatusForbidden},
+		{"outside the denied range", "", "203.0.113.0/24", "198.51.100.1:1", "", http.StatusOK},
+		{"deny wins over allow", "203.0.113.0/24", "203.0.113.7", "203.0.113.7:1", "", http.StatusForbidden},
+		{"bare address", "203.0.113.7", "", "203.0.113.7:1", "", http.StatusOK},
+		{"bare address is a single address", "203.0.113.7", "", "203.0.113.8:1", "", http.StatusForbidden},
+		{"IPv6 range", "2001:db8::/32", "", "[2001:db8::1]:1", "", http.StatusOK},
+		{"forwarded for an allowed client", "203.0.113.0/24", "", "10.0.0.1:1", "203.0.113.7", http.StatusOK},
+		{"spoofed allowed hop", "203.0.113.0/24", "", "10.0.0.1:1", "203.0.113.7, 198.51.100.1", http.StatusForbidden},
+		{"header of an untrusted peer", "203.0.113.0/24", "", "198.51.100.1:1", "203.0.113.7", http.StatusForbidden},
+		{"forwarded for a denied client", "", "203.0.113.7", "10.0.0.1:1", "203.0.113.7", http.StatusForbidden},
+	} {
+		h := withIPFilter(cidrs(t, tc.allow), cidrs(t, tc.deny), cidrs(t, "10.0.0.0/8"), next)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, requestFrom(tc.remoteAddr, tc.xff))
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.code)
+		}
+		if tc.code == http.StatusOK && w.Body.String() != "ok" {
+			t.Errorf("%s: got body %q, want the next handler", tc.name, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when checking the expiry and the
+// start of validity of tokens.
+const jwtLeeway = time.Minute
+
+var errInvalidToken = errors.New("invalid token")
+
+// jwtVerifier checks the signature and validity of JSON Web Tokens, signed
+// with HS256 by secret or with RS256 by publicKey or one of the keys of a
+// JWKS, and when set that they were issued by issuer for audience.
+type jwtVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	jwks      *jwksCache
+	issuer    string
+	audience  string
+}
+
+// loadRSAPublicKey reads the PEM encoded RSA public key, or certificate,
+// of file.
+func loadRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM data", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an RSA public key", file)
+	}
+	return pub, nil
+}
+
+// verify returns the claims of token once its signature and validity
+// checked out. Tokens must expire, so that a leaked one is not valid
+// forever.
+func (v *jwtVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// The algorithm is never trusted to pick the kind of key, so that a
+	// public key cannot be used as an HMAC secret.
+	switch header.Alg {
+	case "HS256":
+		if v.secret == nil {
+			return nil, fmt.Errorf("unexpected algorithm %q", header.Alg)
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errInvalidToken
+		}
+	case "RS256":
+		key := v.publicKey
+		if key == nil && v.jwks != nil {
+			if key, err = v.jwks.key(header.Kid); err != nil {
+				return nil, err
+			}
+		}
+		if key == nil {
+			return nil, fmt.Errorf("unexpected algorithm %q", header.Alg)
+		}
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return nil, errInvalidToken
+		}
+	default:
+		return nil, fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token without expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if iss, _ := claims["iss"].(string); v.issuer != "" && iss != v.issuer {
+		return nil, fmt.Errorf("token issued by %q", iss)
+	}
+	if v.audience != "" && !claimHolds(claims, "aud", v.audience) {
+		return nil, errors.New("token issued for another audience")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// jwksCache holds the RSA keys of a JWKS URL, fetched again every
+// jwksRefresh, or when a token names a key it does not know as happens
+// when keys are rotated, but at most every jwksMinRefresh.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+const (
+	jwksRefresh    = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// key returns the key kid, or the only key of the set when kid is empty.
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lookup := func() *rsa.PublicKey {
+		if kid == "" && len(c.keys) == 1 {
+			for _, k := range c.keys {
+				return k
+			}
+		}
+		return c.keys[kid]
+	}
+	since := time.Since(c.fetched)
+	if k := lookup(); k != nil && since < jwksRefresh {
+		return k, nil
+	}
+	if since >= jwksMinRefresh {
+		if err := c.fetch(); err != nil {
+			logWarn("Unable to fetch the JWKS", "url", c.url, "err", err)
+		}
+	}
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// fetch loads the keys of the JWKS, keeping the previous ones on failure.
+func (c *jwksCache) fetch() error {
+	c.fetched = time.Now()
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS answered %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS holds no RSA signing key")
+	}
+	c.keys = keys
+	return nil
+}
+
+// claimRule requires the claim name, a dotted path into nested claims,
+// to be value or, for a list, to hold it.
+type claimRule struct {
+	name  string
+	value string
+}
+
+// claimRulesFlag implements flag.Value for the repeatable -jwt-claim flag.
+type claimRulesFlag []claimRule
+
+func (c *claimRulesFlag) String() string {
+	var rules []string
+	for _, rule := range *c {
+		rules = append(rules, rule.name+"="+rule.value)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (c *claimRulesFlag) repeatable() {}
+
+func (c *claimRulesFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("claim %q is not of the form NAME=VALUE", value)
+	}
+	*c = append(*c, claimRule{name: value[:i], value: value[i+1:]})
+	return nil
+}
+
+// claimHolds reports whether the claim at the dotted path name of claims
+// is value or a list holding it.
+func claimHolds(claims map[string]interface{}, name, value string) bool {
+	var v interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		v = m[key]
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if fmt.Sprint(item) == value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(v) == value
+	}
+}
+
+// claimsAllowed reports whether claims satisfy rules: rules of the same
+// claim are alternatives, while every claim named by rules must match
+// one of them.
+func claimsAllowed(claims map[string]interface{}, rules []claimRule) bool {
+	matched := make(map[string]bool)
+	for _, rule := range rules {
+		if _, ok := matched[rule.name]; !ok {
+			matched[rule.name] = false
+		}
+		if claimHolds(claims, rule.name, rule.value) {
+			matched[rule.name] = true
+		}
+	}
+	for _, ok := range matched {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// jwtAuth is an authorizer letting in requests bearing a valid JSON Web
+// Token, in the Authorization header or in a cookie, whose claims satisfy
+// the claim rules.
+type jwtAuth struct {
+	verifier *jwtVerifier
+	cookie   string
+	rules    []claimRule
+}
+
+// token returns the token of r.
+func (a *jwtAuth) token(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	if a.cookie != "" {
+		if c, err := r.Cookie(a.cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func (a *jwtAuth) authorize(r *http.Request) (authDecision, error) {
+	header := make(http.Header)
+	token := a.token(r)
+	if token == "" {
+		header.Set("WWW-Authenticate", "Bearer")
+		return authDecision{status: http.StatusUnauthorized, header: header}, nil
+	}
+	claims, err := a.verifier.verify(token)
+	if err != nil {
+		logDebug("Refused token", "path", r.URL.Path, "err", err)
+		header.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return authDecision{status: http.StatusUnauthorized, header: header}, nil
+	}
+	if !claimsAllowed(claims, a.rules) {
+		logDebug("Refused token claims", "path", r.URL.Path, "sub", claims["sub"])
+		return authDecision{status: http.StatusForbidden}, nil
+	}
+	sub, _ := claims["sub"].(string)
+	return authDecision{user: sub}, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// signHS256 returns a token of claims signed with secret.
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTVerify(t *testing.T) {
+	const secret = "jwt secret"
+	v := &jwtVerifier{secret: []byte(secret), issuer: "https://login.example.com", audience: "docs"}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{"valid", map[string]interface{}{"iss": "https://login.example.com", "aud": "docs", "exp": exp}, true},
+		{"audience list", map[string]interface{}{"iss": "https://login.example.com", "aud": []string{"api", "docs"}, "exp": exp}, true},
+		{"no expiry", map[string]interface{}{"iss": "https://login.example.com", "aud": "docs"}, false},
+		{"expired", map[string]interface{}{"iss": "https://login.example.com", "aud": "docs", "exp": time.Now().Add(-time.Hour).Unix()}, false},
+		{"within leeway", map[string]interface{}{"iss": "https://login.example.com", "aud": "docs", "exp": time.Now().Add(-jwtLeeway / 2).Unix()}, true},
+		{"not valid yet", map[string]interface{}{"iss": "https://login.example.com", "aud": "docs", "exp": exp, "nbf": time.Now().Add(time.Hour).Unix()}, false},
+		{"other issuer", map[string]interface{}{"iss": "https://evil.example.com", "aud": "docs", "exp": exp}, false},
+		{"no issuer", map[string]interface{}{"aud": "docs", "exp": exp}, false},
+		{"other audience", map[string]interface{}{"iss": "https://login.example.com", "aud": "api", "exp": exp}, false},
+		{"no audience", map[string]interface{}{"iss": "https://login.example.com", "exp": exp}, false},
+	} {
+		if _, err := v.verify(signHS256(t, secret, tc.claims)); (err == nil) != tc.valid {
+			t.Errorf("%s: got error %v, want valid %v", tc.name, err, tc.valid)
+		}
+	}
+
+	// Without -jwt-issuer and -jwt-audience any issuer and audience do.
+	v = &jwtVerifier{secret: []byte(secret)}
+	if _, err := v.verify(signHS256(t, secret, map[string]interface{}{"iss": "anyone", "exp": exp})); err != nil {
+		t.Errorf("without issuer and audience: %v", err)
+	}
+	if _, err := v.verify(signHS256(t, "other secret", map[string]interface{}{"exp": exp})); err == nil {
+		t.Error("accepted a token signed with another secret")
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	const secret = "jwt secret"
+	store := newFakeStore()
+	store.put("index.html", "private")
+	var rules claimRulesFlag
+	if err := rules.Set("groups=docs"); err != nil {
+		t.Fatal(err)
+	}
+	a := &jwtAuth{verifier: &jwtVerifier{secret: []byte(secret), audience: "docs"}, cookie: "token", rules: rules}
+	h := withAuth(a, newTestS3(t, store))
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := signHS256(t, secret, map[string]interface{}{"sub": "alice", "aud": "docs", "groups": []string{"docs"}, "exp": exp})
+
+	for _, tc := range []struct {
+		name   string
+		header []string
+		code   int
+	}{
+		{"bearer", []string{"Authorization", "Bearer " + valid}, http.StatusOK},
+		{"cookie", []string{"Cookie", "token=" + valid}, http.StatusOK},
+		{"none", nil, http.StatusUnauthorized},
+		{"no expiry", []string{"Authorization", "Bearer " + signHS256(t, secret, map[string]interface{}{"aud": "docs", "groups": "docs"})}, http.StatusUnauthorized},
+		{"other audience", []string{"Authorization", "Bearer " + signHS256(t, secret, map[string]interface{}{"aud": "api", "groups": "docs", "exp": exp})}, http.StatusUnauthorized},
+		{"claims", []string{"Authorization", "Bearer " + signHS256(t, secret, map[string]interface{}{"aud": "docs", "groups": "ops", "exp": exp})}, http.StatusForbidden},
+	} {
+		w := serve(h, "/index.html", tc.header...)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.code)
+		}
+		if tc.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", tc.name)
+		}
+	}
+}
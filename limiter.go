@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errTooBusy is returned when no S3 request slot frees up in time.
+var errTooBusy = errors.New("too many concurrent S3 requests")
+
+// fetchLimiter bounds the number of concurrent requests made to S3. A nil
+// *fetchLimiter imposes no limit.
+type fetchLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newFetchLimiter(max int, timeout time.Duration) *fetchLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &fetchLimiter{
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+	}
+}
+
+// fetchScope is the slot shared by the S3 requests made on behalf of a
+// single client request. Serving an object while fetching another, such
+// as a precompressed sibling or an error page, then never waits for a
+// second slot, which requests each holding one could otherwise starve
+// each other of until the queue timeout.
+type fetchScope struct {
+	mu   sync.Mutex
+	held int
+}
+
+type fetchScopeKey struct{}
+
+// withFetchScope returns a copy of ctx whose S3 requests share a slot.
+func withFetchScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fetchScopeKey{}, &fetchScope{})
+}
+
+// acquire waits for a free slot, for at most the queue timeout or until
+// ctx is done, every successful acquire must be paired with a release.
+// Within a fetch scope only the first acquire waits for a slot, the
+// others share it.
+func (l *fetchLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	scope, _ := ctx.Value(fetchScopeKey{}).(*fetchScope)
+	if scope == nil {
+		return l.wait(ctx)
+	}
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+	if scope.held == 0 {
+		if err := l.wait(ctx); err != nil {
+			return err
+		}
+	}
+	scope.held++
+	return nil
+}
+
+// wait takes a slot, waiting for at most the queue timeout or until ctx
+// is done.
+func (l *fetchLimiter) wait(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return errTooBusy
+	case <-ctx.Done():
+		return errTooBusy
+	}
+}
+
+// release gives back the slot taken by acquire with ctx, once released
+// as many times as acquired within a fetch scope.
+func (l *fetchLimiter) release(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	if scope, ok := ctx.Value(fetchScopeKey{}).(*fetchScope); ok {
+		scope.mu.Lock()
+		defer scope.mu.Unlock()
+		if scope.held--; scope.held > 0 {
+			return
+		}
+	}
+	<-l.slots
+}
+
+// limitedObject is an object holding a slot of the fetch limiter, given
+// back once it is closed since its body streams from S3 until then.
+type limitedObject struct {
+	s3Object
+	release func()
+	once    sync.Once
+}
+
+// holdSlot returns obj releasing the slot acquired with ctx on Close.
+func (l *fetchLimiter) holdSlot(ctx context.Context, obj s3Object) s3Object {
+	if l == nil {
+		return obj
+	}
+	return &limitedObject{s3Object: obj, release: func() { l.release(ctx) }}
+}
+
+func (o *limitedObject) Close() error {
+	err := o.s3Object.Close()
+	o.once.Do(o.release)
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchLimiterBoundsInFlightRequests(t *testing.T) {
+	const limit = 3
+	store := newFakeStore()
+	for i := 0; i < 10; i++ {
+		store.put(fmt.Sprintf("f%d.txt", i), "content")
+	}
+	store.readDelay = 5 * time.Millisecond
+	s3 := newTestS3(t, store)
+	s3.limiter = newFetchLimiter(limit, 10*time.Second)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 40)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- serve(s3, fmt.Sprintf("/f%d.txt", i%10)).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("got status %d, want 200", code)
+		}
+	}
+	if max := store.count(&store.maxOpen); max > limit {
+		t.Errorf("%d S3 requests in flight, want at most %d", max, limit)
+	}
+	if open := store.count(&store.open); open != 0 {
+		t.Errorf("%d objects left open", open)
+	}
+	if n := len(s3.limiter.slots); n != 0 {
+		t.Errorf("%d slots left taken", n)
+	}
+}
+
+func TestFetchLimiterTooBusy(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.txt", "content")
+	s3 := newTestS3(t, store)
+	s3.limiter = newFetchLimiter(1, 10*time.Millisecond)
+
+	if err := s3.limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(s3, "/a.txt"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	s3.limiter.release(context.Background())
+	if w := serve(s3, "/a.txt"); w.Code != http.StatusOK {
+		t.Errorf("got status %d once released, want 200", w.Code)
+	}
+}
+
+func TestFetchScopeSharesSlot(t *testing.T) {
+	l := newFetchLimiter(1, 10*time.Millisecond)
+	ctx := withFetchScope(context.Background())
+	for i := 0; i < 3; i++ {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatalf("acquire %d within the scope: %v", i, err)
+		}
+	}
+	if err := l.acquire(context.Background()); err != errTooBusy {
+		t.Errorf("acquire outside the scope: got %v, want %v", err, errTooBusy)
+	}
+	for i := 0; i < 3; i++ {
+		l.release(ctx)
+	}
+	if err := l.acquire(context.Background()); err != nil {
+		t.Errorf("acquire once the scope released: %v", err)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// listingPageSize is the number of entries returned per listing page.
+var listingPageSize = 1000
+
+// listingHide are the glob patterns of the names left out of listings.
+var listingHide []string
+
+// listingOrder is how the entries of a listing page are sorted, by name,
+// size or modtime.
+type listingOrder struct {
+	by   string
+	desc bool
+}
+
+// listingSort is the parsed -listing-sort, S3 lists keys by name.
+var listingSort = listingOrder{by: "name"}
+
+// parseListingSort parses a sort order of the form FIELD[:asc|:desc].
+func parseListingSort(value string) (listingOrder, error) {
+	order := listingOrder{by: strings.ToLower(strings.TrimSpace(value))}
+	if i := strings.Index(order.by, ":"); i >= 0 {
+		switch order.by[i+1:] {
+		case "asc":
+		case "desc":
+			order.desc = true
+		default:
+			return order, fmt.Errorf("listing sort %q must be ascending 'asc' or descending 'desc'", value)
+		}
+		order.by = order.by[:i]
+	}
+	switch order.by {
+	case "name", "size", "modtime":
+	default:
+		return order, fmt.Errorf("listing sort %q must be by 'name', 'size' or 'modtime'", value)
+	}
+	return order, nil
+}
+
+// parseListingHide parses a comma separated list of glob patterns.
+func parseListingHide(list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid listing hide pattern %q: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// hiddenEntry reports whether the entry name matches one of listingHide.
+func hiddenEntry(name string) bool {
+	for _, pattern := range listingHide {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted reports whether pages are listed in order as S3 lists them.
+func (o listingOrder) sorted() bool {
+	return o.by == "name" && !o.desc
+}
+
+// sort sorts the entries of a page, directories first unless sorting
+// by name.
+func (o listingOrder) sort(entries []listingEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if o.by != "name" && a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if o.desc {
+			a, b = b, a
+		}
+		switch o.by {
+		case "size":
+			return a.Size < b.Size
+		case "modtime":
+			return a.LastModified.Before(b.LastModified)
+		default:
+			return a.Name < b.Name
+		}
+	})
+}
+
+// errInvalidContinuation is returned for a malformed continuation token.
+var errInvalidContinuation = errors.New("invalid continuation token")
+
+// listingEntry describes an object or a sub-directory in a JSON listing.
+type listingEntry struct {
+	Name         string    `json:"name"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	IsDir        bool      `json:"isDir"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// MarshalJSON leaves out the lastModified of directories, which have
+// none, since omitempty never omits a struct such as time.Time.
+func (e listingEntry) MarshalJSON() ([]byte, error) {
+	type entry listingEntry
+	var modified *time.Time
+	if !e.LastModified.IsZero() {
+		modified = &e.LastModified
+	}
+	return json.Marshal(struct {
+		entry
+		LastModified *time.Time `json:"lastModified,omitempty"`
+	}{entry(e), modified})
+}
+
+// listing is a page of a JSON directory listing, Continuation is set when
+// more entries are available and is passed back as ?continuation= to
+// fetch the next page.
+type listing struct {
+	Prefix       string         `json:"prefix"`
+	Entries      []listingEntry `json:"entries"`
+	Continuation string         `json:"continuation,omitempty"`
+}
+
+// wantsJSONListing reports whether the client asked for a machine readable
+// listing, either with ?format=json or by accepting application/json.
+func wantsJSONListing(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	varyOn(r, "Accept")
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mt == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// walkPrefix calls fn, in order, with a single page of the entries
+// directly under prefix as S3 lists them, starting after the key encoded
+// in continuation. It returns the continuation of the next page, empty
+// when there is none. Continuations encode keys relative to prefix, and
+// the keys of the entries are relative to the key prefix of the request,
+// so that neither discloses it.
+func walkPrefix(ctx context.Context, s3 *S3, prefix, continuation string, fn func(listingEntry) error) (string, error) {
+	var startAfter string
+	if continuation != "" {
+		key, err := base64.RawURLEncoding.DecodeString(continuation)
+		if err != nil {
+			return "", errInvalidContinuation
+		}
+		startAfter = prefix + string(key)
+	}
+
+	if err := s3.limiter.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer s3.limiter.release(ctx)
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		lastKey string
+		n       int
+	)
+	for obj := range s3.Client.ListObjects(listCtx, s3.bucket, minio.ListObjectsOptions{
+		Prefix:     prefix,
+		StartAfter: startAfter,
+	}) {
+		if obj.Err != nil {
+			return "", obj.Err
+		}
+		if obj.Key == prefix {
+			// The directory marker object itself.
+			continue
+		}
+		if n == listingPageSize {
+			return base64.RawURLEncoding.EncodeToString([]byte(strings.TrimPrefix(lastKey, prefix))), nil
+		}
+		lastKey = obj.Key
+
+		entry := listingEntry{
+			Name:         strings.TrimPrefix(obj.Key, prefix),
+			Key:          unprefixedKey(ctx, obj.Key),
+			Size:         obj.Size,
+			ETag:         obj.ETag,
+			LastModified: obj.LastModified,
+		}
+		if strings.HasSuffix(entry.Name, pathSeparator) {
+			// Resume after every key under the sub-directory, not
+			// just after the sub-directory itself.
+			lastKey += string(utf8.MaxRune)
+			entry = listingEntry{
+				Name:  strings.TrimSuffix(entry.Name, pathSeparator),
+				Key:   entry.Key,
+				IsDir: true,
+			}
+		}
+		if hiddenEntry(entry.Name) {
+			continue
+		}
+		n++
+		if err := fn(entry); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// listPrefix lists a single page of the entries directly under prefix,
+// starting after the key encoded in continuation, sorted by listingSort.
+func listPrefix(ctx context.Context, s3 *S3, prefix, continuation string) (listing, error) {
+	result := listing{Prefix: unprefixedKey(ctx, prefix), Entries: []listingEntry{}}
+	next, err := walkPrefix(ctx, s3, prefix, continuation, func(e listingEntry) error {
+		result.Entries = append(result.Entries, e)
+		return nil
+	})
+	result.Continuation = next
+	listingSort.sort(result.Entries)
+	return result, err
+}
+
+// listingPrefix returns the prefix listed for the directory name.
+func listingPrefix(name string) string {
+	prefix := strings.Trim(name, pathSeparator)
+	if prefix != "" {
+		prefix += pathSeparator
+	}
+	return prefix
+}
+
+// listError writes the error response of a failed listing of prefix.
+func listError(w http.ResponseWriter, r *http.Request, s3 *S3, prefix string, err error) {
+	if err == errInvalidContinuation {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logError("Unable to list", "prefix", prefix, "err", err)
+	s3.serveError(w, r, toHTTPStatus(err))
+}
+
+// listPage lists the page of the directory name requested by r, writing
+// the error response when it cannot.
+func listPage(w http.ResponseWriter, r *http.Request, s3 *S3, name string) (listing, bool) {
+	prefix := listingPrefix(name)
+	result, err := listPrefix(r.Context(), s3, prefix, r.URL.Query().Get("continuation"))
+	if err != nil {
+		listError(w, r, s3, prefix, err)
+		return result, false
+	}
+	return result, true
+}
+
+// listingWriter returns the writer of a listing of the media type ctype
+// in the response to r, compressed on the fly like an object of that type
+// would be, along with the func ending the response. The length of a
+// listing is unknown until it is written, so -compress-min-size does not
+// apply to it.
+func listingWriter(w http.ResponseWriter, r *http.Request, ctype string) (http.ResponseWriter, func() error) {
+	w.Header().Set("Content-Type", ctype)
+	enc := compressEncoding(w, r, objectInfo{ObjectInfo: minio.ObjectInfo{Size: -1}})
+	// The listing sets it once it starts, an error response has its own.
+	w.Header().Del("Content-Type")
+	if enc == "" {
+		return w, func() error { return nil }
+	}
+	cw := &compressResponseWriter{ResponseWriter: w, encoding: enc, head: r.Method == http.MethodHead}
+	return cw, cw.close
+}
+
+// jsonListWriter streams a listing as JSON, one entry at a time, so that
+// memory use does not grow with the size of the page. The response is
+// only started with the first entry, until then a failed listing can
+// still be reported with an error status.
+type jsonListWriter struct {
+	w       http.ResponseWriter
+	prefix  string
+	started bool
+	n       int
+}
+
+func (l *jsonListWriter) start() error {
+	if l.started {
+		return nil
+	}
+	l.started = true
+	prefix, err := json.Marshal(l.prefix)
+	if err != nil {
+		return err
+	}
+	l.w.Header().Set("Content-Type", "application/json")
+	_, err = fmt.Fprintf(l.w, `{"prefix":%s,"entries":[`, prefix)
+	return err
+}
+
+// entry writes e, it is the callback of walkPrefix.
+func (l *jsonListWriter) entry(e listingEntry) error {
+	if err := l.start(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if l.n > 0 {
+		b = append([]byte{','}, b...)
+	}
+	l.n++
+	_, err = l.w.Write(b)
+	return err
+}
+
+// finish ends the listing with the continuation of the next page.
+func (l *jsonListWriter) finish(continuation string) error {
+	if err := l.start(); err != nil {
+		return err
+	}
+	if continuation == "" {
+		_, err := io.WriteString(l.w, "]}\n")
+		return err
+	}
+	next, err := json.Marshal(continuation)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(l.w, `],"continuation":%s}`+"\n", next)
+	return err
+}
+
+// jsonDirList writes a page of the listing of the directory name as JSON,
+// entry by entry as S3 lists them unless they have to be sorted first. A
+// listing failing once the response has started aborts it, leaving the
+// client with truncated JSON rather than a listing silently missing
+// entries.
+func jsonDirList(w http.ResponseWriter, r *http.Request, s3 *S3, name string) {
+	prefix := listingPrefix(name)
+	lw, done := listingWriter(w, r, "application/json")
+	l := &jsonListWriter{w: lw, prefix: unprefixedKey(r.Context(), prefix)}
+	walk := walkPrefix
+	if !listingSort.sorted() {
+		walk = func(ctx context.Context, s3 *S3, prefix, continuation string, fn func(listingEntry) error) (string, error) {
+			result, err := listPrefix(ctx, s3, prefix, continuation)
+			if err != nil {
+				return "", err
+			}
+			for _, e := range result.Entries {
+				if err := fn(e); err != nil {
+					return "", err
+				}
+			}
+			return result.Continuation, nil
+		}
+	}
+	next, err := walk(r.Context(), s3, prefix, r.URL.Query().Get("continuation"), l.entry)
+	if err == nil {
+		err = l.finish(next)
+	}
+	if err == nil {
+		done()
+		return
+	}
+	if !l.started {
+		listError(w, r, s3, prefix, err)
+		return
+	}
+	logError("Unable to list", "prefix", prefix, "err", err)
+	panic(http.ErrAbortHandler)
+}
+
+// enableListing turns on the listings of directories without an index
+// document.
+var enableListing = true
+
+// listingNameWidth is the width of the name column of HTML listings,
+// longer names are truncated.
+const listingNameWidth = 50
+
+// listingRow formats e as a line of an HTML listing, its linked name
+// padded to the modified time and the size, or "-" for directories.
+func listingRow(e listingEntry) string {
+	name := e.Name
+	if e.IsDir {
+		name += pathSeparator
+	}
+	u := url.URL{Path: name}
+	shown := name
+	if utf8.RuneCountInString(shown) > listingNameWidth {
+		shown = string([]rune(shown)[:listingNameWidth-3]) + "..>"
+	}
+	pad := strings.Repeat(" ", listingNameWidth+1-utf8.RuneCountInString(shown))
+
+	modified, size := "-", "-"
+	if !e.LastModified.IsZero() {
+		modified = e.LastModified.UTC().Format("02-Jan-2006 15:04")
+	}
+	if !e.IsDir {
+		size = strconv.FormatInt(e.Size, 10)
+	}
+	return fmt.Sprintf("<a href=\"%s\">%s</a>%s%-17s %20s\n", u.String(), htmlReplacer.Replace(shown), pad, modified, size)
+}
+
+// dirList writes a page of the listing of the directory name as HTML,
+// with the size and modified time of every object. The continuations of
+// the pages before the current one are carried along as repeated prev
+// parameters, so that the prev link walks back one page at a time.
+func dirList(w http.ResponseWriter, r *http.Request, s3 *S3, name string) {
+	result, ok := listPage(w, r, s3, name)
+	if !ok {
+		return
+	}
+	w, done := listingWriter(w, r, "text/html; charset=utf-8")
+	defer done()
+
+	title := htmlReplacer.Replace("Index of /" + result.Prefix)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1><hr><pre>\n", title, title)
+	if result.Prefix != "" {
+		fmt.Fprintf(w, "<a href=\"../\">../</a>\n")
+	}
+	for _, e := range result.Entries {
+		io.WriteString(w, listingRow(e))
+	}
+	fmt.Fprintf(w, "</pre><hr>\n")
+
+	query := r.URL.Query()
+	current, stack := query.Get("continuation"), query["prev"]
+	if current != "" {
+		prev := url.Values{}
+		if n := len(stack); n > 0 {
+			prev.Set("continuation", stack[n-1])
+			prev["prev"] = stack[:n-1]
+		}
+		fmt.Fprintf(w, "<a href=\"?\">&laquo; first</a> <a href=\"?%s\">&lsaquo; prev</a>\n", htmlReplacer.Replace(prev.Encode()))
+	}
+	if result.Continuation != "" {
+		next := url.Values{}
+		next.Set("continuation", result.Continuation)
+		if current != "" {
+			next["prev"] = append(append([]string(nil), stack...), current)
+		}
+		fmt.Fprintf(w, "<a href=\"?%s\">next &rsaquo;</a>\n", htmlReplacer.Replace(next.Encode()))
+	}
+	fmt.Fprintf(w, "</body>\n</html>\n")
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var entryLink = regexp.MustCompile(`<a href="(f[^"]*)">`)
+
+var pageLink = regexp.MustCompile(`<a href="(\?[^"]*)">(?:&lsaquo; )?(prev|next)`)
+
+// followPage returns the body of the page of dir reached through the
+// prev or next link of body.
+func followPage(t *testing.T, s3 *S3, dir, body, rel string) string {
+	t.Helper()
+	for _, m := range pageLink.FindAllStringSubmatch(body, -1) {
+		if m[2] == rel {
+			return serve(s3, dir+html.UnescapeString(m[1])).Body.String()
+		}
+	}
+	t.Fatalf("no %s link in %q", rel, body)
+	return ""
+}
+
+// firstEntry returns the name of the first entry listed in body.
+func firstEntry(body string) string {
+	m := entryLink.FindStringSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+func TestDirListPrevWalksBack(t *testing.T) {
+	store := newFakeStore()
+	for i := 0; i < 35; i++ {
+		store.put(fmt.Sprintf("dir/f%02d.txt", i), "x")
+	}
+	setGlobal(t, &enableListing, true)
+	setGlobal(t, &listingPageSize, 10)
+	s3 := newTestS3(t, store)
+
+	pages := []string{serve(s3, "/dir/").Body.String()}
+	for i := 1; i < 4; i++ {
+		pages = append(pages, followPage(t, s3, "/dir/", pages[i-1], "next"))
+	}
+	for i, want := range []string{"f00.txt", "f10.txt", "f20.txt", "f30.txt"} {
+		if got := firstEntry(pages[i]); got != want {
+			t.Errorf("page %d starts with %q, want %q", i+1, got, want)
+		}
+	}
+	if strings.Contains(pages[3], "next &rsaquo;") {
+		t.Error("the last page links to a next page")
+	}
+
+	page := pages[3]
+	for i := 2; i >= 0; i-- {
+		page = followPage(t, s3, "/dir/", page, "prev")
+		if got, want := firstEntry(page), firstEntry(pages[i]); got != want {
+			t.Errorf("prev to page %d starts with %q, want %q", i+1, got, want)
+		}
+	}
+	if strings.Contains(page, "prev</a>") {
+		t.Error("the first page links to a previous page")
+	}
+}
+
+func TestDirListFetchesOnePage(t *testing.T) {
+	store := newFakeStore()
+	for i := 0; i < 5000; i++ {
+		store.put(fmt.Sprintf("dir/f%04d.txt", i), "x")
+	}
+	setGlobal(t, &enableListing, true)
+	setGlobal(t, &listingPageSize, 10)
+	s3 := newTestS3(t, store)
+
+	for _, target := range []string{"/dir/", "/dir/?format=json"} {
+		before := store.count(&store.listed)
+		w := serve(s3, target)
+		if w.Code != 200 {
+			t.Fatalf("%s: got status %d", target, w.Code)
+		}
+		// One entry past the page tells whether there is a next one,
+		// and telling the directory apart from an object takes another.
+		if listed := store.count(&store.listed) - before; listed > listingPageSize+2 {
+			t.Errorf("%s: listed %d entries for a page of %d", target, listed, listingPageSize)
+		}
+		n := len(entryLink.FindAllString(w.Body.String(), -1))
+		if strings.Contains(target, "json") {
+			n = strings.Count(w.Body.String(), `"name":`)
+		}
+		if n != listingPageSize {
+			t.Errorf("%s: got %d entries, want %d", target, n, listingPageSize)
+		}
+	}
+}
+
+// firstWriteRecorder records how many entries S3 had listed when the body
+// of the response was first written.
+type firstWriteRecorder struct {
+	*httptest.ResponseRecorder
+	store  *fakeStore
+	listed int
+}
+
+func (w *firstWriteRecorder) Write(p []byte) (int, error) {
+	if w.listed < 0 {
+		w.listed = w.store.count(&w.store.listed)
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestJSONListingStreams(t *testing.T) {
+	const keys = 100000
+	store := newFakeStore()
+	for i := 0; i < keys; i++ {
+		store.put(fmt.Sprintf("dir/f%06d", i), "")
+	}
+	setGlobal(t, &enableListing, true)
+	setGlobal(t, &listingPageSize, keys)
+	s3 := newTestS3(t, store)
+
+	w := &firstWriteRecorder{ResponseRecorder: httptest.NewRecorder(), store: store, listed: -1}
+	s3.ServeHTTP(w, httptest.NewRequest("GET", "/dir/?format=json", nil))
+	if w.Code != 200 {
+		t.Fatalf("got status %d", w.Code)
+	}
+	// Entries are written as S3 lists them rather than gathered first.
+	if w.listed > 10 {
+		t.Errorf("S3 had listed %d entries by the first write, want a handful", w.listed)
+	}
+	var page listing
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != keys {
+		t.Errorf("got %d entries, want %d", len(page.Entries), keys)
+	}
+}
+
+func TestListingCompression(t *testing.T) {
+	setupCompression(t, "gzip")
+	// A listing is compressed whatever its length.
+	setGlobal(t, &compressMinSize, 1<<20)
+	store := newFakeStore()
+	store.put("dir/a.txt", "a")
+	store.put("dir/b.txt", "b")
+	setGlobal(t, &enableListing, true)
+	s3 := withVary(newTestS3(t, store))
+
+	for _, tc := range []struct {
+		target, ctype, want string
+	}{
+		{"/dir/?format=json", "application/json", `"name":"b.txt"`},
+		{"/dir/", "text/html; charset=utf-8", `<a href="b.txt">`},
+	} {
+		w := serve(s3, tc.target, "Accept-Encoding", "gzip")
+		if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Type") != tc.ctype {
+			t.Errorf("%s: got status %d, Content-Encoding %q and Content-Type %q, want 200, gzip and %s",
+				tc.target, w.Code, w.Header().Get("Content-Encoding"), w.Header().Get("Content-Type"), tc.ctype)
+			continue
+		}
+		if !hasVary(w.Header(), "Accept-Encoding") {
+			t.Errorf("%s: got Vary %q, want Accept-Encoding", tc.target, varyNames(w.Header()))
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.target, err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.target, err)
+		}
+		if !strings.Contains(string(body), tc.want) {
+			t.Errorf("%s: got body %q, want it to hold %s", tc.target, body, tc.want)
+		}
+
+		w = serve(s3, tc.target)
+		if w.Header().Get("Content-Encoding") != "" || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%s without Accept-Encoding: got Content-Encoding %q and body %q", tc.target, w.Header().Get("Content-Encoding"), w.Body.String())
+		}
+	}
+
+	// Errors are not compressed.
+	if w := serve(s3, "/dir/?format=json&continuation=%21", "Accept-Encoding", "gzip"); w.Code != 400 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("invalid continuation: got status %d and Content-Encoding %q, want 400 uncompressed", w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
+
+var listedName = regexp.MustCompile(`<a href="([^".?][^"]*)">`)
+
+func TestListingSortAndHide(t *testing.T) {
+	store := newFakeStore()
+	for _, o := range []struct {
+		key  string
+		size int
+		age  time.Duration
+	}{
+		{"dir/b.txt", 30, 2 * time.Hour},
+		{"dir/a.txt", 10, time.Hour},
+		{"dir/c.txt", 20, 3 * time.Hour},
+		{"dir/sub/x.txt", 1, 0},
+		{"dir/.env", 5, 0},
+		{"dir/_redirects", 5, 0},
+		{"dir/404.html", 5, 0},
+	} {
+		store.put(o.key, strings.Repeat("x", o.size)).LastModified = fakeTime.Add(-o.age)
+	}
+	setGlobal(t, &enableListing, true)
+	hide, err := parseListingHide(".*, _redirects,404.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &listingHide, hide)
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		sort string
+		want string
+	}{
+		{"name", "a.txt b.txt c.txt sub"},
+		{"name:desc", "sub c.txt b.txt a.txt"},
+		// Directories come first unless sorting by name.
+		{"size", "sub a.txt c.txt b.txt"},
+		{"size:desc", "sub b.txt c.txt a.txt"},
+		{"modtime", "sub c.txt b.txt a.txt"},
+		{"modtime:desc", "sub a.txt b.txt c.txt"},
+	} {
+		order, err := parseListingSort(tc.sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setGlobal(t, &listingSort, order)
+
+		var page listing
+		if err := json.Unmarshal(serve(s3, "/dir/?format=json").Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s: %v", tc.sort, err)
+		}
+		var names []string
+		for _, e := range page.Entries {
+			names = append(names, e.Name)
+		}
+		if got := strings.Join(names, " "); got != tc.want {
+			t.Errorf("%s JSON: got %s, want %s", tc.sort, got, tc.want)
+		}
+
+		names = names[:0]
+		for _, m := range listedName.FindAllStringSubmatch(serve(s3, "/dir/").Body.String(), -1) {
+			names = append(names, strings.TrimSuffix(m[1], "/"))
+		}
+		if got := strings.Join(names, " "); got != tc.want {
+			t.Errorf("%s HTML: got %s, want %s", tc.sort, got, tc.want)
+		}
+	}
+
+	for _, invalid := range []string{"date", "size:up", "name:"} {
+		if _, err := parseListingSort(invalid); err == nil {
+			t.Errorf("accepted -listing-sort %q", invalid)
+		}
+	}
+	if _, err := parseListingHide("[a-"); err == nil {
+		t.Error("accepted an invalid -listing-hide pattern")
+	}
+}
+
+func TestJSONListingDirectoryModified(t *testing.T) {
+	store := newFakeStore()
+	store.put("dir/a.txt", "a")
+	store.put("dir/sub/b.txt", "b")
+	setGlobal(t, &enableListing, true)
+
+	body := serve(newTestS3(t, store), "/dir/?format=json").Body.Bytes()
+	var page struct {
+		Entries []map[string]interface{} `json:"entries"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 {
+		t.Fatalf("got entries %s, want a.txt and sub/", body)
+	}
+	if got, want := page.Entries[0]["lastModified"], fakeTime.Format(time.RFC3339); got != want {
+		t.Errorf("a.txt: got lastModified %v, want %s", got, want)
+	}
+	if got, ok := page.Entries[1]["lastModified"]; ok {
+		t.Errorf("sub/: got lastModified %v, want it left out", got)
+	}
+
+	// The listing still decodes into the entries it was made of.
+	var decoded listing
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Entries[0].LastModified.Equal(fakeTime) || !decoded.Entries[1].LastModified.IsZero() {
+		t.Errorf("decoded entries %+v", decoded.Entries)
+	}
+}
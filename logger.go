@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log line, lines below -log-level are
+// dropped.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// Formats of the log selected with -log-format.
+const (
+	// logFormatText is the time, the level, the message and its fields.
+	logFormatText = "text"
+	// logFormatLogfmt is a line of key=value pairs.
+	logFormatLogfmt = "logfmt"
+	// logFormatJSON is a JSON object per line.
+	logFormatJSON = "json"
+)
+
+// logger writes leveled lines with key/value fields in its format.
+type logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format string
+}
+
+// std is the logger of the process, set up by setupLogging.
+var std = &logger{out: os.Stderr, level: levelInfo, format: logFormatText}
+
+// parseLogLevel parses one of the level names.
+func parseLogLevel(name string) (logLevel, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		name = "warn"
+	}
+	for level, n := range levelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("log level %q must be 'debug', 'info', 'warn' or 'error'", name)
+}
+
+// setupLogging sets the level and format of std, and sends the lines of
+// the standard logger, such as fatal errors and those of net/http,
+// through it as errors.
+func setupLogging(level, format string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format = strings.ToLower(strings.TrimSpace(format)); format {
+	case logFormatText, logFormatLogfmt, logFormatJSON:
+	default:
+		return fmt.Errorf("log format %q must be 'text', 'logfmt' or 'json'", format)
+	}
+	std.mu.Lock()
+	std.level, std.format = l, format
+	std.mu.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+// stdLogWriter writes the lines of the standard logger as errors.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	std.log(levelError, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// enabled reports whether lines of level are written.
+func (l *logger) enabled(level logLevel) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return level >= l.level
+}
+
+// log writes msg at level with the fields kv, alternating keys and
+// values.
+func (l *logger) log(level logLevel, msg string, kv ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	now := time.Now()
+	var buf bytes.Buffer
+	switch l.format {
+	case logFormatJSON:
+		fields := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": levelNames[level],
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			fields[fmt.Sprint(kv[i])] = fieldValue(kv[i+1])
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			b = []byte(strconv.Quote(msg))
+		}
+		buf.Write(b)
+	case logFormatLogfmt:
+		fmt.Fprintf(&buf, "time=%s level=%s msg=%s", now.Format(time.RFC3339), levelNames[level], logfmtValue(msg))
+		writeFields(&buf, kv)
+	default:
+		fmt.Fprintf(&buf, "%s %s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(levelNames[level]), msg)
+		writeFields(&buf, kv)
+	}
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// writeFields writes kv as space separated key=value pairs.
+func writeFields(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(buf, " %s=%s", kv[i], logfmtValue(fmt.Sprint(fieldValue(kv[i+1]))))
+	}
+}
+
+// fieldValue returns v as logged, errors and durations as strings.
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration, fmt.Stringer:
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// logfmtValue quotes s when it is empty or holds spaces, quotes or '='.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func logDebug(msg string, kv ...interface{}) { std.log(levelDebug, msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { std.log(levelInfo, msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { std.log(levelWarn, msg, kv...) }
+func logError(msg string, kv ...interface{}) { std.log(levelError, msg, kv...) }
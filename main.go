@@ -2,21 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/caddyserver/certmagic"
 	minio "github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
-	"github.com/minio/minio-go/v7/pkg/s3utils"
 	"github.com/patrickmn/go-cache"
 )
 
@@ -27,141 +32,720 @@ import (
 // buckets, If you have any sensitive information please make
 // sure to not sure this project.
 type S3 struct {
-	*minio.Client
-	bucket string
-	cache  *cache.Cache
+	stats     cacheStats
+	Client    objectStore
+	bucket    string
+	cache     *cache.Cache // nil when directory caching is disabled
+	bodyCache *bodyCache
+	diskCache *diskCache
+	limiter   *fetchLimiter
+	analytics *prefixCounter
+	// infoCache briefly keeps the info of the objects opened, or
+	// missingObject for keys without one, nil when disabled.
+	infoCache *cache.Cache
+	// missingPages remembers the error page keys without an object,
+	// nil when the directory cache is disabled.
+	missingPages *cache.Cache
+	// missWebhook is notified of every object fetched from S3.
+	missWebhook *missNotifier
 }
 
-func pathIsDir(ctx context.Context, s3 *S3, name string) bool {
-	name = strings.Trim(name, pathSeparator) + pathSeparator
-	if name == pathSeparator {
-		return true
+// pathIsDir reports whether name is a directory, that is a prefix of
+// objects in the bucket. A failed listing is reported as an error and
+// never cached, it tells nothing about the prefix.
+func pathIsDir(ctx context.Context, s3 *S3, name string) (bool, error) {
+	name = cleanKey(name)
+	if name == "" {
+		return true, nil
 	}
+	name += pathSeparator
+	cached := s3.cache != nil && !bypassCache(name)
 
-	if boolIface, ok := s3.cache.Get(name); ok {
-		return boolIface.(bool)
+	ctx, sp := startSpan(ctx, "directory check", spanInternal)
+	defer sp.finish()
+	sp.set("s3www.prefix", name)
+
+	if cached {
+		if boolIface, ok := s3.cache.Get(name); ok {
+			sp.set("s3www.cache_hit", true)
+			s3.stats.hit()
+			return boolIface.(bool), nil
+		}
+		s3.stats.miss()
+	}
+
+	if err := s3.limiter.acquire(ctx); err != nil {
+		return false, err
 	}
+	defer s3.limiter.release(ctx)
 
-	var ret bool
 	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	var (
+		isDir bool
+		err   error
+		done  bool
+	)
 	objCh := s3.Client.ListObjects(listCtx,
 		s3.bucket,
 		minio.ListObjectsOptions{
 			Prefix: name,
 		})
-	for _ = range objCh {
+	for obj := range objCh {
+		// Keep draining the channel once cancelled, so that the
+		// listing goroutine exits.
+		if done {
+			continue
+		}
+		done = true
 		cancel()
-		ret = true
+		if obj.Err != nil {
+			err = obj.Err
+			continue
+		}
+		isDir = true
+	}
+	if err != nil {
+		if isAccessDenied(err) {
+			logWarn("Access denied listing", "path", name, "err", err)
+			return false, os.ErrPermission
+		}
+		logError("Unable to list", "path", name, "err", err)
+		return false, err
 	}
-	s3.cache.SetDefault(name, ret)
-	return ret
+	if cached {
+		s3.cache.SetDefault(name, isDir)
+	}
+	return isDir, nil
 }
 
-// Open - implements http.Filesystem implementation.
-func (s3 *S3) Open(name string) (http.File, error) {
-	if pathIsDir(context.Background(), s3, name) {
+func (s3 *S3) open(ctx context.Context, name string) (*httpMinioObject, error) {
+	if exactOnly {
+		return s3.openKeys(ctx, resolveKeys(cleanKey(name)))
+	}
+	isDir, err := pathIsDir(ctx, s3, name)
+	if err != nil {
+		return nil, err
+	}
+	if isDir {
 		return &httpMinioObject{
-			client: s3.Client,
-			object: nil,
 			isDir:  true,
-			bucket: bucket,
 			prefix: strings.TrimSuffix(name, pathSeparator),
 		}, nil
 	}
 
-	name = strings.TrimPrefix(name, pathSeparator)
-	obj, err := getObject(context.Background(), s3, name)
+	return s3.openKeys(ctx, resolveKeys(cleanKey(name)))
+}
+
+// openKeys opens the first of keys that exists in the bucket.
+func (s3 *S3) openKeys(ctx context.Context, keys []string) (*httpMinioObject, error) {
+	obj, err := getObject(ctx, s3, keys)
 	if err != nil {
-		return nil, os.ErrNotExist
+		return nil, err
 	}
 
+	info, _ := obj.Stat()
 	return &httpMinioObject{
-		client: s3.Client,
 		object: obj,
-		isDir:  false,
-		bucket: bucket,
-		prefix: name,
+		prefix: info.Key,
 	}, nil
 }
 
-func getObject(ctx context.Context, s3 *S3, name string) (*minio.Object, error) {
-	names := [4]string{name, name + "/index.html", name + "/index.htm", "/404.html"}
-	for _, n := range names {
-		obj, err := s3.Client.GetObject(ctx, s3.bucket, n, minio.GetObjectOptions{})
+// getObject returns the first of keys that exists. It returns
+// os.ErrNotExist when none of them exist, os.ErrPermission when S3
+// denies access and the last unexpected error otherwise.
+func getObject(ctx context.Context, s3 *S3, keys []string) (s3Object, error) {
+	var lastErr error
+	for _, n := range keys {
+		obj, err := fetchObject(ctx, s3, n)
 		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		_, err = obj.Stat()
-		if err != nil {
-			// do not log "file" in bucket not found errors
-			if minio.ToErrorResponse(err).Code != "NoSuchKey" {
-				log.Println(err)
+			if err == errTooBusy || err == errTooLarge {
+				return nil, err
+			}
+			if isAccessDenied(err) {
+				logWarn("Access denied reading", "key", n, "err", err)
+				return nil, os.ErrPermission
 			}
+			// Missing keys are expected while resolving a path.
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				logDebug("No such key", "key", n)
+				continue
+			}
+			logError("Unable to read", "key", n, "err", err)
+			lastErr = err
 			continue
 		}
 
 		return obj, nil
 	}
 
+	if lastErr != nil {
+		return nil, lastErr
+	}
 	return nil, os.ErrNotExist
 }
 
-var (
-	endpoint      string
-	accessKey     string
-	accessKeyFile string
-	secretKey     string
-	secretKeyFile string
-	address       string
-	bucket        string
-	tlsCert       string
-	tlsKey        string
-	cacheTime     string
-	letsEncrypt   bool
-)
+// bypassCache reports whether the object or directory name is always to
+// be fetched fresh from S3.
+func bypassCache(name string) bool {
+	return noCachePattern != nil && noCachePattern.MatchString(pathSeparator+name)
+}
 
-func init() {
-	flag.StringVar(&endpoint, "endpoint", defaultEnvString("S3WWW_ENDPOINT", ""), "S3 server endpoint")
-	flag.StringVar(&accessKey, "accessKey", defaultEnvString("S3WWW_ACCESS_KEY", ""), "Access key of S3 storage")
-	flag.StringVar(&accessKeyFile, "accessKeyFile", defaultEnvString("S3WWW_ACCESS_KEY_FILE", ""), "File which contains the access key")
-	flag.StringVar(&secretKey, "secretKey", defaultEnvString("S3WWW_SECRET_KEY", ""), "Secret key of S3 storage")
-	flag.StringVar(&secretKeyFile, "secretKeyFile", defaultEnvString("S3WWW_SECRET_KEY_FILE", ""), "File which contains the Secret key")
-	flag.StringVar(&bucket, "bucket", defaultEnvString("S3WWW_BUCKET", ""), "Bucket name which hosts static files")
-	flag.StringVar(&address, "address", defaultEnvString("S3WWW_ADDRESS", "127.0.0.1:8080"), "Bind to a specific ADDRESS:PORT, ADDRESS can be an IP or hostname")
-	flag.StringVar(&tlsCert, "ssl-cert", defaultEnvString("S3WWW_SSL_CERT", ""), "TLS certificate for this server")
-	flag.StringVar(&tlsKey, "ssl-key", defaultEnvString("S3WWW_SSL_KEY", ""), "TLS private key for this server")
-	flag.StringVar(&cacheTime, "cache-time", defaultEnvString("S3WWW_CACHE_TIME", "5m"), "Time to keep cache about directory listings")
-	flag.BoolVar(&letsEncrypt, "lets-encrypt", defaultEnvBool("S3WWW_LETS_ENCRYPT", false), "Enable Let's Encrypt")
+// fetchObject returns the object stored under key, going through the
+// body and disk caches when configured, unless it matches -no-cache-pattern.
+func fetchObject(ctx context.Context, s3 *S3, key string) (s3Object, error) {
+	if bypassCache(key) {
+		return openObject(ctx, s3, key)
+	}
+	if s3.bodyCache != nil {
+		return s3.bodyCache.get(ctx, s3, key, fetchUncachedObject)
+	}
+	return fetchUncachedObject(ctx, s3, key)
+}
+
+// fetchUncachedObject returns the object stored under key, bypassing the
+// body cache.
+func fetchUncachedObject(ctx context.Context, s3 *S3, key string) (s3Object, error) {
+	if s3.diskCache != nil {
+		return s3.diskCache.get(ctx, s3, key)
+	}
+	return openObject(ctx, s3, key)
 }
 
-func defaultEnvString(key string, defaultVal string) string {
-	if val, ok := os.LookupEnv(key); ok {
-		return val
+// statObject returns the info of the object stored under key in S3.
+func statObject(ctx context.Context, s3 *S3, key string) (minio.ObjectInfo, error) {
+	if err := s3.limiter.acquire(ctx); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	defer s3.limiter.release(ctx)
+	return s3.Client.StatObject(ctx, s3.bucket, key, minio.StatObjectOptions{})
+}
+
+// errTooLarge is returned for objects larger than -max-object-size.
+var errTooLarge = errors.New("object larger than the maximum object size")
+
+// missingObject is cached in the info cache for keys with no object.
+type missingObject struct{}
+
+// knownObject is an object whose info was cached, it is only read if its
+// ETag still matches so that the cached info describes its body. When
+// the object changed since, S3 fails the first read or seek with 412
+// Precondition Failed and the object is fetched again with reopen.
+type knownObject struct {
+	s3Object
+	info   minio.ObjectInfo
+	reopen func() (s3Object, minio.ObjectInfo, error)
+}
+
+func (k *knownObject) Stat() (minio.ObjectInfo, error) {
+	return k.info, nil
+}
+
+func (k *knownObject) Read(p []byte) (int, error) {
+	n, err := k.s3Object.Read(p)
+	if k.changed(err) {
+		if err = k.refetch(); err == nil {
+			return k.s3Object.Read(p)
+		}
 	}
-	return defaultVal
+	return n, err
 }
 
-func defaultEnvBool(key string, defaultVal bool) bool {
-	if val, ok := os.LookupEnv(key); ok {
-		parsedVal, err := strconv.ParseBool(val)
+func (k *knownObject) Seek(offset int64, whence int) (int64, error) {
+	n, err := k.s3Object.Seek(offset, whence)
+	if k.changed(err) {
+		if err = k.refetch(); err == nil {
+			return k.s3Object.Seek(offset, whence)
+		}
+	}
+	return n, err
+}
+
+// changed reports whether err is the object no longer matching the
+// cached info. S3 only checks the ETag when the body is first requested,
+// so the object is still at its start and the failed call can be made
+// again once it is fetched anew.
+func (k *knownObject) changed(err error) bool {
+	return err != nil && k.reopen != nil && minio.ToErrorResponse(err).Code == "PreconditionFailed"
+}
+
+// refetch replaces the stale object by the current one, once.
+func (k *knownObject) refetch() error {
+	reopen := k.reopen
+	k.reopen = nil
+	obj, info, err := reopen()
+	if err != nil {
+		return err
+	}
+	k.s3Object.Close()
+	k.s3Object, k.info = obj, info
+	return nil
+}
+
+// openObject opens the object stored under key in S3. Its info is
+// retrieved right away so that a missing object is reported here rather
+// than on the first read, and objects over maxObjectSize are refused
+// before any of their body is read. The info, or the absence of the
+// object, is kept in the info cache so that lookups made shortly after,
+// such as for the candidates of the index fallback, need no request to
+// S3 until the body is read, when an object changed in the meantime is
+// fetched again.
+func openObject(ctx context.Context, s3 *S3, key string) (s3Object, error) {
+	infoCache := s3.infoCache
+	if bypassCache(key) {
+		infoCache = nil
+	}
+	if infoCache != nil {
+		if v, ok := infoCache.Get(key); ok {
+			info, found := v.(minio.ObjectInfo)
+			if !found {
+				return nil, minio.ErrorResponse{Code: "NoSuchKey", StatusCode: http.StatusNotFound, Key: key}
+			}
+			if maxObjectSize > 0 && info.Size > maxObjectSize {
+				return nil, errTooLarge
+			}
+			if err := s3.limiter.acquire(ctx); err != nil {
+				return nil, err
+			}
+			opts := minio.GetObjectOptions{}
+			opts.SetMatchETag(info.ETag)
+			obj, err := s3.Client.GetObject(ctx, s3.bucket, key, opts)
+			s3.missWebhook.notify(key, err)
+			if err != nil {
+				s3.limiter.release(ctx)
+				return nil, err
+			}
+			known := &knownObject{s3Object: obj, info: info}
+			known.reopen = func() (s3Object, minio.ObjectInfo, error) {
+				// The slot held by the stale object is reused.
+				infoCache.Delete(key)
+				obj, err := s3.Client.GetObject(ctx, s3.bucket, key, minio.GetObjectOptions{})
+				if err != nil {
+					return nil, minio.ObjectInfo{}, err
+				}
+				info, err := statOpened(infoCache, key, obj)
+				if err != nil {
+					obj.Close()
+					return nil, minio.ObjectInfo{}, err
+				}
+				return obj, info, nil
+			}
+			// The slot is held until the body is read and closed.
+			return s3.limiter.holdSlot(ctx, known), nil
+		}
+	}
+
+	if err := s3.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	obj, err := s3.Client.GetObject(ctx, s3.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		s3.limiter.release(ctx)
+		s3.missWebhook.notify(key, err)
+		return nil, err
+	}
+	// The slot is held until the body is read and closed.
+	obj = s3.limiter.holdSlot(ctx, obj)
+	_, err = statOpened(infoCache, key, obj)
+	s3.missWebhook.notify(key, err)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+// statOpened returns the info of obj, just opened from key, keeping it
+// or the absence of the object in infoCache when set, and failing with
+// errTooLarge for objects over maxObjectSize.
+func statOpened(infoCache *cache.Cache, key string, obj s3Object) (minio.ObjectInfo, error) {
+	info, err := obj.Stat()
+	if infoCache != nil {
 		if err == nil {
-			return parsedVal
+			infoCache.SetDefault(key, info)
+		} else if isNotFound(err) {
+			infoCache.SetDefault(key, missingObject{})
 		}
-		log.Printf("String of %q did not parse as bool for env var %q", val, key)
 	}
-	return defaultVal
+	if err == nil && maxObjectSize > 0 && info.Size > maxObjectSize {
+		err = errTooLarge
+	}
+	return info, err
+}
+
+// isAccessDenied reports whether err is S3 refusing access to an object,
+// as opposed to the object not existing.
+func isAccessDenied(err error) bool {
+	errResp := minio.ToErrorResponse(err)
+	return errResp.Code == "AccessDenied" || errResp.StatusCode == http.StatusForbidden
+}
+
+var (
+	configFile     string
+	endpoint       string
+	providerName   string
+	accessKey      string
+	accessKeyFile  string
+	secretKey      string
+	secretKeyFile  string
+	allowAnonymous bool
+	addresses      = addressesFlag{addrs: []string{"127.0.0.1:8080"}}
+	bucket         string
+	tlsCert        string
+	tlsKey         string
+	cacheTime      string
+	noCache        bool
+	infoCacheTime  string
+	cacheCleanup   string
+	letsEncrypt    bool
+
+	requestIDHeader string
+	trustRequestID  bool
+	serverHeader    optionalString
+	disableHTTP2    bool
+	enableHTTP3     bool
+
+	warmupFile        string
+	warmupConcurrency int
+	warmupTimeout     string
+
+	errorPages          = errorPagesFlag{http.StatusNotFound: "404.html"}
+	useDefaultErrorPage = true
+	nestedErrorPages    bool
+
+	downloadTypesList     string
+	downloadTypes         map[string]bool
+	exposeMetaList        string
+	defaultContentType    string
+	precompressedList     string
+	immutableExpr         string
+	noCacheExpr           string
+	noCachePattern        *regexp.Regexp
+	immutablePattern      *regexp.Regexp
+	cacheControls         cacheControlsFlag
+	headers               headersFlag
+	secureHeaders         bool
+	contentSecurityPolicy string
+	precompressed         []string
+	maxObjectSizeValue    string
+
+	corsOrigins       string
+	corsMethods       string
+	corsHeaders       string
+	corsExposeHeaders string
+	corsCredentials   bool
+	corsMaxAgeValue   string
+
+	compressMinSizeValue string
+	compressTypesList    string
+	compressList         string
+	compressLevelList    string
+	maxObjectSize        int64
+	exposeMeta           []string
+
+	statusPath  string
+	statusToken string
+
+	authURL       string
+	authTimeout   string
+	authUser      string
+	authPass      string
+	authUsersFile string
+	authRealm     string
+
+	jwtSecret    string
+	jwtPublicKey string
+	jwtJWKSURL   string
+	jwtCookie    string
+	jwtIssuer    string
+	jwtAudience  string
+	jwtClaims    claimRulesFlag
+
+	oidcIssuer       string
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string
+	oidcCookieSecret string
+	oidcScopes       string
+	oidcSessionTTL   string
+	oidcEmailDomains string
+	oidcGroups       string
+	oidcGroupsClaim  string
+
+	shareSecret   string
+	shareTokenTTL string
+
+	allowCIDRs     cidrsFlag
+	denyCIDRs      cidrsFlag
+	trustedProxies cidrsFlag
+	rateLimit      float64
+	rateBurst      int
+
+	urlSigningSecret string
+	signedPaths      string
+	signURLPath      string
+	signURLTTL       string
+
+	diskCacheDir  string
+	diskCacheSize string
+	diskCacheTTL  string
+
+	maxConcurrentFetches int
+	fetchQueueTimeout    string
+
+	redirects redirectsFlag
+	rewrites  rewritesFlag
+
+	checkOnly   bool
+	showVersion bool
+
+	startupTimeout string
+	startupProbe   string
+	readyPath      string
+	adminAddress   string
+
+	shutdownTimeoutValue string
+
+	readTimeoutValue       string
+	readHeaderTimeoutValue string
+	writeTimeoutValue      string
+	idleTimeoutValue       string
+
+	metricsAddress string
+
+	otlpEndpoint     string
+	traceServiceName string
+	traceSampleRatio float64
+
+	resolveOrderList string
+	indexList        string
+
+	listingSortValue string
+	listingHideList  string
+
+	archiveObject        string
+	archiveCheckInterval string
+	spa                  bool
+	exactOnly            bool
+	canonicalPaths       bool
+
+	caCert             string
+	insecureSkipVerify bool
+	clientCA           string
+	requireClientCert  bool
+	ocspStapling       bool
+	ticketRotationTime string
+	ticketRotation     time.Duration
+
+	defaultRobots  string
+	icons          = iconsFlag{}
+	noContentIcons bool
+
+	bodyCacheSize      string
+	cacheTTLList       string
+	bodyCacheMaxObject string
+	revalidate         bool
+
+	serveStale   bool
+	maxStaleTime string
+
+	analytics         bool
+	analyticsPrefixes int
+
+	missWebhookURL     string
+	missWebhookTimeout string
+	missWebhookPending int
+
+	logLevelName string
+	logFormat    string
+
+	accessLogFile   string
+	accessLogFormat string
+	// accessLog is the access log file, reopened on SIGUSR1 and SIGHUP.
+	accessLog *reopenableFile
+)
+
+func init() {
+	flag.StringVar(&configFile, "config", "", "YAML or TOML file of settings named like the flags, overridden by flags and env vars")
+	flag.StringVar(&endpoint, "endpoint", "", "S3 server endpoint, https is assumed when it has no scheme, defaults to the endpoint of -provider")
+	flag.StringVar(&providerName, "provider", "s3", "Storage provider, 's3' for any S3 compatible endpoint or 'gcs' for Google Cloud Storage with HMAC keys")
+	flag.StringVar(&accessKey, "accessKey", "", "Access key of S3 storage")
+	flag.StringVar(&accessKeyFile, "accessKeyFile", "", "File which contains the access key")
+	flag.StringVar(&secretKey, "secretKey", "", "Secret key of S3 storage")
+	flag.StringVar(&secretKeyFile, "secretKeyFile", "", "File which contains the Secret key")
+	flag.BoolVar(&allowAnonymous, "allow-anonymous", false, "Access the bucket anonymously when no credentials are found, for public buckets")
+	flag.StringVar(&bucket, "bucket", "", "Bucket name which hosts static files")
+	flag.Var(&addresses, "address", "Bind to a specific ADDRESS:PORT, ADDRESS can be an IP or hostname, may be repeated to listen on several addresses")
+	flag.StringVar(&tlsCert, "ssl-cert", "", "TLS certificate for this server")
+	flag.StringVar(&tlsKey, "ssl-key", "", "TLS private key for this server")
+	flag.StringVar(&cacheTime, "cache-time", "5m", "Time to keep cache about directory listings, 0 disables the cache")
+	flag.StringVar(&cacheCleanup, "cache-cleanup-interval", "", "How often expired directory cache entries are removed, defaults to -cache-time up to 10m")
+	flag.StringVar(&infoCacheTime, "info-cache-time", "5s", "Time to keep the info of objects, or that they do not exist, 0 disables it")
+	flag.BoolVar(&noCache, "no-cache", false, "Disable the directory cache, every lookup goes to S3")
+	flag.BoolVar(&letsEncrypt, "lets-encrypt", false, "Enable Let's Encrypt")
+	flag.StringVar(&requestIDHeader, "request-id-header", "X-Request-ID", "Header used to read and echo the request ID")
+	flag.BoolVar(&trustRequestID, "trust-request-id", true, "Honor a valid inbound request ID instead of always generating one")
+	flag.BoolVar(&disableHTTP2, "disable-http2", false, "Only offer HTTP/1.1 when serving TLS")
+	flag.BoolVar(&enableHTTP3, "http3", false, "Also serve HTTP/3 (QUIC) when serving TLS with -ssl-cert and -ssl-key, requires a binary built with '-tags http3'")
+	flag.StringVar(&warmupFile, "warmup-file", "", "Object listing paths, one per line, to prime the cache with at startup")
+	flag.IntVar(&warmupConcurrency, "warmup-concurrency", 8, "Maximum number of concurrent lookups while warming up")
+	flag.StringVar(&warmupTimeout, "warmup-timeout", "30s", "Time allowed for warming up before accepting traffic")
+	flag.Var(&errorPages, "error-page", "Object served for a HTTP status code as STATUS=OBJECT, may be repeated")
+	flag.BoolVar(&useDefaultErrorPage, "default-error-page", useDefaultErrorPage, "Serve a built-in HTML error page when the bucket has none for a status code, plain text otherwise")
+	flag.BoolVar(&nestedErrorPages, "nested-error-pages", false, "Serve the error page of the same name nearest to the requested path, e.g. docs/404.html under /docs/, before the configured one")
+	flag.StringVar(&maxObjectSizeValue, "max-object-size", "0", "Largest object served, larger ones are refused with 413, 0 means unlimited")
+	flag.BoolVar(&compress, "compress", false, "Compress responses on the fly for clients accepting it, unless the object is stored compressed")
+	flag.StringVar(&compressMinSizeValue, "compress-min-size", "1KiB", "Size of the smallest object compressed with -compress")
+	flag.StringVar(&compressTypesList, "compress-types", strings.Join(compressTypes, ","), "Comma separated media types compressed with -compress, 'text/*' matches every text type")
+	flag.StringVar(&compressList, "compress-encodings", "br,zstd,gzip", "Comma separated content encodings applied with -compress, in order of preference, from 'br', 'zstd' and 'gzip'")
+	flag.StringVar(&compressLevelList, "compress-level", "", "Comma separated levels of the -compress-encodings as ENCODING=LEVEL, e.g. 'br=5,gzip=9,zstd=6'")
+	flag.StringVar(&noCacheExpr, "no-cache-pattern", "", "Regular expression of paths always fetched fresh from S3, bypassing every cache, e.g. '^/status\\.json$'")
+	flag.Var(&cacheControls, "cache-control", "Cache-Control of request paths as PATTERN=VALUE where '*' matches any characters, or PATTERN is a regular expression after '~', e.g. '/assets/*=max-age=31536000, immutable', may be repeated, the first matching rule wins")
+	flag.StringVar(&immutableExpr, "immutable-pattern", "", "Regular expression of paths cached forever as immutable, overriding -cache-control, e.g. '\\.[0-9a-f]{6,}\\.(js|css)$'")
+	flag.StringVar(&precompressedList, "precompressed", "", "Comma separated encodings of precompressed siblings, e.g. 'br,gzip' serves app.js.br or app.js.gz for app.js, in order of preference")
+	flag.StringVar(&defaultContentType, "default-content-type", "", "Content-Type of objects without an extension stored without a usable one, e.g. 'text/html; charset=utf-8'")
+	flag.StringVar(&exposeMetaList, "expose-meta", "", "Comma separated user metadata keys sent as X-Amz-Meta-* headers, e.g. 'version,commit'")
+	flag.StringVar(&downloadTypesList, "download-types", "", "Comma separated file extensions always sent as attachments, e.g. 'pdf,zip'")
+	flag.StringVar(&statusPath, "status-path", "", "Path serving runtime statistics as JSON, e.g. '/_status', requires -status-token")
+	flag.StringVar(&statusToken, "status-token", "", "Bearer token required to access the status path")
+	flag.StringVar(&authURL, "auth-url", "", "URL of a service authorizing every request, which may restrict it to a key prefix with X-Auth-Prefix or redirect it with X-Auth-Redirect")
+	flag.StringVar(&authTimeout, "auth-timeout", "5s", "Timeout of the -auth-url requests")
+	flag.StringVar(&authUser, "auth-user", "", "User allowed in with HTTP Basic authentication, along with -auth-pass")
+	flag.StringVar(&authPass, "auth-pass", "", "Password of -auth-user")
+	flag.StringVar(&authUsersFile, "auth-users-file", "", "htpasswd file of the users allowed in with HTTP Basic authentication, with bcrypt or SHA hashes")
+	flag.StringVar(&authRealm, "auth-realm", "s3www", "Realm of the HTTP Basic authentication")
+	flag.StringVar(&jwtSecret, "jwt-secret", "", "Secret of the HS256 JSON Web Tokens every request must bear")
+	flag.StringVar(&jwtPublicKey, "jwt-public-key", "", "PEM file of the RSA public key of the RS256 JSON Web Tokens every request must bear")
+	flag.StringVar(&jwtJWKSURL, "jwt-jwks-url", "", "URL of the JWKS holding the RSA public keys of the RS256 JSON Web Tokens every request must bear")
+	flag.StringVar(&jwtCookie, "jwt-cookie", "", "Cookie holding the JSON Web Token of requests without an Authorization: Bearer header")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", "", "Issuer the JSON Web Tokens must have been issued by, in their 'iss' claim")
+	flag.StringVar(&jwtAudience, "jwt-audience", "", "Audience the JSON Web Tokens must have been issued for, in their 'aud' claim")
+	flag.Var(&jwtClaims, "jwt-claim", "Claim required in JSON Web Tokens as NAME=VALUE, a list claim must hold VALUE, NAME may be a dotted path such as 'realm_access.roles', may be repeated, the values of a same claim are alternatives")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "Issuer URL of the OpenID Connect provider users log in with before being served, e.g. 'https://accounts.google.com'")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "Client ID registered at the -oidc-issuer")
+	flag.StringVar(&oidcClientSecret, "oidc-client-secret", "", "Client secret registered at the -oidc-issuer")
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "Callback URL registered at the -oidc-issuer, e.g. 'https://docs.example.com/oauth2/callback', its path is handled by s3www")
+	flag.StringVar(&oidcCookieSecret, "oidc-cookie-secret", "", "Secret the OIDC session cookies are encrypted with, keep it across restarts to keep users logged in")
+	flag.StringVar(&oidcScopes, "oidc-scopes", "openid,email,profile", "Comma separated scopes requested at the -oidc-issuer")
+	flag.StringVar(&oidcSessionTTL, "oidc-session-ttl", "12h", "How long users stay logged in")
+	flag.StringVar(&oidcEmailDomains, "oidc-email-domains", "", "Comma separated email domains allowed to log in, e.g. 'example.com'")
+	flag.StringVar(&oidcGroups, "oidc-groups", "", "Comma separated groups allowed to log in, as listed in the -oidc-groups-claim of the ID token")
+	flag.StringVar(&oidcGroupsClaim, "oidc-groups-claim", "groups", "Claim of the ID token listing the groups of the user")
+	flag.StringVar(&shareSecret, "share-secret", "", "Secret signing share tokens, when set only requests with a valid share token are served")
+	flag.StringVar(&shareTokenTTL, "share-token", "", "Print the query string of a share link valid for this long, e.g. '72h', signed with -share-secret, and exit")
+	flag.Var(&allowCIDRs, "allow-cidr", "Comma separated IP addresses or CIDR ranges of the only clients served, e.g. '10.8.0.0/16', may be repeated")
+	flag.Var(&denyCIDRs, "deny-cidr", "Comma separated IP addresses or CIDR ranges of clients refused, taking precedence over -allow-cidr, may be repeated")
+	flag.Var(&trustedProxies, "trusted-proxies", "Comma separated IP addresses or CIDR ranges of the proxies whose X-Forwarded-For header tells the address of the client, may be repeated")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "Requests per second allowed to each client, told apart by address as with -trusted-proxies, 0 for no limit")
+	flag.IntVar(&rateBurst, "rate-burst", 50, "Requests each client may make at once above -rate-limit, such as the assets of a page")
+	flag.StringVar(&urlSigningSecret, "url-signing-secret", "", "Secret signing URLs, when set only requests for -signed-paths with a valid ?expires=&sig= signature of their path are served")
+	flag.StringVar(&signedPaths, "signed-paths", "", "Pattern of the paths requiring a signed URL as in -cache-control, e.g. '/private/*', every path when empty")
+	flag.StringVar(&signURLPath, "sign-url", "", "Print a URL of this path signed with -url-signing-secret, valid for -sign-url-ttl, and exit")
+	flag.StringVar(&signURLTTL, "sign-url-ttl", "24h", "How long the URL printed by -sign-url is valid")
+	flag.StringVar(&diskCacheDir, "disk-cache-dir", "", "Directory used to cache objects on local disk, disabled when empty")
+	flag.StringVar(&diskCacheSize, "disk-cache-size", "1GiB", "Maximum size of the disk cache")
+	flag.StringVar(&diskCacheTTL, "disk-cache-ttl", "1h", "Time after which objects in the disk cache are revalidated against S3")
+	flag.IntVar(&maxConnections, "max-connections", 0, "Maximum number of connections accepted at once on each address, further ones wait, 0 means unlimited")
+	flag.IntVar(&maxConcurrentFetches, "max-concurrent-fetches", 0, "Maximum number of client requests fetching from S3 at once, bodies included, 0 means unlimited")
+	flag.StringVar(&fetchQueueTimeout, "fetch-queue-timeout", "5s", "Time a request waits for a free S3 request slot before failing with 503")
+	flag.Var(&redirects, "redirect", "Redirect rule as FROM=TO[:STATUS] where '*' matches any characters, e.g. '/old/*=/new/*:302', may be repeated")
+	flag.Var(&rewrites, "rewrite", "Rewrite of request paths to bucket keys as FROM=TO where FROM is a regular expression and TO may use its groups, e.g. '^/blog/(.+)$=/content/blog/$1.md', may be repeated")
+	flag.StringVar(&startupTimeout, "startup-timeout", "0", "Time allowed for S3 to answer successfully before listening, retrying meanwhile, 0 listens right away")
+	flag.StringVar(&startupProbe, "startup-probe", "", "Object whose existence is checked by the startup probe, the bucket itself when empty")
+	flag.StringVar(&readyPath, "ready-path", "", "Path answering 200 once S3 answered successfully and 503 until then, e.g. '/_ready'")
+	flag.StringVar(&adminAddress, "admin-address", "", "Serve /healthz and /readyz on this separate address, e.g. '127.0.0.1:8081', for Kubernetes probes and load balancers")
+	flag.StringVar(&shutdownTimeoutValue, "shutdown-timeout", "10s", "How long in-flight requests may take to complete on SIGTERM or SIGINT before their connections are closed")
+	flag.StringVar(&readTimeoutValue, "read-timeout", readTimeout.String(), "Time allowed to read a whole request, 0 for none")
+	flag.StringVar(&readHeaderTimeoutValue, "read-header-timeout", readHeaderTimeout.String(), "Time allowed to read the headers of a request, 0 for none")
+	flag.StringVar(&writeTimeoutValue, "write-timeout", "0", "Time allowed to write a whole response, 0 for none so that large objects can be downloaded on slow links")
+	flag.StringVar(&idleTimeoutValue, "idle-timeout", idleTimeout.String(), "Time a keep-alive connection may wait for its next request, 0 for none")
+	flag.BoolVar(&checkOnly, "check", false, "Validate the configuration and connectivity to the bucket, then exit")
+	flag.BoolVar(&showVersion, "version", false, "Print the version and exit")
+	flag.BoolVar(&enableListing, "enable-listing", enableListing, "List the objects of directories without an index document, pass -enable-listing=false to answer 404 instead")
+	flag.IntVar(&listingPageSize, "listing-page-size", listingPageSize, "Number of entries per directory listing page")
+	flag.StringVar(&listingSortValue, "listing-sort", "name", "Order of the entries of each listing page as FIELD[:asc|:desc], FIELD is 'name', 'size' or 'modtime'")
+	flag.StringVar(&listingHideList, "listing-hide", "", "Comma separated glob patterns of the names left out of listings, e.g. '.*,_redirects,404.html'")
+	flag.StringVar(&indexList, "index", strings.Join(indexDocuments, ","), "Ordered, comma separated names of the index documents served for a directory, e.g. 'index.html,default.htm,README.html'")
+	flag.StringVar(&resolveOrderList, "resolve-order", "exact,index", "Ordered, comma separated lookup stages mapping a path to an object, from 'exact', 'html', 'index' and 'spa'")
+	flag.BoolVar(&spa, "spa", false, "Serve the root 200.html or index.html for paths without an object, for single page applications, same as adding 'spa' to -resolve-order")
+	flag.BoolVar(&canonicalPaths, "canonical-paths", false, "Redirect paths with repeated slashes or '.' segments to their canonical form and refuse '..' segments")
+	flag.BoolVar(&exactOnly, "exact-only", false, "Map every path to exactly one object, without directory, index or error page lookups, for asset buckets")
+	flag.StringVar(&archiveObject, "archive-object", "", "Serve the files of this .zip, .tar or .tar.gz object of the bucket instead of the objects of the bucket, e.g. 'site.zip'")
+	flag.StringVar(&archiveCheckInterval, "archive-check-interval", "30s", "How often the -archive-object is checked for a new version")
+	flag.StringVar(&caCert, "ca-cert", "", "PEM file of additional CAs trusted when connecting to the S3 endpoint")
+	flag.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Do not verify the S3 endpoint certificate, DANGEROUS, for testing only")
+	flag.StringVar(&clientCA, "client-ca", "", "PEM file, or object in the bucket, of the CAs verifying client certificates")
+	flag.BoolVar(&requireClientCert, "require-client-cert", false, "Reject TLS clients without a certificate signed by -client-ca")
+	flag.BoolVar(&ocspStapling, "ocsp-stapling", false, "Staple the OCSP response of the TLS certificate, refreshed before it expires")
+	flag.StringVar(&ticketRotationTime, "session-ticket-rotation", "0", "Interval at which TLS session ticket keys are rotated, 0 keeps the Go defaults")
+	flag.Var(icons, "icon", "Object served for an icon path as PATH=OBJECT, e.g. '/favicon.ico=assets/favicon.ico', may be repeated")
+	flag.BoolVar(&noContentIcons, "no-content-icons", false, "Answer 204 No Content for favicon.ico and apple-touch-icon*.png missing from the bucket")
+	flag.StringVar(&defaultRobots, "default-robots", "", "robots.txt served when the bucket has none, 'allow', 'disallow' or the content itself")
+	flag.StringVar(&bodyCacheSize, "body-cache-size", "0", "Maximum size of the in-memory cache of object bodies, 0 disables it")
+	flag.StringVar(&cacheTTLList, "cache-ttl", "", "Comma separated TTLs of the body cache by media type or extension as MATCH=TTL, e.g. 'text/html=30s,image/*=24h,.woff2=168h', others use -cache-time, 0 does not cache them")
+	flag.StringVar(&bodyCacheMaxObject, "body-cache-max-object", "1MiB", "Largest object kept in the in-memory body cache")
+	flag.BoolVar(&revalidate, "revalidate", true, "Revalidate expired bodies by ETag instead of downloading them again")
+	flag.BoolVar(&xCacheHeader, "x-cache-header", false, "Send an X-Cache header telling whether the body was a cache HIT, MISS, REVALIDATED or STALE")
+	flag.BoolVar(&serveStale, "serve-stale", false, "Serve expired cached bodies, with a Warning header, while S3 is failing")
+	flag.StringVar(&maxStaleTime, "max-stale", "1h", "How long past their expiry cached bodies may be served with -serve-stale")
+	flag.StringVar(&missWebhookURL, "miss-webhook", "", "URL notified with a JSON POST of every object fetched from S3 rather than from a cache")
+	flag.StringVar(&missWebhookTimeout, "miss-webhook-timeout", "5s", "Timeout of the -miss-webhook requests")
+	flag.IntVar(&missWebhookPending, "miss-webhook-pending", 64, "Maximum number of outstanding -miss-webhook requests, further events are dropped")
+	flag.StringVar(&logLevelName, "log-level", "info", "Lowest level of the lines logged, 'debug', 'info', 'warn' or 'error', debug logs every request sent to S3")
+	flag.StringVar(&logFormat, "log-format", logFormatText, "Format of the log, 'text', 'logfmt' or 'json'")
+	flag.StringVar(&accessLogFile, "access-log-file", "", "File the access log is appended to, '-' for stdout, reopened on SIGUSR1 or SIGHUP")
+	flag.StringVar(&accessLogFormat, "access-log-format", accessLogCombined, "Format of the access log, 'common', 'combined' or 'json'")
+	flag.BoolVar(&accessLogClientCN, "access-log-client-cn", false, "Log the common name of verified client certificates, as the user of requests that did not authenticate otherwise")
+	flag.StringVar(&metricsAddress, "metrics-address", "", "Serve Prometheus metrics as /metrics on this separate address, e.g. '127.0.0.1:9100'")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector traces are exported to as JSON, e.g. 'http://127.0.0.1:4318'")
+	flag.StringVar(&traceServiceName, "trace-service-name", "s3www", "Service name of the exported traces")
+	flag.Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "Ratio of the traces started by s3www that are sampled, requests carrying a traceparent header follow its sampling decision")
+	flag.BoolVar(&analytics, "analytics", false, "Count requests by top-level path prefix, reported by the status endpoint")
+	flag.IntVar(&analyticsPrefixes, "analytics-prefixes", 100, "Maximum number of top-level prefixes counted with -analytics")
+	flag.Var(&headers, "header", "Header set on every response as NAME: VALUE, or on the responses to request paths matching PATTERN as PATTERN=NAME: VALUE with PATTERN as in -cache-control, e.g. 'X-Frame-Options: DENY', an empty VALUE strips the header, may be repeated")
+	flag.BoolVar(&secureHeaders, "secure-headers", false, "Send Strict-Transport-Security, X-Content-Type-Options, Referrer-Policy and Content-Security-Policy headers with secure defaults, each can be overridden with -header")
+	flag.StringVar(&contentSecurityPolicy, "content-security-policy", "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'self'", "Content-Security-Policy sent with -secure-headers, empty to send none")
+	flag.StringVar(&corsOrigins, "cors-origins", "", "Comma separated origins allowed to read responses cross-origin, '*' matches any characters as in 'https://*.example.com', a lone '*' allows every origin")
+	flag.StringVar(&corsMethods, "cors-methods", "GET, HEAD", "Comma separated methods allowed in CORS preflight requests")
+	flag.StringVar(&corsHeaders, "cors-headers", "Range", "Comma separated request headers allowed in CORS preflight requests, '*' allows any")
+	flag.StringVar(&corsExposeHeaders, "cors-expose-headers", "Content-Length, Content-Range, ETag", "Comma separated response headers exposed to cross-origin pages")
+	flag.BoolVar(&corsCredentials, "cors-credentials", false, "Allow cross-origin requests with cookies or HTTP authentication")
+	flag.StringVar(&corsMaxAgeValue, "cors-max-age", "0", "How long browsers may cache the answer to a CORS preflight request, 0 leaves it to the browser")
+	flag.Var(&serverHeader, "server-header", "Value of the Server response header, an explicit empty value strips it")
+}
+
+// parseEndpoint parses the S3 endpoint URL, a bare HOST[:PORT] defaults
+// to https.
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid endpoint %q: scheme must be http or https", endpoint)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid endpoint %q: missing host", endpoint)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: only a scheme, host and port are allowed", endpoint)
+	}
+	return u, nil
 }
 
 // NewCustomHTTPTransport returns a new http configuration
 // used while communicating with the cloud backends.
 // This sets the value for MaxIdleConnsPerHost from 2 (go default)
 // to 100.
-func NewCustomHTTPTransport() *http.Transport {
+func NewCustomHTTPTransport(tlsConfig *tls.Config) *http.Transport {
 	return &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
 			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
@@ -175,14 +759,122 @@ func NewCustomHTTPTransport() *http.Transport {
 	}
 }
 
+// parseCleanupInterval returns how often the expired entries of caches
+// keeping them for ttl are removed: every value when given, otherwise
+// every ttl, up to 10 minutes, so short lived entries do not linger.
+func parseCleanupInterval(value string, ttl time.Duration) (time.Duration, error) {
+	if value == "" {
+		if ttl > 10*time.Minute {
+			return 10 * time.Minute, nil
+		}
+		return ttl, nil
+	}
+	return time.ParseDuration(value)
+}
+
 func main() {
+	bindEnv(flag.CommandLine)
 	flag.Parse()
+	if err := applyEnv(flag.CommandLine); err != nil {
+		log.Fatalln(err)
+	}
+	if configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, configFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if err := setupLogging(logLevelName, logFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	if showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if shareTokenTTL != "" {
+		ttl, err := time.ParseDuration(shareTokenTTL)
+		if err != nil || ttl <= 0 {
+			log.Fatalln("-share-token must be a positive duration")
+		}
+		if shareSecret == "" {
+			log.Fatalln("-share-token requires a -share-secret")
+		}
+		fmt.Println("?" + shareQuery(shareSecret, ttl))
+		return
+	}
+	if signURLPath != "" {
+		ttl, err := time.ParseDuration(signURLTTL)
+		if err != nil || ttl <= 0 {
+			log.Fatalln("-sign-url-ttl must be a positive duration")
+		}
+		if urlSigningSecret == "" {
+			log.Fatalln("-sign-url requires a -url-signing-secret")
+		}
+		fmt.Println(signURL(urlSigningSecret, path.Clean(pathSeparator+signURLPath), ttl))
+		return
+	}
 
 	if strings.TrimSpace(bucket) == "" {
 		log.Fatalln(`Bucket name cannot be empty, please provide 's3www -bucket "mybucket"'`)
 	}
 
-	u, err := url.Parse(endpoint)
+	if listingPageSize <= 0 {
+		log.Fatalln("-listing-page-size must be positive")
+	}
+
+	var err error
+	if listingSort, err = parseListingSort(listingSortValue); err != nil {
+		log.Fatalln(err)
+	}
+	if listingHide, err = parseListingHide(listingHideList); err != nil {
+		log.Fatalln(err)
+	}
+
+	if statusPath != "" && statusToken == "" {
+		log.Fatalln("-status-path requires a -status-token")
+	}
+
+	if requireClientCert && clientCA == "" {
+		log.Fatalln("-require-client-cert requires a -client-ca")
+	}
+	if clientCA != "" && (letsEncrypt || tlsCert == "" || tlsKey == "") {
+		log.Fatalln("-client-ca is only supported when serving TLS with -ssl-cert and -ssl-key")
+	}
+	if ticketRotation, err = time.ParseDuration(ticketRotationTime); err != nil {
+		log.Fatalln(err)
+	}
+	if maxConnections < 0 {
+		log.Fatalln("-max-connections must not be negative")
+	}
+	if maxConnections > 0 && letsEncrypt {
+		log.Fatalln("-max-connections is not supported with -lets-encrypt")
+	}
+	if (ocspStapling || ticketRotation > 0) && (letsEncrypt || tlsCert == "" || tlsKey == "") {
+		log.Fatalln("-ocsp-stapling and -session-ticket-rotation are only supported when serving TLS with -ssl-cert and -ssl-key")
+	}
+	if enableHTTP3 && (letsEncrypt || tlsCert == "" || tlsKey == "") {
+		log.Fatalln("-http3 is only supported when serving TLS with -ssl-cert and -ssl-key")
+	}
+
+	prov, err := lookupProvider(providerName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if endpoint == "" {
+		endpoint = prov.endpoint
+	}
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logConfig(flag.CommandLine)
+
+	if insecureSkipVerify {
+		logWarn("-insecure-skip-verify disables verification of the S3 endpoint certificate")
+	}
+	backendTLS, err := backendTLSConfig(caCert, insecureSkipVerify)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -198,7 +890,7 @@ func main() {
 		&credentials.FileAWSCredentials{},
 		&credentials.IAM{
 			Client: &http.Client{
-				Transport: NewCustomHTTPTransport(),
+				Transport: NewCustomHTTPTransport(backendTLS),
 			},
 		},
 		&credentials.EnvMinio{},
@@ -230,39 +922,462 @@ func main() {
 
 	// If we see an Amazon S3 endpoint, then we use more ways to fetch backend credentials.
 	// Specifically IAM style rotating credentials are only supported with AWS S3 endpoint.
-	creds := credentials.NewChainCredentials(defaultAWSCredProviders)
-
-	client, err := minio.New(u.Host, &minio.Options{
-		Creds:        creds,
-		Secure:       u.Scheme == "https",
-		Region:       s3utils.GetRegionFromURL(*u),
-		BucketLookup: minio.BucketLookupAuto,
-		Transport:    NewCustomHTTPTransport(),
-	})
+	creds := credentials.NewChainCredentials(logCredentials(defaultAWSCredProviders))
+	if err := checkCredentials(creds, allowAnonymous); err != nil {
+		log.Fatalln(err)
+	}
+
+	var transport http.RoundTripper = NewCustomHTTPTransport(backendTLS)
+	if metricsAddress != "" {
+		metrics = newMetricsRegistry()
+	}
+	if otlpEndpoint != "" {
+		if tracer, err = newSpanExporter(otlpEndpoint, traceServiceName, traceSampleRatio); err != nil {
+			log.Fatalln(err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			tracer.shutdown(ctx)
+		}()
+	}
+	if metrics != nil || tracer != nil || std.enabled(levelDebug) {
+		transport = meteredTransport{transport}
+	}
+	client, err := minio.New(u.Host, prov.options(u, creds, transport))
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	downloadTypes = parseExtensions(downloadTypesList)
+	exposeMeta = parseMetaKeys(exposeMetaList)
+	if precompressed, err = parseEncodings(precompressedList); err != nil {
+		log.Fatalln(err)
+	}
+	if noCacheExpr != "" {
+		if noCachePattern, err = regexp.Compile(noCacheExpr); err != nil {
+			log.Fatalf("Invalid -no-cache-pattern: %v\n", err)
+		}
+	}
+	if immutableExpr != "" {
+		if immutablePattern, err = regexp.Compile(immutableExpr); err != nil {
+			log.Fatalf("Invalid -immutable-pattern: %v\n", err)
+		}
+	}
+	if maxObjectSize, err = parseByteSize(maxObjectSizeValue); err != nil {
+		log.Fatalln(err)
+	}
+	if compressMinSize, err = parseByteSize(compressMinSizeValue); err != nil {
+		log.Fatalln(err)
+	}
+	compressTypes = parseCompressTypes(compressTypesList)
+	if err = setupCompressors(compressList, compressLevelList); err != nil {
+		log.Fatalln(err)
+	}
+
+	if cacheTTLs, err = parseCacheTTLs(cacheTTLList); err != nil {
+		log.Fatalln(err)
+	}
+	if indexDocuments, err = parseIndexDocuments(indexList); err != nil {
+		log.Fatalln(err)
+	}
+	if resolveOrder, err = parseResolveOrder(resolveOrderList); err != nil {
+		log.Fatalln(err)
+	}
+	if spa {
+		if exactOnly {
+			log.Fatalln("-spa cannot be combined with -exact-only")
+		}
+		resolveOrder = withStage(resolveOrder, stageSPA)
+	}
+	if exactOnly {
+		resolveOrder = []string{stageExact}
+	}
+
+	if defaultRobots != "" {
+		defaultObjects["/robots.txt"] = defaultObject{
+			content:     robotsTxt(defaultRobots),
+			contentType: "text/plain; charset=utf-8",
+		}
+	}
+	if noContentIcons {
+		for _, icon := range wellKnownIcons {
+			defaultObjects[icon] = defaultObject{noContent: true}
+		}
+	}
+
 	cacheDuration, err := time.ParseDuration(cacheTime)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	queueTimeout, err := time.ParseDuration(fetchQueueTimeout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	warmupDuration, err := time.ParseDuration(warmupTimeout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if serveStale {
+		if maxStale, err = time.ParseDuration(maxStaleTime); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	s3 := &S3{
-		Client: client,
-		bucket: bucket,
-		cache:  cache.New(cacheDuration, 10*time.Minute),
+		Client:  minioStore{client},
+		bucket:  bucket,
+		limiter: newFetchLimiter(maxConcurrentFetches, queueTimeout),
+	}
+	// go-cache treats a zero expiration as "never expire", so a zero
+	// cache time has to skip the cache altogether.
+	if !noCache && cacheDuration > 0 {
+		cleanupInterval, err := parseCleanupInterval(cacheCleanup, cacheDuration)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		s3.cache = cache.New(cacheDuration, cleanupInterval)
+		s3.missingPages = cache.New(cacheDuration, cleanupInterval)
+	}
+
+	if size, err := parseByteSize(bodyCacheSize); err != nil {
+		log.Fatalln(err)
+	} else if size > 0 {
+		maxObject, err := parseByteSize(bodyCacheMaxObject)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		s3.bodyCache = newBodyCache(size, maxObject, cacheDuration, revalidate)
+	}
+
+	if missWebhookURL != "" {
+		timeout, err := time.ParseDuration(missWebhookTimeout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if missWebhookPending <= 0 {
+			log.Fatalln("-miss-webhook-pending must be positive")
+		}
+		s3.missWebhook = newMissNotifier(missWebhookURL, timeout, missWebhookPending)
+	}
+
+	var authz authorizer
+	if authURL != "" {
+		timeout, err := time.ParseDuration(authTimeout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		authz = newAuthService(authURL, timeout)
+	}
+	if authUser != "" || authUsersFile != "" {
+		if authz != nil {
+			log.Fatalln("-auth-user and -auth-users-file cannot be combined with -auth-url")
+		}
+		if authz, err = newBasicAuth(authRealm, authUser, authPass, authUsersFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if jwtSecret != "" || jwtPublicKey != "" || jwtJWKSURL != "" {
+		if authz != nil {
+			log.Fatalln("JSON Web Tokens cannot be combined with -auth-url, -auth-user or -auth-users-file")
+		}
+		if jwtPublicKey != "" && jwtJWKSURL != "" {
+			log.Fatalln("-jwt-public-key and -jwt-jwks-url cannot be combined")
+		}
+		v := &jwtVerifier{issuer: jwtIssuer, audience: jwtAudience}
+		if jwtSecret != "" {
+			v.secret = []byte(jwtSecret)
+		}
+		if jwtPublicKey != "" {
+			if v.publicKey, err = loadRSAPublicKey(jwtPublicKey); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if jwtJWKSURL != "" {
+			v.jwks = newJWKSCache(jwtJWKSURL)
+		}
+		authz = &jwtAuth{verifier: v, cookie: jwtCookie, rules: jwtClaims}
+	} else if len(jwtClaims) > 0 || jwtIssuer != "" || jwtAudience != "" {
+		log.Fatalln("-jwt-claim, -jwt-issuer and -jwt-audience require -jwt-secret, -jwt-public-key or -jwt-jwks-url")
+	}
+	var oidc *oidcLogin
+	if oidcIssuer != "" {
+		if authz != nil {
+			log.Fatalln("-oidc-issuer cannot be combined with -auth-url, -auth-user, -auth-users-file or JSON Web Tokens")
+		}
+		if oidc, err = newOIDCLogin(oidcIssuer, oidcClientID, oidcClientSecret, oidcRedirectURL, oidcCookieSecret); err != nil {
+			log.Fatalln(err)
+		}
+		if oidc.sessionTTL, err = time.ParseDuration(oidcSessionTTL); err != nil || oidc.sessionTTL <= 0 {
+			log.Fatalf("Invalid -oidc-session-ttl %q\n", oidcSessionTTL)
+		}
+		oidc.scopes = splitList(oidcScopes)
+		oidc.emailDomains = splitList(oidcEmailDomains)
+		oidc.groups = splitList(oidcGroups)
+		oidc.groupsClaim = oidcGroupsClaim
+	}
+
+	if infoDuration, err := time.ParseDuration(infoCacheTime); err != nil {
+		log.Fatalln(err)
+	} else if infoDuration > 0 && !noCache {
+		s3.infoCache = cache.New(infoDuration, infoDuration)
+	}
+
+	if archiveObject != "" {
+		interval, err := time.ParseDuration(archiveCheckInterval)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		store, err := newArchiveStore(context.Background(), s3.Client, bucket, archiveObject)
+		if err != nil {
+			log.Fatalf("Unable to load archive %q: %v\n", archiveObject, err)
+		}
+		store.onSwap = func() { flushCaches(s3) }
+		store.watch(interval)
+		s3.Client = store
+		// Files are read from memory, and change along with the archive.
+		s3.infoCache = nil
+	}
+
+	if analytics {
+		if analyticsPrefixes <= 0 {
+			log.Fatalln("-analytics-prefixes must be positive")
+		}
+		s3.analytics = newPrefixCounter(analyticsPrefixes)
+	}
+
+	if diskCacheDir != "" {
+		maxSize, err := parseByteSize(diskCacheSize)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ttl, err := time.ParseDuration(diskCacheTTL)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if s3.diskCache, err = newDiskCache(diskCacheDir, maxSize, ttl); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if checkOnly {
+		if err = checkConfig(context.Background(), s3); err != nil {
+			log.Fatalln("Configuration check failed:", err)
+		}
+		logInfo("Configuration check passed")
+		return
+	}
+
+	if shutdownTimeout, err = time.ParseDuration(shutdownTimeoutValue); err != nil || shutdownTimeout < 0 {
+		log.Fatalf("Invalid -shutdown-timeout %q\n", shutdownTimeoutValue)
+	}
+	for _, t := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"read-timeout", readTimeoutValue, &readTimeout},
+		{"read-header-timeout", readHeaderTimeoutValue, &readHeaderTimeout},
+		{"write-timeout", writeTimeoutValue, &writeTimeout},
+		{"idle-timeout", idleTimeoutValue, &idleTimeout},
+	} {
+		if *t.dst, err = time.ParseDuration(t.value); err != nil || *t.dst < 0 {
+			log.Fatalf("Invalid -%s %q\n", t.name, t.value)
+		}
 	}
 
-	mux := http.FileServer(s3)
+	waitStartup, err := time.ParseDuration(startupTimeout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if waitStartup > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), waitStartup)
+		err = waitReady(ctx, s3, startupProbe)
+		cancel()
+		if err != nil {
+			log.Fatalf("S3 did not answer successfully within %s: %v\n", waitStartup, err)
+		}
+		logInfo("S3 is ready")
+	} else if readyPath != "" {
+		go func() {
+			if err := waitReady(context.Background(), s3, startupProbe); err != nil {
+				logError("S3 is not ready", "err", err)
+			}
+		}()
+	}
+
+	if warmupFile != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), warmupDuration)
+		primed, err := warmup(ctx, s3, warmupFile, warmupConcurrency)
+		cancel()
+		if err != nil {
+			logWarn("Warmup incomplete", "file", warmupFile, "err", err)
+		}
+		logInfo("Warmed up", "paths", primed, "file", warmupFile)
+	}
+
+	rs, err := loadRules()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	currentRules.Store(rs)
+	handleReloadSignal(s3)
+
+	var mux http.Handler = s3
+	mux = withRedirects(mux)
+	if authz != nil {
+		mux = withAuth(authz, mux)
+	}
+	if oidc != nil {
+		mux = withOIDC(oidc, mux)
+	}
+	if shareSecret != "" {
+		mux = withShare(shareSecret, mux)
+	}
+	if urlSigningSecret != "" {
+		var pattern *regexp.Regexp
+		if signedPaths != "" {
+			if pattern, err = compilePathPattern(signedPaths); err != nil {
+				log.Fatalf("Invalid -signed-paths: %v\n", err)
+			}
+		}
+		mux = withSignedURLs(urlSigningSecret, pattern, mux)
+	}
+	if s3.analytics != nil {
+		mux = withAnalytics(s3.analytics, mux)
+	}
+	if statusPath != "" {
+		mux = withStatus(s3, statusPath, statusToken, mux)
+	}
+	if canonicalPaths {
+		mux = withCanonicalPath(mux)
+	}
+	mux = withMethods(s3, mux)
+	if corsOrigins != "" {
+		maxAge, err := time.ParseDuration(corsMaxAgeValue)
+		if err != nil || maxAge < 0 {
+			log.Fatalf("Invalid -cors-max-age %q\n", corsMaxAgeValue)
+		}
+		cors, err := newCORSPolicy(corsOrigins, corsMethods, corsHeaders, corsExposeHeaders, corsCredentials, maxAge)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		mux = withCORS(cors, mux)
+	}
+	if rateLimit < 0 || rateBurst < 1 {
+		log.Fatalln("-rate-limit must not be negative and -rate-burst must be positive")
+	}
+	if rateLimit > 0 {
+		mux = withRateLimit(newRateLimiter(rateLimit, rateBurst), trustedProxies, mux)
+	}
+	if len(allowCIDRs) > 0 || len(denyCIDRs) > 0 {
+		mux = withIPFilter(allowCIDRs, denyCIDRs, trustedProxies, mux)
+	}
+	if readyPath != "" {
+		mux = withReady(readyPath, mux)
+	}
+	mux = withVary(mux)
+	if serverHeader.set {
+		mux = withServerHeader(serverHeader.value, mux)
+	}
+	// Always in place, -header rules can be added on reload.
+	mux = withHeaders(mux)
+	if accessLogFile != "" {
+		var out io.Writer = os.Stdout
+		if accessLogFile != "-" {
+			if accessLog, err = openReopenableFile(accessLogFile); err != nil {
+				log.Fatalln(err)
+			}
+			handleReopenSignal(accessLog)
+			out = accessLog
+		}
+		format, err := parseAccessLogFormat(accessLogFormat)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		mux = withAccessLog(out, format, mux)
+	}
+	if adminAddress != "" {
+		if err := serveAdmin(adminAddress, s3, startupProbe); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if metrics != nil {
+		mux = withMetrics(metrics, mux)
+		if err := serveMetrics(metricsAddress, metrics, s3); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if tracer != nil {
+		mux = withTracing(mux)
+	}
+	mux = withRequestID(requestIDHeader, trustRequestID, mux)
 	if letsEncrypt {
-		log.Printf("Started listening on https://%s\n", address)
-		certmagic.HTTPS([]string{address}, mux)
-	} else if tlsCert != "" && tlsKey != "" {
-		log.Printf("Started listening on https://%s\n", address)
-		log.Fatalln(http.ListenAndServeTLS(address, tlsCert, tlsKey, mux))
+		logInfo("Started listening", "url", "https://"+addresses.String())
+		certmagic.HTTPS(addresses.addrs, mux)
+		return
+	}
+
+	for _, addr := range addresses.addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			log.Fatalf("Invalid address %q: %v\n", addr, err)
+		}
+	}
+
+	srvs := make([]*http.Server, len(addresses.addrs))
+	if tlsCert != "" && tlsKey != "" {
+		var clientCAs *x509.CertPool
+		if clientCA != "" {
+			if clientCAs, err = loadCertPool(context.Background(), s3, clientCA); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		certs, err := newCertStore(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if ocspStapling {
+			certs.keepStapled()
+		}
+		certs.handleReloadSignal()
+		for i, addr := range addresses.addrs {
+			srvs[i] = setTimeouts(newTLSServer(addr, mux, disableHTTP2, clientCAs, requireClientCert))
+			srvs[i].TLSConfig.GetCertificate = certs.getCertificate
+			if ticketRotation > 0 {
+				if err := rotateSessionTickets(srvs[i], ticketRotation); err != nil {
+					log.Fatalln(err)
+				}
+			}
+		}
+		lns, err := listenAll(srvs, "https")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if enableHTTP3 {
+			for _, srv := range srvs {
+				startHTTP3(srv)
+			}
+		}
+		err = serveAll(srvs, lns, func(srv *http.Server, ln net.Listener) error {
+			// The certificate comes from GetCertificate.
+			return srv.ServeTLS(ln, "", "")
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
 	} else {
-		log.Printf("Started listening on http://%s\n", address)
-		log.Fatalln(http.ListenAndServe(address, mux))
+		for i, addr := range addresses.addrs {
+			srvs[i] = setTimeouts(&http.Server{Addr: addr, Handler: mux, DisableGeneralOptionsHandler: true})
+		}
+		lns, err := listenAll(srvs, "http")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := serveAll(srvs, lns, (*http.Server).Serve); err != nil {
+			log.Fatalln(err)
+		}
 	}
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics collects the metrics served on -metrics-address, nil when
+// disabled.
+var metrics *metricsRegistry
+
+// histogram counts observations into cumulative buckets, as a Prometheus
+// histogram.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64), name, h.count)
+}
+
+// counterVec is a counter by the values of its labels.
+type counterVec map[[2]string]uint64
+
+func (c counterVec) write(w io.Writer, name, help string, labels ...string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([][2]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{", name)
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, "%s=%q", label, k[i])
+		}
+		fmt.Fprintf(w, "} %d\n", c[k])
+	}
+}
+
+// metricsRegistry holds the request, S3 and cache metrics of the server.
+type metricsRegistry struct {
+	mu           sync.Mutex
+	requests     counterVec
+	duration     *histogram
+	size         *histogram
+	s3Requests   counterVec
+	s3Errors     counterVec
+	cacheResults counterVec
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requests:     make(counterVec),
+		duration:     newHistogram(.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10),
+		size:         newHistogram(100, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8),
+		s3Requests:   make(counterVec),
+		s3Errors:     make(counterVec),
+		cacheResults: make(counterVec),
+	}
+}
+
+// request counts a request served with code, clients sending any method
+// the server does not know are counted as "OTHER" to bound the number of
+// series.
+func (m *metricsRegistry) request(method string, code int, elapsed time.Duration, size int64) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost,
+		http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		method = "OTHER"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[2]string{method, strconv.Itoa(code)}]++
+	m.duration.observe(elapsed.Seconds())
+	m.size.observe(float64(size))
+}
+
+// s3Request counts a request to S3, answered with code or failed with
+// err. Server errors count as errors along with failed requests.
+func (m *metricsRegistry) s3Request(method string, code int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.s3Errors[[2]string{method}]++
+		return
+	}
+	m.s3Requests[[2]string{method, strconv.Itoa(code)}]++
+	if code >= 500 {
+		m.s3Errors[[2]string{method}]++
+	}
+}
+
+// cacheResult counts a body served with the X-Cache status.
+func (m *metricsRegistry) cacheResult(status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cacheResults[[2]string{status}]++
+}
+
+// write writes the metrics in the Prometheus text format, along with the
+// directory cache statistics of s3.
+func (m *metricsRegistry) write(w io.Writer, s3 *S3) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests.write(w, "s3www_requests_total", "Requests served by method and status code.", "method", "code")
+	m.duration.write(w, "s3www_request_duration_seconds", "Time taken to serve requests.")
+	m.size.write(w, "s3www_response_size_bytes", "Size of the response bodies.")
+	m.s3Requests.write(w, "s3www_s3_requests_total", "Requests sent to S3 by method and status code.", "method", "code")
+	m.s3Errors.write(w, "s3www_s3_errors_total", "Requests to S3 failing or answered with a server error.", "method")
+	m.cacheResults.write(w, "s3www_body_cache_total", "Bodies served by X-Cache result.", "result")
+	fmt.Fprintf(w, "# HELP s3www_dir_cache_hits_total Directory cache hits.\n# TYPE s3www_dir_cache_hits_total counter\ns3www_dir_cache_hits_total %d\n", atomic.LoadInt64(&s3.stats.hits))
+	fmt.Fprintf(w, "# HELP s3www_dir_cache_misses_total Directory cache misses.\n# TYPE s3www_dir_cache_misses_total counter\ns3www_dir_cache_misses_total %d\n", atomic.LoadInt64(&s3.stats.misses))
+	fmt.Fprintf(w, "# HELP s3www_credential_failures_total Failed credential lookups.\n# TYPE s3www_credential_failures_total counter\ns3www_credential_failures_total %d\n", atomic.LoadInt64(&credentialFailures))
+}
+
+// meteredTransport counts and traces the requests sent to S3 through
+// next, and logs them at the debug level.
+type meteredTransport struct {
+	next http.RoundTripper
+}
+
+func (t meteredTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	_, sp := startSpan(r.Context(), s3Operation(r), spanClient)
+	sp.set("http.method", r.Method)
+	sp.set("http.url", r.URL.Redacted())
+	resp, err := t.next.RoundTrip(r)
+	code := 0
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	if metrics != nil {
+		metrics.s3Request(r.Method, code, err)
+	}
+	switch {
+	case err != nil:
+		sp.fail(err.Error())
+	case code >= 500:
+		sp.fail(resp.Status)
+	}
+	sp.set("http.status_code", code)
+	sp.finish()
+	if err != nil {
+		logDebug("S3 request failed", "method", r.Method, "url", r.URL.Redacted(), "duration", time.Since(start), "err", err)
+	} else {
+		logDebug("S3 request", "method", r.Method, "url", r.URL.Redacted(), "status", code, "duration", time.Since(start))
+	}
+	return resp, err
+}
+
+// withMetrics counts every request passed to next.
+func withMetrics(m *metricsRegistry, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.request(r.Method, rec.status, time.Since(start), rec.bytes)
+	})
+}
+
+// serveMetrics serves the metrics as /metrics on a separate listener at
+// addr, kept off the site.
+func serveMetrics(addr string, m *metricsRegistry, s3 *S3) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		m.write(&buf, s3)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		buf.WriteTo(w)
+	})
+	logInfo("Serving metrics", "url", "http://"+ln.Addr().String()+"/metrics")
+	go func() {
+		if err := setTimeouts(&http.Server{Handler: mux}).Serve(ln); err != nil {
+			logError("Metrics listener stopped", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// hookResponseWriter wraps a http.ResponseWriter and calls beforeWrite
+// exactly once, just before the response header is written out. This
+// lets middlewares adjust headers after the wrapped handler has set
+// its own.
+type hookResponseWriter struct {
+	http.ResponseWriter
+	beforeWrite func(code int, h http.Header)
+	wroteHeader bool
+}
+
+func (w *hookResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.beforeWrite(code, w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *hookResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// withServerHeader sets the Server header on every response to value, or
+// strips it entirely when value is empty.
+func withServerHeader(value string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&hookResponseWriter{
+			ResponseWriter: w,
+			beforeWrite: func(code int, h http.Header) {
+				if value == "" {
+					h.Del("Server")
+					return
+				}
+				h.Set("Server", value)
+			},
+		}, r)
+	})
+}
+
+// allowedMethods is the Allow header of every resource, they are all read
+// only.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// withMethods answers OPTIONS requests with 204 No Content and refuses
+// methods other than GET and HEAD, whether the path exists or not, with
+// 405 Method Not Allowed and the error page configured for it, both
+// listing the allowed methods. The servers leave "OPTIONS *" to it too,
+// rather than answering it themselves without listing them.
+func withMethods(s3 *S3, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			next.ServeHTTP(w, r)
+		case http.MethodOptions:
+			w.Header().Set("Allow", allowedMethods)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", allowedMethods)
+			s3.serveError(w, r, http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// canonicalPath returns the path p is looked up with, without repeated
+// slashes, "." or ".." segments, keeping its trailing slash. Path patterns
+// are matched against it, so that "/a/../b" or "//b" cannot dodge a rule
+// for "/b".
+func canonicalPath(p string) string {
+	canonical := path.Clean(pathSeparator + p)
+	if strings.HasSuffix(p, pathSeparator) && canonical != pathSeparator {
+		canonical += pathSeparator
+	}
+	return canonical
+}
+
+// withCanonicalPath refuses paths with ".." segments with 400 Bad Request
+// and redirects any other path that is not canonical, such as "/a//b" or
+// "/a/./b", to its canonical form with 301 Moved Permanently, keeping the
+// trailing slash and the query. Lookups are always made with the canonical
+// path, the redirect lets clients and caches settle on a single URL.
+func withCanonicalPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		for _, segment := range strings.Split(p, pathSeparator) {
+			if segment == ".." {
+				http.Error(w, "invalid path", http.StatusBadRequest)
+				return
+			}
+		}
+		canonical := canonicalPath(p)
+		if canonical == p {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := url.URL{Path: canonical, RawQuery: r.URL.RawQuery}
+		w.Header().Set("Location", u.String())
+		w.WriteHeader(http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMethods(t *testing.T) {
+	store := newFakeStore()
+	store.put("index.html", "home")
+	s3 := newTestS3(t, store)
+	h := withMethods(s3, s3)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+		allow  string
+	}{
+		{http.MethodGet, "/index.html", http.StatusOK, ""},
+		{http.MethodHead, "/index.html", http.StatusOK, ""},
+		{http.MethodOptions, "/index.html", http.StatusNoContent, allowedMethods},
+		{http.MethodOptions, "/missing.html", http.StatusNoContent, allowedMethods},
+		{http.MethodPost, "/index.html", http.StatusMethodNotAllowed, allowedMethods},
+		{http.MethodPut, "/index.html", http.StatusMethodNotAllowed, allowedMethods},
+		{http.MethodDelete, "/missing.html", http.StatusMethodNotAllowed, allowedMethods},
+		{http.MethodPatch, "/", http.StatusMethodNotAllowed, allowedMethods},
+	} {
+		w := serveMethod(h, tc.method, tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, w.Code, tc.code)
+		}
+		if got := w.Header().Get("Allow"); got != tc.allow {
+			t.Errorf("%s %s: got Allow %q, want %q", tc.method, tc.path, got, tc.allow)
+		}
+	}
+}
+
+func TestMethodNotAllowedPage(t *testing.T) {
+	setGlobal(t, &errorPages, errorPagesFlag{http.StatusMethodNotAllowed: "errors/405.html"})
+	store := newFakeStore()
+	store.put("index.html", "home")
+	store.put("errors/405.html", "<h1>read only</h1>")
+	s3 := newTestS3(t, store)
+	h := withMethods(s3, s3)
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		for _, p := range []string{"/index.html", "/missing.html"} {
+			w := serveMethod(h, method, p)
+			if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != allowedMethods {
+				t.Errorf("%s %s: got status %d and Allow %q, want %d and %q", method, p, w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed, allowedMethods)
+			}
+			if w.Body.String() != "<h1>read only</h1>" {
+				t.Errorf("%s %s: got body %q, want the 405 page", method, p, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestMethodsWithCORS(t *testing.T) {
+	store := newFakeStore()
+	store.put("index.html", "home")
+	s3 := newTestS3(t, store)
+	p, err := newCORSPolicy("https://example.com", "GET, HEAD", "", "", false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withCORS(p, withMethods(s3, s3))
+
+	// Preflight requests are answered by the CORS policy.
+	w := serveMethod(h, http.MethodOptions, "/index.html",
+		"Origin", "https://example.com", "Access-Control-Request-Method", "GET")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") != "GET, HEAD" {
+		t.Errorf("preflight: got status %d and allowed methods %q", w.Code, w.Header().Get("Access-Control-Allow-Methods"))
+	}
+	// Any other OPTIONS request lists the allowed methods.
+	w = serveMethod(h, http.MethodOptions, "/index.html", "Origin", "https://example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != allowedMethods {
+		t.Errorf("OPTIONS: got status %d and Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestOptionsAsterisk(t *testing.T) {
+	s3 := newTestS3(t, newFakeStore())
+	srv := newTLSServer("127.0.0.1:0", withMethods(s3, s3), true, nil, false)
+	addr := strings.TrimPrefix(serveTLS(t, srv, testCert(t, "127.0.0.1", false, nil)), "https://")
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "OPTIONS * HTTP/1.1\r\nHost: %s\r\n\r\n", addr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Allow") != allowedMethods {
+		t.Errorf("OPTIONS *: got status %d and Allow %q, want %d and %q",
+			resp.StatusCode, resp.Header.Get("Allow"), http.StatusNoContent, allowedMethods)
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	store := newFakeStore()
+	store.put("foo/bar", "bar")
+	store.put("foo/index.html", "foo index")
+	h := withCanonicalPath(newTestS3(t, store))
+
+	for _, tc := range []struct {
+		target   string
+		code     int
+		location string
+	}{
+		{"/foo/bar", http.StatusOK, ""},
+		{"/foo//bar", http.StatusMovedPermanently, "/foo/bar"},
+		{"//foo/bar", http.StatusMovedPermanently, "/foo/bar"},
+		{"/foo/./bar", http.StatusMovedPermanently, "/foo/bar"},
+		{"/foo/./bar?v=1", http.StatusMovedPermanently, "/foo/bar?v=1"},
+		// The trailing slash of directories is kept.
+		{"/foo/", http.StatusOK, ""},
+		{"/foo//", http.StatusMovedPermanently, "/foo/"},
+		{"/./foo/.//", http.StatusMovedPermanently, "/foo/"},
+		// Encoded slashes are slashes.
+		{"/foo%2Fbar", http.StatusOK, ""},
+		{"/foo%2F%2Fbar", http.StatusMovedPermanently, "/foo/bar"},
+		{"/foo/../foo/bar", http.StatusBadRequest, ""},
+		{"/foo/%2e%2e/foo/bar", http.StatusBadRequest, ""},
+		{"/foo/..%2Ffoo/bar", http.StatusBadRequest, ""},
+	} {
+		w := serve(h, tc.target)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.target, w.Code, tc.code)
+			continue
+		}
+		if got := w.Header().Get("Location"); got != tc.location {
+			t.Errorf("%s: got Location %q, want %q", tc.target, got, tc.location)
+		}
+	}
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"context"
+	"io"
 	"os"
-	"strings"
 	"time"
 
 	minio "github.com/minio/minio-go/v7"
@@ -13,17 +12,26 @@ const (
 	pathSeparator = "/"
 )
 
-// A httpMinioObject implements http.File interface, returned by a S3
-// Open method and can be served by the FileServer implementation.
+// s3Object is the readable content of an object, either streamed from
+// S3 or served from a local cache.
+type s3Object interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (minio.ObjectInfo, error)
+}
+
+// A httpMinioObject is an object or a directory of the bucket, as looked
+// up for a request path and served by S3.ServeHTTP.
 type httpMinioObject struct {
-	client *minio.Client
-	object *minio.Object
-	bucket string
+	object s3Object
 	prefix string
 	isDir  bool
 }
 
 func (h *httpMinioObject) Close() error {
+	if h.object == nil {
+		return nil
+	}
 	return h.object.Close()
 }
 
@@ -35,52 +43,6 @@ func (h *httpMinioObject) Seek(offset int64, whence int) (int64, error) {
 	return h.object.Seek(offset, whence)
 }
 
-func (h *httpMinioObject) Readdir(count int) ([]os.FileInfo, error) {
-	// List 'N' number of objects from a bucket-name with a matching prefix.
-	listObjectsN := func(bucket, prefix string, count int) (objsInfo []minio.ObjectInfo, err error) {
-		i := 1
-		for object := range h.client.ListObjects(context.Background(), bucket, minio.ListObjectsOptions{
-			Prefix:    prefix,
-			Recursive: false,
-		}) {
-			if object.Err != nil {
-				return nil, object.Err
-			}
-			i++
-			// Verify if we have printed N objects.
-			if i == count {
-				return
-			}
-			objsInfo = append(objsInfo, object)
-		}
-		return objsInfo, nil
-	}
-
-	// List non-recursively first count entries for prefix 'prefix" prefix.
-	objsInfo, err := listObjectsN(h.bucket, h.prefix, count)
-	if err != nil {
-		return nil, os.ErrNotExist
-	}
-	var fileInfos []os.FileInfo
-	for _, objInfo := range objsInfo {
-		if strings.HasSuffix(objInfo.Key, pathSeparator) {
-			fileInfos = append(fileInfos, objectInfo{
-				ObjectInfo: minio.ObjectInfo{
-					Key:          strings.TrimSuffix(objInfo.Key, pathSeparator),
-					LastModified: objInfo.LastModified,
-				},
-				prefix: strings.TrimSuffix(objInfo.Key, pathSeparator),
-				isDir:  true,
-			})
-			continue
-		}
-		fileInfos = append(fileInfos, objectInfo{
-			ObjectInfo: objInfo,
-		})
-	}
-	return fileInfos, nil
-}
-
 func (h *httpMinioObject) Stat() (os.FileInfo, error) {
 	if h.isDir {
 		return objectInfo{
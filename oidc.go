@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookies of the OIDC login flow. The state cookie of each login is named
+// after its state, so that logins started together, from several tabs or
+// by the assets of a page, do not overwrite each other.
+const (
+	oidcSessionCookie = "s3www_session"
+	oidcStateCookie   = "s3www_oidc_state_"
+)
+
+// oidcStateTTL is how long a user may take to log in at the identity
+// provider.
+const oidcStateTTL = 10 * time.Minute
+
+// oidcProvider holds the endpoints of an OpenID Connect provider, as
+// published by its discovery document.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin lets in the users logged in at an OpenID Connect provider,
+// sending the others there with the authorization code flow and keeping
+// them logged in with an encrypted session cookie.
+type oidcLogin struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  *url.URL
+	scopes       []string
+	sessionTTL   time.Duration
+	emailDomains []string
+	groupsClaim  string
+	groups       []string
+
+	sessionAEAD cipher.AEAD
+	stateAEAD   cipher.AEAD
+	client      *http.Client
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	verifier *jwtVerifier
+}
+
+// newOIDCLogin returns the login flow of the client clientID at the
+// provider issuer, whose callback is redirectURL, sealing cookies with
+// keys derived from cookieSecret.
+func newOIDCLogin(issuer, clientID, clientSecret, redirectURL, cookieSecret string) (*oidcLogin, error) {
+	if clientID == "" {
+		return nil, errors.New("-oidc-issuer requires -oidc-client-id")
+	}
+	u, err := url.Parse(redirectURL)
+	if err != nil || !u.IsAbs() || u.Path == "" {
+		return nil, fmt.Errorf("OIDC redirect URL %q must be an absolute URL with a path", redirectURL)
+	}
+	if cookieSecret == "" {
+		return nil, errors.New("-oidc-issuer requires -oidc-cookie-secret")
+	}
+	sessionAEAD, err := newCookieAEAD(cookieSecret, "session")
+	if err != nil {
+		return nil, err
+	}
+	stateAEAD, err := newCookieAEAD(cookieSecret, "state")
+	if err != nil {
+		return nil, err
+	}
+	return &oidcLogin{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  u,
+		sessionAEAD:  sessionAEAD,
+		stateAEAD:    stateAEAD,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// newCookieAEAD returns the cipher of the cookies of purpose, keyed from
+// secret apart from the other purposes so that a state cookie never opens
+// as a session.
+func newCookieAEAD(secret, purpose string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("s3www oidc " + purpose))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// discover returns the provider, fetching its discovery document the
+// first time it is needed, and again after a failure.
+func (o *oidcLogin) discover() (*oidcProvider, *jwtVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return o.provider, o.verifier, nil
+	}
+	resp, err := o.client.Get(o.issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OIDC discovery answered %s", resp.Status)
+	}
+	p := &oidcProvider{}
+	if err = json.NewDecoder(resp.Body).Decode(p); err != nil {
+		return nil, nil, err
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, nil, errors.New("OIDC discovery document lacks endpoints")
+	}
+	o.provider, o.verifier = p, &jwtVerifier{jwks: newJWKSCache(p.JWKSURI)}
+	return o.provider, o.verifier, nil
+}
+
+// seal encrypts and authenticates v into a cookie value with aead.
+func seal(aead cipher.AEAD, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+// open decrypts the cookie value sealed from v with aead.
+func open(aead cipher.AEAD, value string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) < aead.NonceSize() {
+		return errInvalidToken
+	}
+	n := aead.NonceSize()
+	if data, err = aead.Open(nil, data[:n], data[n:], nil); err != nil {
+		return errInvalidToken
+	}
+	return json.Unmarshal(data, v)
+}
+
+// oidcSession is the content of the session cookie.
+type oidcSession struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcState is the content of the state cookie of a login in progress.
+type oidcState struct {
+	State  string `json:"state"`
+	Nonce  string `json:"nonce"`
+	Return string `json:"return"`
+}
+
+// randomToken returns a random URL-safe token.
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (o *oidcLogin) setCookie(w http.ResponseWriter, r *http.Request, name, value, path string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		Secure:   r.TLS != nil || o.redirectURL.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// session returns the session of r, if it has a valid one.
+func (o *oidcLogin) session(r *http.Request) (oidcSession, bool) {
+	var s oidcSession
+	c, err := r.Cookie(oidcSessionCookie)
+	if err != nil || open(o.sessionAEAD, c.Value, &s) != nil {
+		return s, false
+	}
+	return s, time.Now().Unix() < s.Expires
+}
+
+// login sends the user to the provider, to come back to the page of r.
+func (o *oidcLogin) login(w http.ResponseWriter, r *http.Request) {
+	p, _, err := o.discover()
+	if err != nil {
+		logError("Unable to reach the OIDC provider", "issuer", o.issuer, "err", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	st := oidcState{Return: r.URL.RequestURI()}
+	if st.State, err = randomToken(); err == nil {
+		st.Nonce, err = randomToken()
+	}
+	var value string
+	if err == nil {
+		value, err = seal(o.stateAEAD, st)
+	}
+	if err != nil {
+		logError("Unable to start the OIDC login", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// Only the callback needs the state cookie.
+	o.setCookie(w, r, oidcStateCookie+st.State, value, o.redirectURL.Path, time.Now().Add(oidcStateTTL))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.clientID)
+	q.Set("redirect_uri", o.redirectURL.String())
+	q.Set("scope", strings.Join(o.scopes, " "))
+	q.Set("state", st.State)
+	q.Set("nonce", st.Nonce)
+	target := p.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// callback completes a login, exchanging the code of r for an ID token
+// whose claims open a session.
+func (o *oidcLogin) callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var st oidcState
+	c, err := r.Cookie(oidcStateCookie + q.Get("state"))
+	if err != nil || q.Get("state") == "" || open(o.stateAEAD, c.Value, &st) != nil || q.Get("state") != st.State {
+		http.Error(w, "invalid or expired login, try again", http.StatusBadRequest)
+		return
+	}
+	o.setCookie(w, r, c.Name, "", o.redirectURL.Path, time.Unix(0, 0))
+	if e := q.Get("error"); e != "" {
+		logWarn("OIDC login failed", "error", e, "description", q.Get("error_description"))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	claims, err := o.exchange(r, q.Get("code"), st.Nonce)
+	if err != nil {
+		logError("Unable to complete the OIDC login", "err", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if !o.allowed(claims) {
+		logInfo("Refused OIDC user", "sub", claims["sub"], "email", claims["email"])
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	s := oidcSession{Expires: time.Now().Add(o.sessionTTL).Unix()}
+	s.Subject, _ = claims["sub"].(string)
+	s.Email, _ = claims["email"].(string)
+	value, err := seal(o.sessionAEAD, s)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	o.setCookie(w, r, oidcSessionCookie, value, "/", time.Unix(s.Expires, 0))
+	back := st.Return
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") {
+		back = "/"
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// exchange redeems code at the token endpoint and returns the claims of
+// the ID token, once checked to be issued to this client for nonce.
+func (o *oidcLogin) exchange(r *http.Request, code, nonce string) (map[string]interface{}, error) {
+	p, v, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.redirectURL.String())
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint answered %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+
+	claims, err := v.verify(tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != o.issuer {
+		return nil, fmt.Errorf("ID token issued by %q", iss)
+	}
+	if !claimHolds(claims, "aud", o.clientID) {
+		return nil, errors.New("ID token issued to another client")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// allowed reports whether the user of claims may log in, with a verified
+// email of one of emailDomains and in one of groups when set.
+func (o *oidcLogin) allowed(claims map[string]interface{}) bool {
+	if len(o.emailDomains) > 0 {
+		email, _ := claims["email"].(string)
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return false
+		}
+		i := strings.LastIndex(email, "@")
+		if i < 0 {
+			return false
+		}
+		found := false
+		for _, d := range o.emailDomains {
+			if strings.EqualFold(email[i+1:], d) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(o.groups) > 0 {
+		for _, g := range o.groups {
+			if claimHolds(claims, o.groupsClaim, g) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// withOIDC serves only the requests of users logged in with o, sending
+// the others to log in first, and handles the callback of the provider.
+func withOIDC(o *oidcLogin, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		varyOn(r, "Cookie")
+		if r.URL.Path == o.redirectURL.Path {
+			o.callback(w, r)
+			return
+		}
+		if s, ok := o.session(r); ok {
+			user := s.Email
+			if user == "" {
+				user = s.Subject
+			}
+			setAccessUser(r, user)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		o.login(w, r)
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIdP is an OpenID Connect provider whose token endpoint answers an
+// ID token of claims, with the nonce of the last login.
+type fakeIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+	nonce  string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","use":"sig","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		claims := map[string]interface{}{
+			"iss":   idp.URL,
+			"aud":   "client",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": idp.nonce,
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, claims)})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// sign returns an RS256 ID token of claims.
+func (idp *fakeIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"k1"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// startLogin requests target without a session and returns the state of
+// the login it starts, and its state cookie.
+func startLogin(t *testing.T, h http.Handler, idp *fakeIdP, target string) (string, *http.Cookie) {
+	t.Helper()
+	w := serve(h, target)
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), idp.URL+"/authorize?") {
+		t.Fatalf("%s: got status %d to %q, want a redirect to the provider", target, w.Code, w.Header().Get("Location"))
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := u.Query().Get("state")
+	idp.nonce = u.Query().Get("nonce")
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie+state {
+			if c.Path != "/callback" {
+				t.Errorf("%s: state cookie for path %q, want only the callback", target, c.Path)
+			}
+			return state, c
+		}
+	}
+	t.Fatalf("%s: no state cookie for state %q", target, state)
+	return "", nil
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	store := newFakeStore()
+	store.put("index.html", "private")
+	store.put("site.css", "body{}")
+	o, err := newOIDCLogin(idp.URL, "client", "client secret", "https://docs.example.com/callback", "cookie secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.sessionTTL = time.Hour
+	o.emailDomains = []string{"example.com"}
+	h := withOIDC(o, newTestS3(t, store))
+
+	// Logins started together, by a page and its assets, keep their own
+	// state, and the first one still completes.
+	state, cookie := startLogin(t, h, idp, "/index.html")
+	nonce := idp.nonce
+	otherState, otherCookie := startLogin(t, h, idp, "/site.css")
+	if otherState == state {
+		t.Fatal("two logins got the same state")
+	}
+	idp.nonce = nonce
+	idp.claims = map[string]interface{}{"sub": "alice", "email": "alice@example.com", "email_verified": true}
+	w := serve(h, "/callback?code=c&state="+state, "Cookie", otherCookie.Name+"="+otherCookie.Value+"; "+cookie.Name+"="+cookie.Value)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/index.html" {
+		t.Fatalf("callback: got status %d to %q, want back to /index.html", w.Code, w.Header().Get("Location"))
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcSessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("callback: no session cookie")
+	}
+	if w := serve(h, "/index.html", "Cookie", session.Name+"="+session.Value); w.Code != http.StatusOK || w.Body.String() != "private" {
+		t.Errorf("with the session: got status %d and body %q, want the page", w.Code, w.Body.String())
+	}
+
+	// The state cookie of another login does not complete this one.
+	if w := serve(h, "/callback?code=c&state="+state, "Cookie", oidcStateCookie+state+"="+otherCookie.Value); w.Code != http.StatusBadRequest {
+		t.Errorf("with the cookie of another state: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	// A state cookie, sealed with its own key, is no session.
+	if w := serve(h, "/index.html", "Cookie", oidcSessionCookie+"="+otherCookie.Value); w.Code != http.StatusFound {
+		t.Errorf("with a state cookie as session: got status %d, want a login", w.Code)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+	}{
+		{"unverified email", map[string]interface{}{"sub": "bob", "email": "bob@example.com", "email_verified": false}},
+		{"email not known verified", map[string]interface{}{"sub": "bob", "email": "bob@example.com"}},
+		{"other domain", map[string]interface{}{"sub": "eve", "email": "eve@example.org", "email_verified": true}},
+	} {
+		state, cookie := startLogin(t, h, idp, "/index.html")
+		idp.claims = tc.claims
+		if w := serve(h, "/callback?code=c&state="+state, "Cookie", cookie.Name+"="+cookie.Value); w.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// objectStore is the object storage objects are fetched from. minioStore
+// implements it for every S3 compatible backend, other backends only have
+// to implement these methods.
+type objectStore interface {
+	BucketExists(ctx context.Context, bucket string) (bool, error)
+	GetObject(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (s3Object, error)
+	StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+	ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+}
+
+// minioStore is an objectStore backed by the minio client.
+type minioStore struct {
+	*minio.Client
+}
+
+func (m minioStore) GetObject(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (s3Object, error) {
+	obj, err := m.Client.GetObject(ctx, bucket, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// provider holds the defaults to reach the S3 compatible API of a
+// storage provider.
+type provider struct {
+	// endpoint is used when no -endpoint is given.
+	endpoint string
+	// region overrides the region derived from the endpoint.
+	region       string
+	bucketLookup minio.BucketLookupType
+}
+
+// providers are the storage providers selected with -provider.
+var providers = map[string]provider{
+	"s3": {
+		bucketLookup: minio.BucketLookupAuto,
+	},
+	// Google Cloud Storage through its XML API, with HMAC keys.
+	"gcs": {
+		endpoint:     "https://storage.googleapis.com",
+		region:       "auto",
+		bucketLookup: minio.BucketLookupPath,
+	},
+}
+
+// lookupProvider returns the provider called name.
+func lookupProvider(name string) (provider, error) {
+	p, ok := providers[name]
+	if !ok {
+		return p, fmt.Errorf("unknown provider %q, expected 's3' or 'gcs'", name)
+	}
+	return p, nil
+}
+
+// regionFor returns the region used to reach the provider at u.
+func (p provider) regionFor(u *url.URL) string {
+	if p.region != "" {
+		return p.region
+	}
+	return s3utils.GetRegionFromURL(*u)
+}
+
+// options returns the options of the client reaching the provider at u
+// with creds through transport.
+func (p provider) options(u *url.URL, creds *credentials.Credentials, transport http.RoundTripper) *minio.Options {
+	return &minio.Options{
+		Creds:        creds,
+		Secure:       u.Scheme == "https",
+		Region:       p.regionFor(u),
+		BucketLookup: p.bucketLookup,
+		Transport:    transport,
+	}
+}
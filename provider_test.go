@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestProviderOptions(t *testing.T) {
+	creds := credentials.NewStaticV4("access", "secret", "")
+	for _, tc := range []struct {
+		provider string
+		endpoint string
+		host     string
+		secure   bool
+		region   string
+		lookup   minio.BucketLookupType
+	}{
+		{"gcs", "", "storage.googleapis.com", true, "auto", minio.BucketLookupPath},
+		{"gcs", "http://127.0.0.1:4443", "127.0.0.1:4443", false, "auto", minio.BucketLookupPath},
+		{"s3", "https://s3.eu-west-1.amazonaws.com", "s3.eu-west-1.amazonaws.com", true, "eu-west-1", minio.BucketLookupAuto},
+		{"s3", "http://minio.local:9000", "minio.local:9000", false, "", minio.BucketLookupAuto},
+	} {
+		p, err := lookupProvider(tc.provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint := tc.endpoint
+		if endpoint == "" {
+			endpoint = p.endpoint
+		}
+		u, err := parseEndpoint(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := p.options(u, creds, nil)
+		if u.Host != tc.host || opts.Secure != tc.secure || opts.Region != tc.region || opts.BucketLookup != tc.lookup {
+			t.Errorf("%s %q: got host %q, secure %v, region %q and lookup %v, want %q, %v, %q and %v",
+				tc.provider, tc.endpoint, u.Host, opts.Secure, opts.Region, opts.BucketLookup,
+				tc.host, tc.secure, tc.region, tc.lookup)
+		}
+	}
+	if _, err := lookupProvider("azure"); err == nil {
+		t.Error("accepted an unknown provider")
+	}
+}
+
+func TestGCSRequests(t *testing.T) {
+	var gotPath, gotAuth string
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuth = r.URL.Path, r.Header.Get("Authorization")
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", fakeTime.Format(http.TimeFormat))
+		io.WriteString(w, "page")
+	}))
+	defer gcs.Close()
+
+	p, _ := lookupProvider("gcs")
+	u, _ := url.Parse(gcs.URL)
+	client, err := minio.New(u.Host, p.options(u, credentials.NewStaticV4("GOOG1EXAMPLE", "secret", ""), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := minioStore{client}.GetObject(context.Background(), "site", "docs/index.html", minio.GetObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if _, err := io.ReadAll(obj); err != nil {
+		t.Fatal(err)
+	}
+	// GCS wants path style requests signed for the "auto" region.
+	if gotPath != "/site/docs/index.html" {
+		t.Errorf("requested %q, want the path style /site/docs/index.html", gotPath)
+	}
+	if !strings.Contains(gotAuth, "/auto/s3/aws4_request") {
+		t.Errorf("signed with %q, want the auto region", gotAuth)
+	}
+}
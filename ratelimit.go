@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the requests a client may still make right away.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the requests of each client to rate per second, with
+// bursts of up to burst requests, as token buckets refilled continuously.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+	go l.sweep()
+	return l
+}
+
+// allow takes a token from the bucket of client, or returns how long
+// until one is available.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets every minute the clients whose bucket refilled, they are
+// no different from new clients, so that memory follows the number of
+// active clients.
+func (l *rateLimiter) sweep() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		l.mu.Lock()
+		for client, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, client)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// withRateLimit refuses with 429 Too Many Requests the requests of clients,
+// told apart by address as with -trusted-proxies, over the rate of l,
+// telling them when to retry.
+func withRateLimit(l *rateLimiter, trusted cidrsFlag, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Clients are never told apart by port, each new connection
+		// would get a bucket of its own.
+		client := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		if ip := clientIP(r, trusted); ip != nil {
+			client = ip.String()
+		}
+		if ok, wait := l.allow(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
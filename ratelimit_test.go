@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	l := newRateLimiter(0.5, 2)
+	h := withRateLimit(l, cidrs(t, "10.0.0.0/8"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(remoteAddr, xff string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, requestFrom(remoteAddr, xff))
+		return w
+	}
+
+	// The burst is served, then the client must wait for a token, two
+	// seconds at half a request per second.
+	for i := 0; i < 2; i++ {
+		if w := request("203.0.113.7:1000", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d of the burst: got status %d", i+1, w.Code)
+		}
+	}
+	w := request("203.0.113.7:1000", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the burst: got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("got Retry-After %q, want 2", got)
+	}
+
+	// Other connections of the client share its bucket, other clients
+	// have their own.
+	if w := request("203.0.113.7:1001", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("new connection: got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := request("10.0.0.1:1000", "203.0.113.7"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("through a trusted proxy: got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := request("198.51.100.1:1000", ""); w.Code != http.StatusOK {
+		t.Errorf("other client: got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Peers that are no IP address are told apart by host as well.
+	for i := 0; i < 2; i++ {
+		request("peer.local:1000", "")
+	}
+	if w := request("peer.local:1001", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("new connection of a named peer: got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	l := newRateLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("client"); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	if ok, wait := l.allow("client"); ok || wait <= 0 || wait > time.Second {
+		t.Fatalf("over the burst: got %v, wait %v, want refused for up to a second", ok, wait)
+	}
+
+	// Two seconds later two tokens are back, and never more than the
+	// burst however long the client waited.
+	l.buckets["client"].last = l.buckets["client"].last.Add(-2 * time.Second)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("client"); !ok {
+			t.Errorf("refilled request %d refused", i+1)
+		}
+	}
+	if ok, _ := l.allow("client"); ok {
+		t.Error("served more requests than refilled")
+	}
+	l.buckets["client"].last = l.buckets["client"].last.Add(-time.Hour)
+	served := 0
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.allow("client"); ok {
+			served++
+		}
+	}
+	if served != 3 {
+		t.Errorf("served %d requests after an hour, want the burst of 3", served)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// ready is set to 1 once S3 was successfully contacted, updated
+// atomically.
+var ready int32
+
+// probeInterval is the first interval between startup probes, doubled
+// after every failed probe up to maxProbeInterval.
+var probeInterval = 500 * time.Millisecond
+
+// maxProbeInterval bounds the backoff between startup probes.
+const maxProbeInterval = 10 * time.Second
+
+// probe performs a lightweight request to S3: checking that the bucket
+// exists, or that the object key does when not empty.
+func probe(ctx context.Context, s3 *S3, key string) error {
+	if key != "" {
+		_, err := s3.Client.StatObject(ctx, s3.bucket, key, minio.StatObjectOptions{})
+		return err
+	}
+	found, err := s3.Client.BucketExists(ctx, s3.bucket)
+	if err == nil && !found {
+		err = fmt.Errorf("bucket %q does not exist", s3.bucket)
+	}
+	return err
+}
+
+// waitReady probes S3 until it answers successfully, backing off between
+// attempts, and marks the server ready. It gives up with the last error
+// once ctx is done.
+func waitReady(ctx context.Context, s3 *S3, key string) error {
+	interval := probeInterval
+	for attempt := 1; ; attempt++ {
+		err := probe(ctx, s3, key)
+		if err == nil {
+			atomic.StoreInt32(&ready, 1)
+			return nil
+		}
+		logWarn("S3 is not ready yet", "attempt", attempt, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxProbeInterval {
+			interval = maxProbeInterval
+		}
+	}
+}
+
+// withReady answers requests for readyPath with 200 OK once the server is
+// ready and 503 Service Unavailable until then or while shutting down,
+// and passes every other request to next.
+func withReady(readyPath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != readyPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if atomic.LoadInt32(&ready) == 0 || atomic.LoadInt32(&draining) == 1 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ready")
+	})
+}
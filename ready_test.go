@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	setGlobal(t, &probeInterval, 5*time.Millisecond)
+	setGlobal(t, &ready, 0)
+	store := newFakeStore()
+	store.errs["health.txt"] = errors.New("connection refused")
+	s3 := newTestS3(t, store)
+	h := withReady("/_ready", s3)
+
+	if w := serve(h, "/_ready"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("before S3 answered: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	// S3 only becomes available after a while.
+	time.AfterFunc(delay, func() {
+		store.mu.Lock()
+		delete(store.errs, "health.txt")
+		store.mu.Unlock()
+		store.put("health.txt", "ok")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := waitReady(ctx, s3, "health.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// Listening only starts once waitReady returned.
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("ready after %s, before S3 was available", elapsed)
+	}
+	if w := serve(h, "/_ready"); w.Code != http.StatusOK {
+		t.Errorf("after S3 answered: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serve(h, "/health.txt"); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("got status %d and body %q for other paths, want them served", w.Code, w.Body.String())
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	setGlobal(t, &probeInterval, 5*time.Millisecond)
+	setGlobal(t, &ready, 0)
+	store := newFakeStore()
+	store.errs["health.txt"] = errors.New("connection refused")
+	s3 := newTestS3(t, store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := waitReady(ctx, s3, "health.txt"); err == nil {
+		t.Fatal("ready while S3 never answered")
+	}
+	if w := serve(withReady("/_ready", s3), "/_ready"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
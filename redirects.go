@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// redirectRule redirects request paths matching from to to, where each
+// '*' in the pattern is captured and substituted in order for the '*'
+// found in the target.
+type redirectRule struct {
+	pattern string
+	from    *regexp.Regexp
+	to      string
+	status  int
+}
+
+// parseRedirectRule parses a rule of the form FROM=TO[:STATUS], e.g.
+// "/old/*=/new/*:302". The status defaults to 301.
+func parseRedirectRule(value string) (redirectRule, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return redirectRule{}, fmt.Errorf("redirect %q is not of the form FROM=TO[:STATUS]", value)
+	}
+	rule := redirectRule{
+		pattern: value,
+		to:      value[i+1:],
+		status:  http.StatusMovedPermanently,
+	}
+
+	from := value[:i]
+	if !strings.HasPrefix(from, pathSeparator) {
+		return redirectRule{}, fmt.Errorf("redirect %q must match an absolute path", value)
+	}
+
+	// A trailing ":NNN" is the status code, anything else after the last
+	// colon such as a port is part of the target.
+	if j := strings.LastIndex(rule.to, ":"); j >= 0 && len(rule.to)-j == 4 {
+		if code, err := strconv.Atoi(rule.to[j+1:]); err == nil {
+			switch code {
+			case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+				http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			default:
+				return redirectRule{}, fmt.Errorf("redirect %q has an invalid status code", value)
+			}
+			rule.status = code
+			rule.to = rule.to[:j]
+		}
+	}
+	if rule.to == "" {
+		return redirectRule{}, fmt.Errorf("redirect %q has an empty target", value)
+	}
+	if strings.Count(rule.to, "*") > strings.Count(from, "*") {
+		return redirectRule{}, fmt.Errorf("redirect %q uses more wildcards in its target than it matches", value)
+	}
+
+	parts := strings.Split(from, "*")
+	for k := range parts {
+		parts[k] = regexp.QuoteMeta(parts[k])
+	}
+	rule.from = regexp.MustCompile("^" + strings.Join(parts, "(.*)") + "$")
+	return rule, nil
+}
+
+// target returns where a request for urlPath is redirected to, if the
+// rule matches it.
+func (rule redirectRule) target(urlPath string) (string, bool) {
+	m := rule.from.FindStringSubmatch(urlPath)
+	if m == nil {
+		return "", false
+	}
+	to := rule.to
+	for _, capture := range m[1:] {
+		if !strings.Contains(to, "*") {
+			break
+		}
+		to = strings.Replace(to, "*", capture, 1)
+	}
+	return to, true
+}
+
+// redirectsFlag implements flag.Value for the repeatable -redirect flag.
+type redirectsFlag []redirectRule
+
+func (r *redirectsFlag) String() string {
+	var rules []string
+	for _, rule := range *r {
+		rules = append(rules, rule.pattern)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *redirectsFlag) repeatable() {}
+
+func (r *redirectsFlag) Set(value string) error {
+	rule, err := parseRedirectRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// withRedirects redirects requests matching one of the current redirect
+// rules, the first matching rule wins. The query string is kept unless
+// the target sets its own.
+func withRedirects(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range rules().redirects {
+			to, ok := rule.target(r.URL.Path)
+			if !ok {
+				continue
+			}
+			if r.URL.RawQuery != "" && !strings.Contains(to, "?") {
+				to += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, to, rule.status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
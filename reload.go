@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"syscall"
+)
+
+// ruleSet holds the request handling rules that can be swapped at runtime,
+// requests always see a single consistent set.
+type ruleSet struct {
+	redirects     []redirectRule
+	rewrites      []rewriteRule
+	errorPages    errorPagesFlag
+	headers       []headerRule
+	cacheControls []cacheControlRule
+}
+
+var currentRules atomic.Value
+
+// rules returns the rule set currently in effect.
+func rules() *ruleSet {
+	return currentRules.Load().(*ruleSet)
+}
+
+// loadRules builds a rule set from the current configuration.
+func loadRules() (*ruleSet, error) {
+	pages := make(errorPagesFlag, len(errorPages))
+	for code, object := range errorPages {
+		pages[code] = object
+	}
+	return &ruleSet{
+		redirects:     append([]redirectRule(nil), redirects...),
+		rewrites:      append([]rewriteRule(nil), rewrites...),
+		errorPages:    pages,
+		headers:       responseHeaderRules(headers),
+		cacheControls: append([]cacheControlRule(nil), cacheControls...),
+	}, nil
+}
+
+// reloadableFlags are the settings of the config file applied again on
+// reload, with a constructor of their default value. Changes to the
+// others are only logged, they need a restart.
+var reloadableFlags = map[string]func() flag.Value{
+	"redirect":      func() flag.Value { return &redirectsFlag{} },
+	"rewrite":       func() flag.Value { return &rewritesFlag{} },
+	"error-page":    func() flag.Value { return errorPagesFlag{http.StatusNotFound: "404.html"} },
+	"header":        func() flag.Value { return &headersFlag{} },
+	"cache-control": func() flag.Value { return &cacheControlsFlag{} },
+}
+
+// reloadRules builds a rule set from the config file as it is now, the
+// rules given on the command line or through env vars keep their value.
+func reloadRules(fs *flag.FlagSet, path string) (*ruleSet, error) {
+	rs, err := loadRules()
+	if err != nil || path == "" {
+		return rs, err
+	}
+	settings, err := readConfigFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	explicit := explicitFlags(fs)
+	logRestartSettings(explicit, settings)
+
+	for name, newValue := range reloadableFlags {
+		if explicit[name] {
+			continue
+		}
+		v := newValue()
+		if err = setValues(v, name, settings[name]); err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case *redirectsFlag:
+			rs.redirects = *v
+		case *rewritesFlag:
+			rs.rewrites = *v
+		case errorPagesFlag:
+			rs.errorPages = v
+		case *headersFlag:
+			rs.headers = responseHeaderRules(*v)
+		case *cacheControlsFlag:
+			rs.cacheControls = *v
+		}
+	}
+	return rs, nil
+}
+
+// logRestartSettings logs the settings of the config file changed since
+// startup that only take effect on restart.
+func logRestartSettings(explicit map[string]bool, settings map[string][]string) {
+	changed := make(map[string]bool)
+	for name, values := range settings {
+		if !reflect.DeepEqual(values, startupSettings[name]) {
+			changed[name] = true
+		}
+	}
+	for name := range startupSettings {
+		if _, ok := settings[name]; !ok {
+			changed[name] = true
+		}
+	}
+	var names []string
+	for name := range changed {
+		if _, ok := reloadableFlags[name]; !ok && !explicit[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		logWarn("Changed settings of the config file require a restart", "settings", names)
+	}
+}
+
+// flushCaches drops everything cached about the objects of the bucket.
+func flushCaches(s3 *S3) {
+	if s3.cache != nil {
+		s3.cache.Flush()
+		s3.missingPages.Flush()
+	}
+	if s3.bodyCache != nil {
+		s3.bodyCache.flush()
+	}
+	if s3.infoCache != nil {
+		s3.infoCache.Flush()
+	}
+	if s3.diskCache != nil {
+		s3.diskCache.flush()
+	}
+}
+
+// reload flushes the caches, resets the analytics, reopens the access log
+// and atomically swaps in the rules of the config file read again,
+// keeping the current ones if they fail to load.
+func reload(s3 *S3) {
+	flushCaches(s3)
+	if s3.analytics != nil {
+		s3.analytics.reset()
+	}
+	if accessLog != nil {
+		if err := accessLog.reopen(); err != nil {
+			logError("Unable to reopen the log file", "path", accessLog.path, "err", err)
+		}
+	}
+
+	rs, err := reloadRules(flag.CommandLine, configFile)
+	if err != nil {
+		logError("Reload failed, keeping the current rules", "err", err)
+		return
+	}
+	currentRules.Store(rs)
+	logInfo("Reloaded caches and rules")
+}
+
+// handleReloadSignal reloads on every SIGHUP.
+func handleReloadSignal(s3 *S3) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			reload(s3)
+		}
+	}()
+}
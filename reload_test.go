@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlagSet returns a flag set with the reloadable flags and -bucket,
+// set from the config file path.
+func testFlagSet(t *testing.T, path string, args ...string) *flag.FlagSet {
+	t.Helper()
+	setGlobal(t, &startupSettings, nil)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var r redirectsFlag
+	var rw rewritesFlag
+	fs.Var(&r, "redirect", "")
+	fs.Var(&rw, "rewrite", "")
+	fs.Var(errorPagesFlag{}, "error-page", "")
+	fs.Var(&headersFlag{}, "header", "")
+	fs.Var(&cacheControlsFlag{}, "cache-control", "")
+	fs.String("bucket", "", "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadRulesReadsConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3www.yaml")
+	writeFile(t, path, "bucket: site\nredirect:\n  - /old=/new\nerror-page:\n  500: errors/500.html\n")
+	fs := testFlagSet(t, path)
+
+	var logged bytes.Buffer
+	setGlobal(t, &std.out, io.Writer(&logged))
+	writeFile(t, path, "bucket: other\nredirect:\n  - /a=/b\n  - /c=/d:302\nheader:\n  - 'X-Frame-Options: DENY'\ncache-control:\n  - '/assets/*=max-age=60'\n")
+	rs, err := reloadRules(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirects := redirectsFlag(rs.redirects)
+	if got, want := redirects.String(), "/a=/b,/c=/d:302"; got != want {
+		t.Errorf("got redirects %q, want %q", got, want)
+	}
+	headers := headersFlag(rs.headers)
+	if got, want := headers.String(), "X-Frame-Options: DENY"; got != want {
+		t.Errorf("got headers %q, want %q", got, want)
+	}
+	controls := cacheControlsFlag(rs.cacheControls)
+	if got, want := controls.String(), "/assets/*=max-age=60"; got != want {
+		t.Errorf("got cache controls %q, want %q", got, want)
+	}
+	// The error page left out of the file is back to its default.
+	if got, want := rs.errorPages.String(), "404=404.html"; got != want {
+		t.Errorf("got error pages %q, want %q", got, want)
+	}
+	if !strings.Contains(logged.String(), "restart") || !strings.Contains(logged.String(), "bucket") {
+		t.Errorf("the changed bucket is not logged as needing a restart: %q", logged.String())
+	}
+
+	writeFile(t, path, "redirect: [/a\n")
+	if _, err := reloadRules(fs, path); err == nil {
+		t.Error("reloaded a broken config file")
+	}
+	writeFile(t, path, "redirect:\n  - nonsense\n")
+	if _, err := reloadRules(fs, path); err == nil {
+		t.Error("reloaded an invalid redirect rule")
+	}
+}
+
+func TestReloadRulesKeepsExplicitFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3www.toml")
+	writeFile(t, path, "error-page = [\"500=errors/500.html\"]\n")
+	fs := testFlagSet(t, path, "-error-page", "503=busy.html")
+	setGlobal(t, &errorPages, errorPagesFlag{503: "busy.html"})
+
+	writeFile(t, path, "error-page = [\"500=errors/oops.html\"]\n")
+	rs, err := reloadRules(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rs.errorPages.String(), "503=busy.html"; got != want {
+		t.Errorf("got error pages %q, want %q", got, want)
+	}
+}
+
+func TestReloadedHeadersApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3www.yaml")
+	writeFile(t, path, "bucket: site\n")
+	fs := testFlagSet(t, path)
+	setGlobal(t, &secureHeaders, true)
+	store := newFakeStore()
+	store.put("assets/site.css", "body{}")
+	h := withHeaders(newTestS3(t, store))
+	if w := serve(h, "/assets/site.css"); w.Header().Get("X-Frame-Options") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Fatalf("before reload: got headers %v", w.Header())
+	}
+
+	writeFile(t, path, "header:\n  - 'X-Frame-Options: DENY'\ncache-control:\n  - '/assets/*=max-age=60'\n")
+	rs, err := reloadRules(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentRules.Store(rs)
+	w := serve(h, "/assets/site.css")
+	for name, want := range map[string]string{
+		"X-Frame-Options": "DENY",
+		"Cache-Control":   "max-age=60",
+		// The headers of -secure-headers are kept.
+		"X-Content-Type-Options": "nosniff",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("after reload: got %s %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReloadFlushesDiskCache(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.txt", "hello")
+	s3 := newTestS3(t, store)
+	dir := t.TempDir()
+	var err error
+	if s3.diskCache, err = newDiskCache(dir, 1<<20, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := s3.diskCache.get(context.Background(), s3, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+
+	flushCaches(s3)
+	if _, ok := s3.diskCache.lookup("a.txt"); ok {
+		t.Error("a.txt is still cached")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+diskCacheSuffix))
+	if len(files) != 0 {
+		t.Errorf("%d cache files left behind", len(files))
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("the cache directory is gone: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDLength is the longest inbound request ID we are willing
+// to honor, anything longer is replaced by a generated one.
+const maxRequestIDLength = 64
+
+// newRequestID returns a short random URL-safe identifier.
+func newRequestID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// validRequestID reports whether an inbound request ID is short and only
+// made of URL-safe characters, so it is safe to echo back and to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext returns the request ID attached by withRequestID,
+// or an empty string if there is none.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID attaches a request ID to every request, honoring an
+// inbound one when trusted, and echoes it back as a response header.
+func withRequestID(header string, trustInbound bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !trustInbound || !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(header, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		next.ServeHTTP(w, r)
+	})
+}
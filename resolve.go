@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Lookup stages mapping a request path to an object key, they are tried
+// in the order configured with -resolve-order. When no stage finds an
+// object the 404 error page is served.
+const (
+	// stageExact looks up the path as is.
+	stageExact = "exact"
+	// stageHTML looks up the path with a ".html" suffix, for clean URLs.
+	stageHTML = "html"
+	// stageIndex looks up the index documents under the path, unless it
+	// has a file extension.
+	stageIndex = "index"
+	// stageSPA falls back to the root 200.html or index document, for
+	// single page applications handling their own routing, unless the
+	// path has a file extension.
+	stageSPA = "spa"
+)
+
+// indexDocuments are the object names served for a directory, in order,
+// as parsed from -index.
+var indexDocuments = []string{"index.html", "index.htm"}
+
+// spaFallback is served by the spa stage, the 200.html generated by some
+// static site builders for unmatched routes is preferred over the first
+// root index document.
+const spaFallback = "200.html"
+
+// parseIndexDocuments parses a comma separated list of index document
+// names.
+func parseIndexDocuments(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.Contains(name, pathSeparator) {
+			return nil, fmt.Errorf("index document %q must be a name, not a path", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no index document in %q", list)
+	}
+	return names, nil
+}
+
+// resolveOrder is the parsed -resolve-order.
+var resolveOrder = []string{stageExact, stageIndex}
+
+// parseResolveOrder parses a comma separated list of lookup stages.
+func parseResolveOrder(list string) ([]string, error) {
+	var stages []string
+	seen := make(map[string]bool)
+	for _, stage := range strings.Split(list, ",") {
+		stage = strings.ToLower(strings.TrimSpace(stage))
+		if stage == "" {
+			continue
+		}
+		switch stage {
+		case stageExact, stageHTML, stageIndex, stageSPA:
+		default:
+			return nil, fmt.Errorf("unknown lookup stage %q in %q", stage, list)
+		}
+		if seen[stage] {
+			return nil, fmt.Errorf("lookup stage %q is repeated in %q", stage, list)
+		}
+		seen[stage] = true
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// withStage returns stages with stage appended, unless already present.
+func withStage(stages []string, stage string) []string {
+	for _, s := range stages {
+		if s == stage {
+			return stages
+		}
+	}
+	return append(stages, stage)
+}
+
+// indexKeys returns the keys of the index documents of the directory dir,
+// when the index stage is enabled.
+func indexKeys(dir string) []string {
+	for _, stage := range resolveOrder {
+		if stage == stageIndex {
+			return joinKeys(dir, indexDocuments)
+		}
+	}
+	return nil
+}
+
+// resolveKeys returns the keys looked up, in order, for the path name.
+func resolveKeys(name string) []string {
+	var keys []string
+	for _, stage := range resolveOrder {
+		switch stage {
+		case stageExact:
+			if name != "" {
+				keys = append(keys, name)
+			}
+		case stageHTML:
+			if name != "" && !strings.HasSuffix(name, ".html") {
+				keys = append(keys, name+".html")
+			}
+		case stageIndex:
+			// Paths with an extension are assets, not directories.
+			if path.Ext(name) == "" {
+				keys = append(keys, joinKeys(name, indexDocuments)...)
+			}
+		case stageSPA:
+			// Missing assets are not routes, they stay 404s.
+			if path.Ext(name) == "" {
+				keys = append(keys, spaFallback, indexDocuments[0])
+			}
+		}
+	}
+	return keys
+}
+
+// cleanKey returns the object key for the request path name, without
+// leading, trailing or repeated slashes. The root of the bucket, whether
+// spelled "", "/" or "//", is the empty key.
+func cleanKey(name string) string {
+	return strings.TrimPrefix(path.Clean(pathSeparator+name), pathSeparator)
+}
+
+// joinKeys returns the keys of names under the directory dir.
+func joinKeys(dir string, names []string) []string {
+	dir = cleanKey(dir)
+	keys := make([]string, 0, len(names))
+	for _, n := range names {
+		if dir == "" {
+			keys = append(keys, n)
+			continue
+		}
+		keys = append(keys, dir+pathSeparator+n)
+	}
+	return keys
+}
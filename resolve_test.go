@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolutionOrder(t *testing.T) {
+	store := newFakeStore()
+	for key, body := range map[string]string{
+		"index.html":      "root index",
+		"200.html":        "spa fallback",
+		"404.html":        "not found page",
+		"page.html":       "clean url",
+		"app":             "exact app",
+		"app.html":        "html app",
+		"docs/index.html": "docs index",
+		"docs/guide.htm":  "guide",
+		"misc/notes.txt":  "notes",
+	} {
+		store.put(key, body)
+	}
+
+	// Directories without an index are listed unless listings are
+	// disabled, which leaves the 404 page.
+	setGlobal(t, &enableListing, false)
+	for _, tc := range []struct {
+		order string
+		path  string
+		code  int
+		body  string
+	}{
+		{"exact,index", "/", http.StatusOK, "root index"},
+		{"exact,index", "/page.html", http.StatusOK, "clean url"},
+		{"exact,index", "/page", http.StatusNotFound, "not found page"},
+		{"exact,index", "/app", http.StatusOK, "exact app"},
+		{"exact,index", "/docs/", http.StatusOK, "docs index"},
+		{"exact,index", "/docs", http.StatusMovedPermanently, ""},
+		{"exact,index", "/misc/", http.StatusNotFound, "not found page"},
+		{"exact,index", "/nowhere", http.StatusNotFound, "not found page"},
+		{"exact,html,index", "/page", http.StatusOK, "clean url"},
+		{"exact,html,index", "/app", http.StatusOK, "exact app"},
+		{"html,exact,index", "/app", http.StatusOK, "html app"},
+		{"exact", "/docs/", http.StatusNotFound, "not found page"},
+		{"exact", "/", http.StatusNotFound, "not found page"},
+		{"exact,index,spa", "/some/route", http.StatusOK, "spa fallback"},
+		{"exact,index,spa", "/docs/", http.StatusOK, "docs index"},
+		{"exact,index,spa", "/page.html", http.StatusOK, "clean url"},
+	} {
+		order, err := parseResolveOrder(tc.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setGlobal(t, &resolveOrder, order)
+		w := serve(newTestS3(t, store), tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: got status %d, want %d", tc.order, tc.path, w.Code, tc.code)
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s %s: got body %q, want %q", tc.order, tc.path, w.Body.String(), tc.body)
+		}
+	}
+}
+
+func TestIndexDocumentsOrder(t *testing.T) {
+	store := newFakeStore()
+	store.put("docs/index.html", "html")
+	store.put("docs/default.htm", "htm")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		list string
+		body string
+	}{
+		{"index.html,default.htm", "html"},
+		{"default.htm,index.html", "htm"},
+		{"README.html,default.htm", "htm"},
+	} {
+		docs, err := parseIndexDocuments(tc.list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setGlobal(t, &indexDocuments, docs)
+		if w := serve(s3, "/docs/"); w.Body.String() != tc.body {
+			t.Errorf("%s: got body %q, want %q", tc.list, w.Body.String(), tc.body)
+		}
+	}
+}
+
+func TestParseResolveOrder(t *testing.T) {
+	for _, tc := range []struct {
+		list string
+		want []string
+		ok   bool
+	}{
+		{"exact,index", []string{stageExact, stageIndex}, true},
+		{" HTML , exact ", []string{stageHTML, stageExact}, true},
+		{"exact,spa,index", []string{stageExact, stageSPA, stageIndex}, true},
+		{"exact,exact", nil, false},
+		{"exact,fallback", nil, false},
+	} {
+		got, err := parseResolveOrder(tc.list)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: got error %v, want ok=%v", tc.list, err, tc.ok)
+			continue
+		}
+		if tc.ok && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.list, got, tc.want)
+		}
+	}
+}
+
+func TestRootIndex(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"//", ""},
+		{"/docs/", "docs"},
+		{"//docs//", "docs"},
+		{"/docs/../", ""},
+	} {
+		if got := cleanKey(tc.name); got != tc.want {
+			t.Errorf("cleanKey(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+		if got, want := indexKeys(tc.name)[0], strings.TrimPrefix(tc.want+"/index.html", "/"); got != want {
+			t.Errorf("indexKeys(%q) starts with %q, want %q", tc.name, got, want)
+		}
+	}
+
+	store := newFakeStore()
+	store.put("index.html", "root index")
+	s3 := newTestS3(t, store)
+	for _, target := range []string{"/", "//", "/./", "/docs/../"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		// The client sent the path as is, without cleaning it.
+		r.URL.Path = target
+		w := httptest.NewRecorder()
+		s3.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "root index" {
+			t.Errorf("%q: got status %d and body %q, want the root index", target, w.Code, w.Body.String())
+		}
+	}
+	for _, key := range store.requested {
+		if strings.HasPrefix(key, "/") || strings.Contains(key, "//") {
+			t.Errorf("looked up key %q", key)
+		}
+	}
+}
+
+func TestIndexSkippedForAssets(t *testing.T) {
+	setGlobal(t, &enableListing, false)
+	store := newFakeStore()
+	store.put("docs/index.html", "docs")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path  string
+		probe string
+		want  bool
+	}{
+		{"/logo.png", "logo.png/index.html", false},
+		{"/assets/app.min.js", "assets/app.min.js/index.html", false},
+		{"/docs/", "docs/index.html", true},
+		{"/about", "about/index.html", true},
+	} {
+		store.requested = nil
+		serve(s3, tc.path)
+		var probed bool
+		for _, key := range store.requested {
+			probed = probed || key == tc.probe
+		}
+		if probed != tc.want {
+			t.Errorf("%s: looked up %q, want index probed %v", tc.path, store.requested, tc.want)
+		}
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+	setGlobal(t, &resolveOrder, []string{stageExact, stageIndex, stageSPA})
+	store := newFakeStore()
+	store.put("index.html", "root index")
+	store.put("app.js", "js")
+	s3 := newTestS3(t, store)
+
+	// Without a 200.html unmatched routes get the root index document.
+	for _, p := range []string{"/users/42", "/deep/nested/route"} {
+		if w := serve(s3, p); w.Code != http.StatusOK || w.Body.String() != "root index" {
+			t.Errorf("%s without 200.html: got %d %q, want %d %q", p, w.Code, w.Body.String(), http.StatusOK, "root index")
+		}
+	}
+
+	store.put("200.html", "generated fallback")
+	s3 = newTestS3(t, store)
+	for _, tc := range []struct {
+		path string
+		body string
+	}{
+		{"/users/42", "generated fallback"},
+		{"/deep/nested/route", "generated fallback"},
+		// Matched paths are served as they are.
+		{"/", "root index"},
+		{"/app.js", "js"},
+	} {
+		if w := serve(s3, tc.path); w.Code != http.StatusOK || w.Body.String() != tc.body {
+			t.Errorf("%s with 200.html: got %d %q, want %d %q", tc.path, w.Code, w.Body.String(), http.StatusOK, tc.body)
+		}
+	}
+
+	// Missing assets are no routes.
+	for _, p := range []string{"/missing.js", "/img/logo.png", "/users/42/avatar.jpg"} {
+		if w := serve(s3, p); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", p, w.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// headerRule sets the header name to value on the responses to request
+// paths matching match, or to every request when match is nil. An empty
+// value strips the header.
+type headerRule struct {
+	pattern string
+	match   *regexp.Regexp
+	name    string
+	value   string
+}
+
+// parseHeaderRule parses a rule of the form [PATTERN=]NAME: VALUE, e.g.
+// "X-Frame-Options: DENY" or "/docs/*=X-Robots-Tag: noindex", with
+// PATTERN as in -cache-control.
+func parseHeaderRule(value string) (headerRule, error) {
+	rule := headerRule{pattern: value}
+	header := value
+	// Header names never hold a slash or a tilde, so a rule starting
+	// with one is scoped to a pattern.
+	if strings.HasPrefix(value, pathSeparator) || strings.HasPrefix(value, "~") {
+		i := strings.Index(value, "=")
+		if i < 0 {
+			return headerRule{}, fmt.Errorf("header %q is not of the form [PATTERN=]NAME: VALUE", value)
+		}
+		match, err := compilePathPattern(value[:i])
+		if err != nil {
+			return headerRule{}, fmt.Errorf("header %q %v", value, err)
+		}
+		rule.match = match
+		header = value[i+1:]
+	}
+
+	i := strings.Index(header, ":")
+	if i < 0 {
+		return headerRule{}, fmt.Errorf("header %q is not of the form [PATTERN=]NAME: VALUE", value)
+	}
+	rule.name = http.CanonicalHeaderKey(strings.TrimSpace(header[:i]))
+	rule.value = strings.TrimSpace(header[i+1:])
+	if rule.name == "" || strings.ContainsAny(rule.name, " \t\"(),/:;<=>?@[\\]{}") {
+		return headerRule{}, fmt.Errorf("header %q has an invalid name", value)
+	}
+	return rule, nil
+}
+
+// headersFlag implements flag.Value for the repeatable -header flag.
+type headersFlag []headerRule
+
+func (h *headersFlag) String() string {
+	var rules []string
+	for _, rule := range *h {
+		rules = append(rules, rule.pattern)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (h *headersFlag) repeatable() {}
+
+func (h *headersFlag) Set(value string) error {
+	rule, err := parseHeaderRule(value)
+	if err != nil {
+		return err
+	}
+	*h = append(*h, rule)
+	return nil
+}
+
+// secureHeaderDefaults are the headers sent with -secure-headers, the
+// Content-Security-Policy is set apart with -content-security-policy.
+var secureHeaderDefaults = []headerRule{
+	{name: "Strict-Transport-Security", value: "max-age=31536000; includeSubDomains"},
+	{name: "X-Content-Type-Options", value: "nosniff"},
+	{name: "Referrer-Policy", value: "strict-origin-when-cross-origin"},
+}
+
+// secureHeaderRules returns the rules of -secure-headers with the policy
+// csp, followed by rules so that they can override any of them.
+func secureHeaderRules(csp string, rules []headerRule) []headerRule {
+	preset := append([]headerRule(nil), secureHeaderDefaults...)
+	if csp != "" {
+		preset = append(preset, headerRule{name: "Content-Security-Policy", value: csp})
+	}
+	return append(preset, rules...)
+}
+
+// responseHeaderRules returns the header rules applied for the -header
+// rules, after those of -secure-headers when enabled.
+func responseHeaderRules(rules []headerRule) []headerRule {
+	if secureHeaders {
+		return secureHeaderRules(contentSecurityPolicy, rules)
+	}
+	return append([]headerRule(nil), rules...)
+}
+
+// withHeaders sets the headers of the current rules matching the canonical
+// request path on every response, overriding those set by the handlers.
+// Later rules win over earlier ones for the same header.
+func withHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := rules().headers
+		if len(headers) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p := canonicalPath(r.URL.Path)
+		next.ServeHTTP(&hookResponseWriter{
+			ResponseWriter: w,
+			beforeWrite: func(code int, h http.Header) {
+				for _, rule := range headers {
+					if rule.match != nil && !rule.match.MatchString(p) {
+						continue
+					}
+					if rule.value == "" {
+						h.Del(rule.name)
+						continue
+					}
+					h.Set(rule.name, rule.value)
+				}
+			},
+		}, r)
+	})
+}
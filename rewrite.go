@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rewriteRule maps request paths matching from to the path looked up in
+// the bucket, to may refer to the groups captured by from as $1 or ${1}.
+type rewriteRule struct {
+	pattern string
+	from    *regexp.Regexp
+	to      string
+}
+
+// parseRewriteRule parses a rule of the form FROM=TO where FROM is a
+// regular expression, e.g. "^/blog/(.+)$=/content/blog/$1.md".
+func parseRewriteRule(value string) (rewriteRule, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return rewriteRule{}, fmt.Errorf("rewrite %q is not of the form FROM=TO", value)
+	}
+	from, err := regexp.Compile(value[:i])
+	if err != nil {
+		return rewriteRule{}, fmt.Errorf("rewrite %q has an invalid pattern: %v", value, err)
+	}
+	return rewriteRule{pattern: value, from: from, to: value[i+1:]}, nil
+}
+
+// rewritesFlag implements flag.Value for the repeatable -rewrite flag.
+type rewritesFlag []rewriteRule
+
+func (r *rewritesFlag) String() string {
+	var rules []string
+	for _, rule := range *r {
+		rules = append(rules, rule.pattern)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *rewritesFlag) repeatable() {}
+
+func (r *rewritesFlag) Set(value string) error {
+	rule, err := parseRewriteRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// rewritePath returns the path looked up in the bucket for the request
+// path name, rewritten by the first matching rewrite rule, and whether it
+// was rewritten. A rewritten path climbing out with ".." is refused.
+func rewritePath(name string) (string, bool, error) {
+	for _, rule := range rules().rewrites {
+		m := rule.from.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+		to := string(rule.from.ExpandString(nil, rule.to, name, m))
+		for _, segment := range strings.Split(to, pathSeparator) {
+			if segment == ".." {
+				return "", false, fmt.Errorf("rewrite %q of %q escapes the bucket root", rule.pattern, name)
+			}
+		}
+		return pathSeparator + cleanKey(to), true, nil
+	}
+	return name, false, nil
+}
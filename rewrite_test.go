@@ -0,0 +1,98 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"testing"
+)
+
+// setRewrites sets the -rewrite rules for the duration of the test.
+func setRewrites(t *testing.T, values ...string) {
+	t.Helper()
+	var rs rewritesFlag
+	for _, v := range values {
+		if err := rs.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setGlobal(t, &rewrites, rs)
+}
+
+func TestRewritePath(t *testing.T) {
+	setRewrites(t,
+		`^/blog/(\d+)/(.+)$=/content/blog/$2-$1.md`,
+		`^/blog/(?P<slug>[^/]+)$=/content/blog/${slug}.md`,
+		`^/up/(.*)$=/../$1`,
+		`^/dots/(.*)$=/content/$1`,
+	)
+	// Makes the rules current.
+	newTestS3(t, newFakeStore())
+
+	for _, tc := range []struct {
+		name      string
+		want      string
+		rewritten bool
+		err       bool
+	}{
+		{"/blog/2021/hello", "/content/blog/hello-2021.md", true, false},
+		{"/blog/hello", "/content/blog/hello.md", true, false},
+		{"/docs/index.html", "/docs/index.html", false, false},
+		// The first matching rule wins.
+		{"/blog/7/x", "/content/blog/x-7.md", true, false},
+		{"/up/secret", "", false, true},
+		{"/dots/../../secret", "", false, true},
+	} {
+		got, rewritten, err := rewritePath(tc.name)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.err)
+			continue
+		}
+		if got != tc.want || rewritten != tc.rewritten {
+			t.Errorf("%s: got %q rewritten %v, want %q rewritten %v", tc.name, got, rewritten, tc.want, tc.rewritten)
+		}
+	}
+
+	for _, invalid := range []string{"^/a", "=/b", "^/a=", "([=/b"} {
+		if _, err := parseRewriteRule(invalid); err == nil {
+			t.Errorf("accepted rewrite %q", invalid)
+		}
+	}
+}
+
+func TestRewriteServing(t *testing.T) {
+	setRewrites(t,
+		`^/blog/(.+)$=/content/blog/$1.md`,
+		`^/img/(.+)\.png$=/assets/$1.bin`,
+		`^/escape/(.*)$=/../$1`,
+	)
+	store := newFakeStore()
+	store.put("content/blog/post.md", "# post").ContentType = "text/markdown"
+	store.put("assets/logo.bin", "\x89PNG")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		path  string
+		code  int
+		body  string
+		ctype string
+	}{
+		// Without an extension in the URL the stored type is used.
+		{"/blog/post", http.StatusOK, "# post", "text/markdown"},
+		// The type follows the extension of the URL, not of the key.
+		{"/img/logo.png", http.StatusOK, "\x89PNG", mime.TypeByExtension(".png")},
+		{"/blog/missing", http.StatusNotFound, "", ""},
+		{"/escape/secret", http.StatusBadRequest, "", ""},
+	} {
+		w := serve(s3, tc.path)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.path, w.Code, tc.code)
+			continue
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("%s: got body %q, want %q", tc.path, w.Body.String(), tc.body)
+		}
+		if tc.ctype != "" && w.Header().Get("Content-Type") != tc.ctype {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.path, w.Header().Get("Content-Type"), tc.ctype)
+		}
+	}
+}
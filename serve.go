@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/netutil"
+)
+
+// shutdownTimeout bounds how long in-flight requests may take to complete
+// once the process is asked to terminate, set with -shutdown-timeout.
+var shutdownTimeout = 10 * time.Second
+
+// Timeouts of the servers, set with -read-timeout, -read-header-timeout,
+// -write-timeout and -idle-timeout, 0 means none.
+var (
+	readTimeout       = 30 * time.Second
+	readHeaderTimeout = 10 * time.Second
+	writeTimeout      time.Duration
+	idleTimeout       = 120 * time.Second
+)
+
+// setTimeouts sets the configured timeouts on srv, so that slow clients
+// cannot hold connections open forever.
+func setTimeouts(srv *http.Server) *http.Server {
+	srv.ReadTimeout = readTimeout
+	srv.ReadHeaderTimeout = readHeaderTimeout
+	srv.WriteTimeout = writeTimeout
+	srv.IdleTimeout = idleTimeout
+	return srv
+}
+
+// draining is set to 1 once the server is shutting down, updated
+// atomically, so that readiness checks fail while requests drain.
+var draining int32
+
+// maxConnections caps the number of connections accepted at once by each
+// listener, 0 means unlimited.
+var maxConnections int
+
+// listenAll binds every server to its address, logging each one bound.
+// When an address cannot be bound the listeners already open are closed.
+// With maxConnections, connections over the limit wait in the backlog of
+// the listener until others are closed.
+func listenAll(srvs []*http.Server, scheme string) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, len(srvs))
+	for _, srv := range srvs {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("unable to listen on %s: %v", srv.Addr, err)
+		}
+		if maxConnections > 0 {
+			ln = netutil.LimitListener(ln, maxConnections)
+		}
+		logInfo("Started listening", "url", scheme+"://"+ln.Addr().String())
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// serveAll serves every server on its listener with serve until one of
+// them fails or the process receives SIGINT or SIGTERM, then gracefully
+// shuts all of them down: new connections are refused while in-flight
+// requests get up to shutdownTimeout to complete, those still running
+// are then cut off. It returns the error that stopped serving, nil on a
+// requested shutdown.
+func serveAll(srvs []*http.Server, lns []net.Listener, serve func(*http.Server, net.Listener) error) error {
+	errCh := make(chan error, len(srvs))
+	for i := range srvs {
+		go func(srv *http.Server, ln net.Listener) {
+			errCh <- serve(srv, ln)
+		}(srvs[i], lns[i])
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	var err error
+	select {
+	case err = <-errCh:
+	case sig := <-sigCh:
+		logInfo("Shutting down, draining in-flight requests", "signal", sig, "timeout", shutdownTimeout)
+	}
+	atomic.StoreInt32(&draining, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range srvs {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if serr := srv.Shutdown(ctx); serr != nil {
+				logError("Unable to shut down gracefully, closing the remaining connections", "addr", srv.Addr, "err", serr)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	return err
+}
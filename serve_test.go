@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxConnections(t *testing.T) {
+	const limit, clients = 2, 6
+	setGlobal(t, &maxConnections, limit)
+
+	var (
+		mu           sync.Mutex
+		active, peak int
+		release      = make(chan struct{})
+		reachedLimit = make(chan struct{})
+		signalled    bool
+	)
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		if active == limit && !signalled {
+			signalled = true
+			close(reachedLimit)
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})}
+	lns, err := listenAll([]*http.Server{srv}, "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lns[0])
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("http://" + lns[0].Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+
+	<-reachedLimit
+	// Leaves the connections over the limit time to be wrongly accepted.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if peak != limit {
+		t.Errorf("served %d connections at once, want %d", peak, limit)
+	}
+}
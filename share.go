@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareCookie remembers a valid share token, so that the assets of a
+// shared page load without a token of their own.
+const shareCookie = "s3www_share"
+
+// shareSignature returns the signature of a share token expiring at exp.
+func shareSignature(secret string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d", exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// shareQuery returns the query string of a link valid for ttl.
+func shareQuery(secret string, ttl time.Duration) string {
+	exp := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("token", shareSignature(secret, exp))
+	return q.Encode()
+}
+
+// validShare reports whether token is the signature of a share token
+// expiring at exp, that has not expired yet.
+func validShare(secret, exp, token string) (int64, bool) {
+	t, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() >= t {
+		return 0, false
+	}
+	return t, hmac.Equal([]byte(token), []byte(shareSignature(secret, t)))
+}
+
+// withShare only serves requests carrying a valid share token signed with
+// secret, either in the ?exp= and ?token= query parameters of a shared
+// link or in the cookie set by a previous request with them. Requests
+// without one, or with an expired or tampered one, are refused with 403
+// Forbidden.
+func withShare(secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		varyOn(r, "Cookie")
+		q := r.URL.Query()
+		if token := q.Get("token"); token != "" {
+			exp, ok := validShare(secret, q.Get("exp"), token)
+			if !ok {
+				http.Error(w, "invalid or expired share token", http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     shareCookie,
+				Value:    strconv.FormatInt(exp, 10) + "." + token,
+				Path:     "/",
+				Expires:  time.Unix(exp, 0),
+				Secure:   r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c, err := r.Cookie(shareCookie); err == nil {
+			if i := strings.Index(c.Value, "."); i > 0 {
+				if _, ok := validShare(secret, c.Value[:i], c.Value[i+1:]); ok {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareTokens(t *testing.T) {
+	const secret = "share secret"
+	store := newFakeStore()
+	store.put("index.html", "preview")
+	h := withShare(secret, newTestS3(t, store))
+
+	valid, err := url.ParseQuery(shareQuery(secret, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, token := valid.Get("exp"), valid.Get("token")
+	expired := time.Now().Add(-time.Minute).Unix()
+	past := strconv.FormatInt(expired, 10)
+	later, _ := strconv.ParseInt(exp, 10, 64)
+	tampered := []byte(token)
+	tampered[0] ^= 1
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{"valid", "exp=" + exp + "&token=" + token, http.StatusOK},
+		{"expired", "exp=" + past + "&token=" + shareSignature(secret, expired), http.StatusForbidden},
+		{"tampered token", "exp=" + exp + "&token=" + string(tampered), http.StatusForbidden},
+		{"extended expiry", "exp=" + strconv.FormatInt(later+3600, 10) + "&token=" + token, http.StatusForbidden},
+		{"other secret", "exp=" + exp + "&token=" + shareSignature("other", later), http.StatusForbidden},
+		{"missing expiry", "token=" + token, http.StatusForbidden},
+		{"no token", "", http.StatusForbidden},
+	} {
+		w := serve(h, "/?"+tc.query)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.code)
+		}
+		if cookie := w.Header().Get("Set-Cookie"); (cookie != "") != (tc.code == http.StatusOK) {
+			t.Errorf("%s: got Set-Cookie %q", tc.name, cookie)
+		}
+	}
+
+	// The cookie set by a shared link lets the assets of the page in.
+	w := serve(h, "/?exp="+exp+"&token="+token)
+	cookie := strings.SplitN(w.Header().Get("Set-Cookie"), ";", 2)[0]
+	if w := serve(h, "/index.html", "Cookie", cookie); w.Code != http.StatusOK || w.Body.String() != "preview" {
+		t.Errorf("with the cookie: got status %d and body %q, want the page", w.Code, w.Body.String())
+	}
+	if w := serve(h, "/index.html", "Cookie", shareCookie+"="+past+"."+shareSignature(secret, expired)); w.Code != http.StatusForbidden {
+		t.Errorf("with an expired cookie: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := serve(h, "/index.html", "Cookie", shareCookie+"="+exp+"."+string(tampered)); w.Code != http.StatusForbidden {
+		t.Errorf("with a tampered cookie: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
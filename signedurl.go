@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// urlSignature returns the signature of a link to urlPath expiring at
+// expires.
+func urlSignature(secret, urlPath string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%d", urlPath, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns urlPath with the query string signing it for ttl.
+func signURL(secret, urlPath string, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", urlSignature(secret, urlPath, expires))
+	return (&url.URL{Path: urlPath, RawQuery: q.Encode()}).String()
+}
+
+// validURLSignature reports whether the query of r holds a signature of
+// its canonical path that has not expired yet.
+func validURLSignature(secret string, r *http.Request) bool {
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(q.Get("sig")), []byte(urlSignature(secret, canonicalPath(r.URL.Path), expires)))
+}
+
+// withSignedURLs only serves the requests for canonical paths matching
+// pattern, or every path when nil, that carry a valid ?expires=&sig= signature of
+// their path made with secret, refusing the others with 403 Forbidden.
+// Unlike share links a signed URL opens a single path.
+func withSignedURLs(secret string, pattern *regexp.Regexp, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pattern != nil && !pattern.MatchString(canonicalPath(r.URL.Path)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validURLSignature(secret, r) {
+			http.Error(w, "invalid or expired signature", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
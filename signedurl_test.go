@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSignedURLs(t *testing.T) {
+	const secret = "url secret"
+	store := newFakeStore()
+	store.put("private/secret.txt", "secret")
+	store.put("public/index.html", "public")
+	h := withSignedURLs(secret, regexp.MustCompile(`^/private/`), newTestS3(t, store))
+	signed := signURL(secret, "/private/secret.txt", time.Hour)
+
+	for _, tc := range []struct {
+		target string
+		code   int
+	}{
+		{signed, http.StatusOK},
+		{"/public/index.html", http.StatusOK},
+		{"/private/secret.txt", http.StatusForbidden},
+		{"/private/secret.txt?expires=1&sig=00", http.StatusForbidden},
+		// Paths that are looked up as a protected one are protected too.
+		{"/public/../private/secret.txt", http.StatusForbidden},
+		{"//private/secret.txt", http.StatusForbidden},
+		{"/./private/secret.txt", http.StatusForbidden},
+		{"/public/%2e%2e/private/secret.txt", http.StatusForbidden},
+		{"/public/..%2Fprivate/secret.txt", http.StatusForbidden},
+		// The signature is of the path looked up.
+		{"/" + signed, http.StatusOK},
+	} {
+		if w := serve(h, tc.target); w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.target, w.Code, tc.code)
+		}
+	}
+}
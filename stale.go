@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// staleWarning is the Warning header sent along stale responses.
+const staleWarning = `110 - "Response is Stale"`
+
+// maxStale is how long past their expiry cached bodies may still be
+// served while S3 is failing, 0 disables serving stale content.
+var maxStale time.Duration
+
+// staleObject is implemented by cached objects, reporting whether they
+// are served past their expiry because S3 could not be reached.
+type staleObject interface {
+	isStale() bool
+}
+
+// isNotFound reports whether err is S3 reporting a missing object.
+func isNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// canServeStale reports whether a cached copy fetched at fetched and
+// expiring after ttl may be served instead of failing with err. Only
+// errors from S3 being unavailable qualify, not missing objects or
+// denied access.
+func canServeStale(fetched time.Time, ttl time.Duration, err error) bool {
+	if maxStale <= 0 || err == nil || isNotFound(err) || isAccessDenied(err) {
+		return false
+	}
+	return time.Since(fetched) < ttl+maxStale
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/patrickmn/go-cache"
+)
+
+var errUnavailable = minio.ErrorResponse{Code: "ServiceUnavailable", StatusCode: http.StatusServiceUnavailable}
+
+func TestServeStaleDuringOutage(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		warm     bool
+		maxStale time.Duration
+		code     int
+		warning  bool
+	}{
+		{"warm cache", true, time.Hour, http.StatusOK, true},
+		{"cold cache", false, time.Hour, http.StatusInternalServerError, false},
+		{"too stale", true, time.Nanosecond, http.StatusInternalServerError, false},
+		{"disabled", true, 0, http.StatusInternalServerError, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.put("a.txt", "last known good")
+			setGlobal(t, &maxStale, tc.maxStale)
+			s3 := newTestS3(t, store)
+			s3.cache = cache.New(time.Hour, time.Hour)
+			s3.bodyCache = newBodyCache(1<<20, 1<<20, time.Millisecond, false)
+
+			if tc.warm {
+				if w := serve(s3, "/a.txt"); w.Code != http.StatusOK {
+					t.Fatalf("warming up: got status %d", w.Code)
+				}
+			} else {
+				pathIsDir(context.Background(), s3, "a.txt")
+			}
+			time.Sleep(2 * time.Millisecond)
+			store.errs["a.txt"] = errUnavailable
+
+			w := serve(s3, "/a.txt")
+			if w.Code != tc.code {
+				t.Errorf("got status %d, want %d", w.Code, tc.code)
+			}
+			if tc.code == http.StatusOK && w.Body.String() != "last known good" {
+				t.Errorf("got body %q", w.Body.String())
+			}
+			if got := w.Header().Get("Warning") != ""; got != tc.warning {
+				t.Errorf("got Warning %q, want one: %v", w.Header().Get("Warning"), tc.warning)
+			}
+		})
+	}
+}
+
+func TestStaleNotServedForMissingObjects(t *testing.T) {
+	store := newFakeStore()
+	store.put("a.txt", "deleted soon")
+	setGlobal(t, &maxStale, time.Hour)
+	s3 := newTestS3(t, store)
+	s3.bodyCache = newBodyCache(1<<20, 1<<20, time.Millisecond, false)
+
+	serve(s3, "/a.txt")
+	time.Sleep(2 * time.Millisecond)
+	delete(store.objects, "a.txt")
+	if w := serve(s3, "/a.txt"); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
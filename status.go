@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+// cacheStats counts directory cache lookups, updated atomically.
+type cacheStats struct {
+	hits   int64
+	misses int64
+}
+
+func (c *cacheStats) hit() {
+	atomic.AddInt64(&c.hits, 1)
+}
+
+func (c *cacheStats) miss() {
+	atomic.AddInt64(&c.misses, 1)
+}
+
+// serverStatus is the JSON document returned by the status endpoint.
+type serverStatus struct {
+	Version     string  `json:"version"`
+	Commit      string  `json:"commit"`
+	BuildDate   string  `json:"buildDate"`
+	Bucket      string  `json:"bucket"`
+	Endpoint    string  `json:"endpoint"`
+	Uptime      string  `json:"uptime"`
+	UptimeSecs  float64 `json:"uptimeSeconds"`
+	CacheItems  int     `json:"cacheItems"`
+	CacheHits   int64   `json:"cacheHits"`
+	CacheMisses int64   `json:"cacheMisses"`
+
+	CredentialFailures int64 `json:"credentialFailures"`
+
+	TopPrefixes []prefixCount `json:"topPrefixes,omitempty"`
+}
+
+// withStatus serves runtime statistics as JSON on statusPath to clients
+// presenting token as a bearer token, and passes every other request
+// to next.
+func withStatus(s3 *S3, statusPath, token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != statusPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The token alone, without its scheme, is refused.
+		const scheme = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if len(auth) < len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="s3www"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		uptime := time.Since(startTime)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		status := serverStatus{
+			Version:     version,
+			Commit:      commit,
+			BuildDate:   date,
+			Bucket:      s3.bucket,
+			Endpoint:    endpoint,
+			Uptime:      uptime.Truncate(time.Second).String(),
+			UptimeSecs:  uptime.Seconds(),
+			CacheHits:   atomic.LoadInt64(&s3.stats.hits),
+			CacheMisses: atomic.LoadInt64(&s3.stats.misses),
+
+			CredentialFailures: atomic.LoadInt64(&credentialFailures),
+		}
+		if s3.cache != nil {
+			status.CacheItems = s3.cache.ItemCount()
+		}
+		if s3.analytics != nil {
+			status.TopPrefixes = s3.analytics.top()
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestStatusToken(t *testing.T) {
+	const token = "status token"
+	store := newFakeStore()
+	store.put("index.html", "home")
+	s3 := newTestS3(t, store)
+	h := withStatus(s3, "/_status", token, s3)
+
+	for _, tc := range []struct {
+		name   string
+		header []string
+		code   int
+	}{
+		{"bearer token", []string{"Authorization", "Bearer " + token}, http.StatusOK},
+		{"lower case scheme", []string{"Authorization", "bearer " + token}, http.StatusOK},
+		{"no scheme", []string{"Authorization", token}, http.StatusUnauthorized},
+		{"other scheme", []string{"Authorization", "Basic " + token}, http.StatusUnauthorized},
+		{"wrong token", []string{"Authorization", "Bearer other"}, http.StatusUnauthorized},
+		{"empty token", []string{"Authorization", "Bearer "}, http.StatusUnauthorized},
+		{"none", nil, http.StatusUnauthorized},
+	} {
+		w := serve(h, "/_status", tc.header...)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.code)
+			continue
+		}
+		if tc.code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", tc.name)
+		}
+		if tc.code == http.StatusOK {
+			var status serverStatus
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status.Bucket != "bucket" {
+				t.Errorf("%s: got %q, %v, want the status of the bucket", tc.name, w.Body.String(), err)
+			}
+		}
+	}
+
+	// Other paths are not behind the token.
+	if w := serve(h, "/"); w.Code != http.StatusOK || w.Body.String() != "home" {
+		t.Errorf("/: got status %d and body %q, want the page", w.Code, w.Body.String())
+	}
+}
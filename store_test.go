@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+func init() {
+	// The lines logged while serving the test requests are noise.
+	std.out = io.Discard
+}
+
+// fakeTime is the modification time of the objects of fakeStore.
+var fakeTime = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeStore is an in-memory objectStore failing like S3 does: errors of
+// GetObject only surface once the object is read or stat'ed.
+type fakeStore struct {
+	mu      sync.Mutex
+	objects map[string]*fakeEntry
+	// errs are returned when reading the keys, listErrs when listing
+	// the prefixes.
+	errs     map[string]error
+	listErrs map[string]error
+
+	gets, stats, lists int
+	// listed counts the entries received by the listings.
+	listed int
+	// requested are the keys read or stat'ed, in order.
+	requested []string
+	// open counts the objects not closed yet and the listings not
+	// done, maxOpen the most there ever were at once.
+	open, maxOpen int
+	// readDelay slows down every read, as when streaming from S3.
+	readDelay time.Duration
+}
+
+type fakeEntry struct {
+	data []byte
+	info minio.ObjectInfo
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		objects:  make(map[string]*fakeEntry),
+		errs:     make(map[string]error),
+		listErrs: make(map[string]error),
+	}
+}
+
+// put stores data under key, returning its info for the test to adjust.
+func (s *fakeStore) put(key, data string) *minio.ObjectInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := md5.Sum([]byte(data))
+	e := &fakeEntry{
+		data: []byte(data),
+		info: minio.ObjectInfo{
+			Key:          key,
+			Size:         int64(len(data)),
+			ETag:         hex.EncodeToString(sum[:]),
+			LastModified: fakeTime,
+			Metadata:     make(http.Header),
+			UserMetadata: make(minio.StringMap),
+		},
+	}
+	s.objects[key] = e
+	return &e.info
+}
+
+// count returns one of the counters of s.
+func (s *fakeStore) count(n *int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *n
+}
+
+// opened counts a new object or listing in flight, with s.mu held.
+func (s *fakeStore) opened() {
+	s.open++
+	if s.open > s.maxOpen {
+		s.maxOpen = s.open
+	}
+}
+
+// lookup returns the entry of key, or the error reading it.
+func (s *fakeStore) lookup(key string) (*fakeEntry, error) {
+	if err, ok := s.errs[key]; ok {
+		return nil, err
+	}
+	e, ok := s.objects[key]
+	if !ok {
+		return nil, noSuchKey(key)
+	}
+	return e, nil
+}
+
+func (s *fakeStore) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	return true, nil
+}
+
+func (s *fakeStore) GetObject(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (s3Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	s.requested = append(s.requested, key)
+	s.opened()
+	obj := &fakeObject{store: s}
+	e, err := s.lookup(key)
+	switch {
+	case err != nil:
+		obj.err = err
+	case opts.Header().Get("If-Match") != "" && strings.Trim(opts.Header().Get("If-Match"), `"`) != e.info.ETag:
+		obj.err = minio.ErrorResponse{Code: "PreconditionFailed", StatusCode: http.StatusPreconditionFailed, Key: key}
+	default:
+		obj.Reader = bytes.NewReader(e.data)
+		obj.info = e.info
+	}
+	return obj, nil
+}
+
+func (s *fakeStore) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats++
+	s.requested = append(s.requested, key)
+	e, err := s.lookup(key)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return e.info, nil
+}
+
+// ListObjects lists the objects under opts.Prefix after opts.StartAfter,
+// grouping those below a further "/" into directories unless
+// opts.Recursive.
+func (s *fakeStore) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists++
+	s.opened()
+	var infos []minio.ObjectInfo
+	if err, ok := s.listErrs[opts.Prefix]; ok {
+		infos = append(infos, minio.ObjectInfo{Err: err})
+	} else {
+		var keys []string
+		for key := range s.objects {
+			if strings.HasPrefix(key, opts.Prefix) && key > opts.StartAfter {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var lastDir string
+		for _, key := range keys {
+			info := s.objects[key].info
+			if !opts.Recursive {
+				if j := strings.Index(key[len(opts.Prefix):], pathSeparator); j >= 0 {
+					dir := key[:len(opts.Prefix)+j+1]
+					if dir == lastDir || dir <= opts.StartAfter {
+						continue
+					}
+					lastDir = dir
+					info = minio.ObjectInfo{Key: dir}
+				}
+			}
+			infos = append(infos, info)
+		}
+	}
+
+	ch := make(chan minio.ObjectInfo)
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.open--
+			s.mu.Unlock()
+			close(ch)
+		}()
+		for _, info := range infos {
+			select {
+			case ch <- info:
+				s.mu.Lock()
+				s.listed++
+				s.mu.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// fakeObject is an object of fakeStore, failing with err on every call
+// when set.
+type fakeObject struct {
+	*bytes.Reader
+	info   minio.ObjectInfo
+	err    error
+	store  *fakeStore
+	closed bool
+}
+
+func (o *fakeObject) Read(p []byte) (int, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	time.Sleep(o.store.readDelay)
+	return o.Reader.Read(p)
+}
+
+func (o *fakeObject) Seek(offset int64, whence int) (int64, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	return o.Reader.Seek(offset, whence)
+}
+
+func (o *fakeObject) Stat() (minio.ObjectInfo, error) {
+	if o.err != nil {
+		return minio.ObjectInfo{}, o.err
+	}
+	return o.info, nil
+}
+
+func (o *fakeObject) Close() error {
+	o.store.mu.Lock()
+	defer o.store.mu.Unlock()
+	if !o.closed {
+		o.closed = true
+		o.store.open--
+	}
+	return nil
+}
+
+// setGlobal sets the configuration variable p to v for the duration of
+// the test.
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// newTestS3 returns an S3 serving the objects of store, with the rules
+// of the current configuration.
+func newTestS3(t *testing.T, store objectStore) *S3 {
+	t.Helper()
+	rs, err := loadRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentRules.Store(rs)
+	return &S3{Client: store, bucket: "bucket"}
+}
+
+// serve returns the response of h to a GET of target with the headers
+// given as alternating names and values.
+func serve(h http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	return serveMethod(h, http.MethodGet, target, header...)
+}
+
+// serveMethod is serve for any method.
+func serveMethod(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// newTLSServer returns a http.Server serving handler over TLS with
+// ALPN explicitly configured, so that HTTP/2 keeps being negotiated
+// even once the tls.Config is customized. When disableHTTP2 is set
+// only HTTP/1.1 is offered. When clientCAs is set, client certificates
+// signed by them are verified, and required if requireClientCert is set.
+func newTLSServer(addr string, handler http.Handler, disableHTTP2 bool, clientCAs *x509.CertPool, requireClientCert bool) *http.Server {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		// "OPTIONS *" is answered by withMethods like any other path.
+		DisableGeneralOptionsHandler: true,
+		TLSConfig: &tls.Config{
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+	}
+	if clientCAs != nil {
+		srv.TLSConfig.ClientCAs = clientCAs
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if disableHTTP2 {
+		srv.TLSConfig.NextProtos = []string{"http/1.1"}
+		// A non-nil, empty TLSNextProto disables the automatic
+		// HTTP/2 support of net/http.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv
+}
+
+// readFileOrObject reads the local file name, or the object of the same
+// name in the bucket when there is no such file.
+func readFileOrObject(ctx context.Context, s3 *S3, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err == nil || !os.IsNotExist(err) {
+		return data, err
+	}
+	logInfo("No local file, reading it from the bucket", "file", name)
+	obj, err := s3.Client.GetObject(ctx, s3.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return ioutil.ReadAll(obj)
+}
+
+// loadCertPool loads the PEM encoded certificates stored in the local file
+// or bucket object name.
+func loadCertPool(ctx context.Context, s3 *S3, name string) (*x509.CertPool, error) {
+	data, err := readFileOrObject(ctx, s3, name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %q", name)
+	}
+	return pool, nil
+}
+
+// backendTLSConfig returns the TLS configuration used to reach S3, trusting
+// the PEM encoded CAs of the local file caFile on top of the system roots.
+// The bucket cannot hold that file since it is needed to reach the bucket.
+func backendTLSConfig(caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %q", caFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert returns a certificate for 127.0.0.1 signed by parent, or self
+// signed when parent is nil, usable as a CA when isCA is set.
+func testCert(t *testing.T, cn string, isCA bool, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// serveTLS serves srv with cert on a random local port until the test
+// ends, returning its URL.
+func serveTLS(t *testing.T, srv *http.Server, cert tls.Certificate) string {
+	t.Helper()
+	srv.TLSConfig.Certificates = []tls.Certificate{cert}
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+func TestTLSServerProtocols(t *testing.T) {
+	for _, tc := range []struct {
+		disableHTTP2 bool
+		want         string
+	}{
+		{false, "HTTP/2.0"},
+		{true, "HTTP/1.1"},
+	} {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		})
+		srv := newTLSServer("127.0.0.1:0", handler, tc.disableHTTP2, nil, false)
+		url := serveTLS(t, srv, testCert(t, "127.0.0.1", false, nil))
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Proto != tc.want {
+			t.Errorf("disableHTTP2=%v: negotiated %s, want %s", tc.disableHTTP2, resp.Proto, tc.want)
+		}
+		if tc.want == "HTTP/2.0" && resp.TLS.NegotiatedProtocol != "h2" {
+			t.Errorf("ALPN negotiated %q, want h2", resp.TLS.NegotiatedProtocol)
+		}
+	}
+}
+
+func TestTLSServerClientCertificates(t *testing.T) {
+	ca := testCert(t, "test CA", true, nil)
+	client := testCert(t, "client", false, &ca)
+	rogueCA := testCert(t, "rogue CA", true, nil)
+	rogue := testCert(t, "rogue", false, &rogueCA)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	get := func(url string, certs ...tls.Certificate) error {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+		resp, err := c.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	required := serveTLS(t, newTLSServer("127.0.0.1:0", handler, false, pool, true), testCert(t, "127.0.0.1", false, nil))
+	if err := get(required); err == nil {
+		t.Error("accepted a client without a certificate")
+	}
+	if err := get(required, rogue); err == nil {
+		t.Error("accepted a client certificate of another CA")
+	}
+	if err := get(required, client); err != nil {
+		t.Errorf("refused a valid client certificate: %v", err)
+	}
+
+	optional := serveTLS(t, newTLSServer("127.0.0.1:0", handler, false, pool, false), testCert(t, "127.0.0.1", false, nil))
+	if err := get(optional); err != nil {
+		t.Errorf("refused a client without a certificate: %v", err)
+	}
+	if err := get(optional, client); err != nil {
+		t.Errorf("refused a valid client certificate: %v", err)
+	}
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	ca := testCert(t, "private CA", true, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		TLSConfig: &tls.Config{},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	}
+	url := serveTLS(t, srv, testCert(t, "127.0.0.1", false, &ca))
+
+	for _, tc := range []struct {
+		caFile   string
+		insecure bool
+		ok       bool
+	}{
+		{"", false, false},
+		{caFile, false, true},
+		{"", true, true},
+	} {
+		config, err := backendTLSConfig(tc.caFile, tc.insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.caFile != "" && config.RootCAs == nil {
+			t.Errorf("-ca-cert %q: no root CAs in the TLS configuration", tc.caFile)
+		}
+		client := &http.Client{Transport: NewCustomHTTPTransport(config)}
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("-ca-cert %q -insecure-skip-verify=%v: got error %v, want success %v", tc.caFile, tc.insecure, err, tc.ok)
+		}
+	}
+
+	if _, err := backendTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), false); err == nil {
+		t.Error("accepted a missing CA file")
+	}
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	if _, err := backendTLSConfig(notPEM, false); err == nil {
+		t.Error("accepted a CA file without certificates")
+	}
+}
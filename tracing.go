@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of spans, as numbered by OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// tracer exports the spans of sampled requests, nil when tracing is
+// disabled with no -otlp-endpoint.
+var tracer *spanExporter
+
+// span is a timed operation of a trace. Every method is a no-op on a nil
+// span, so that callers need not check whether tracing is enabled.
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	sampled bool
+	name    string
+	kind    int
+	start   time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   string
+}
+
+type spanKey struct{}
+
+// startSpan starts a span named name as a child of the span of ctx, or
+// as the root of a new trace sampled by -trace-sample-ratio.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parent, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		// Sampled like the TraceIDRatioBased sampler of OpenTelemetry,
+		// so that every service samples the same traces.
+		s.sampled = binary.BigEndian.Uint64(s.traceID[8:])>>1 < uint64(tracer.ratio*(1<<63))
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// set sets the attribute key of s to value.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// fail marks s as failed with msg.
+func (s *span) fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = msg
+	s.mu.Unlock()
+}
+
+// finish ends s, queuing it for export when sampled.
+func (s *span) finish() {
+	if s == nil || !s.sampled {
+		return
+	}
+	tracer.add(s, time.Now())
+}
+
+// parseTraceparent parses a W3C traceparent header into the remote span
+// it names.
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	s.sampled = flags&1 == 1
+	return s, true
+}
+
+// withTracing traces every request as a server span, continuing the
+// trace of the traceparent header of the request when present.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, parent)
+		}
+		ctx, sp := startSpan(ctx, "HTTP "+r.Method, spanServer)
+		sp.set("http.method", r.Method)
+		sp.set("http.target", r.URL.Path)
+		sp.set("http.user_agent", r.UserAgent())
+		sp.set("s3www.request_id", requestIDFromContext(ctx))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		sp.set("http.status_code", rec.status)
+		if rec.status >= 500 {
+			sp.fail(http.StatusText(rec.status))
+		}
+		sp.finish()
+	})
+}
+
+// s3Operation names the S3 operation sent as r.
+func s3Operation(r *http.Request) string {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead && strings.Trim(r.URL.Path, "/") == "":
+		return "S3 HeadBucket"
+	case r.Method == http.MethodHead:
+		return "S3 StatObject"
+	case query.Get("list-type") != "":
+		return "S3 ListObjects"
+	case query["location"] != nil:
+		return "S3 GetBucketLocation"
+	case r.Method == http.MethodGet:
+		return "S3 GetObject"
+	}
+	return "S3 " + r.Method
+}
+
+// exportedSpan is a finished span waiting for export.
+type exportedSpan struct {
+	*span
+	end time.Time
+}
+
+// spanExporter sends finished spans to an OTLP/HTTP collector as JSON,
+// in batches. Spans are dropped rather than slowing requests down when
+// the collector cannot keep up.
+type spanExporter struct {
+	url     string
+	service string
+	ratio   float64
+	client  *http.Client
+	queue   chan exportedSpan
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// spanBatchSize is the largest number of spans sent at once.
+const spanBatchSize = 512
+
+// newSpanExporter returns an exporter sending the spans of service to the
+// collector at endpoint, on /v1/traces unless it has a path of its own.
+func newSpanExporter(endpoint, service string, ratio float64) (*spanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint %q must be an http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("trace sample ratio %v must be between 0 and 1", ratio)
+	}
+	e := &spanExporter{
+		url:     u.String(),
+		service: service,
+		ratio:   ratio,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan exportedSpan, 4*spanBatchSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *spanExporter) add(s *span, end time.Time) {
+	select {
+	case e.queue <- exportedSpan{s, end}:
+	default:
+	}
+}
+
+// run exports the queued spans every few seconds, or as soon as a batch
+// is full, until stopped.
+func (e *spanExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var batch []exportedSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			logWarn("Unable to export spans", "spans", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) == spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// shutdown exports the spans still queued, waiting at most until ctx is
+// done.
+func (e *spanExporter) shutdown(ctx context.Context) {
+	close(e.stop)
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		i := strconv.Itoa(v)
+		a.Value.IntValue = &i
+	case bool:
+		a.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+// export sends batch to the collector.
+func (e *spanExporter) export(batch []exportedSpan) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    s.kind,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for key, value := range s.attrs {
+			out.Attributes = append(out.Attributes, otlpAttr(key, value))
+		}
+		if s.err != "" {
+			out.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{
+					otlpAttr("service.name", e.service),
+					otlpAttr("service.version", version),
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "s3www"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type varyKey struct{}
+
+// varySet collects the request headers a response depended on.
+type varySet struct {
+	names []string
+}
+
+// varyOn records that the response to r depends on the named request
+// headers, withVary lists them in the Vary response header. It does
+// nothing for requests that did not go through withVary.
+func varyOn(r *http.Request, names ...string) {
+	if v, ok := r.Context().Value(varyKey{}).(*varySet); ok {
+		v.names = append(v.names, names...)
+	}
+}
+
+// mergeVary adds names to the Vary header of h, skipping those already
+// listed whatever their case.
+func mergeVary(h http.Header, names []string) {
+	seen := make(map[string]bool)
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			seen[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	if seen["*"] {
+		return
+	}
+	for _, name := range names {
+		if key := strings.ToLower(name); !seen[key] {
+			seen[key] = true
+			h.Add("Vary", http.CanonicalHeaderKey(name))
+		}
+	}
+}
+
+// withVary lets the handlers down the chain record with varyOn which
+// request headers influenced the response, and sets Vary accordingly so
+// shared caches keep the variants apart.
+func withVary(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := &varySet{}
+		next.ServeHTTP(&hookResponseWriter{
+			ResponseWriter: w,
+			beforeWrite: func(code int, h http.Header) {
+				mergeVary(h, v.names)
+			},
+		}, r.WithContext(context.WithValue(r.Context(), varyKey{}, v)))
+	})
+}
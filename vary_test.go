@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// varyNames returns the names listed in the Vary headers of h.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+	return names
+}
+
+func hasVary(h http.Header, name string) bool {
+	for _, n := range varyNames(h) {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVaryCompressed(t *testing.T) {
+	setGlobal(t, &compress, true)
+	setGlobal(t, &compressMinSize, 0)
+	setGlobal(t, &compressors, map[string]*compressor{})
+	setGlobal(t, &compressEncodings, nil)
+	if err := setupCompressors("gzip", ""); err != nil {
+		t.Fatal(err)
+	}
+	store := newFakeStore()
+	store.put("app.js", "console.log('hello')")
+	store.put("logo.png", "\x89PNG")
+	h := withVary(newTestS3(t, store))
+
+	w := serve(h, "/app.js", "Accept-Encoding", "gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", got)
+	}
+	if !hasVary(w.Header(), "Accept-Encoding") {
+		t.Errorf("gzip response has Vary %q, want Accept-Encoding", varyNames(w.Header()))
+	}
+	// The identity response is a variant too.
+	if w := serve(h, "/app.js"); !hasVary(w.Header(), "Accept-Encoding") {
+		t.Errorf("identity response has Vary %q, want Accept-Encoding", varyNames(w.Header()))
+	}
+	if w := serve(h, "/logo.png", "Accept-Encoding", "gzip"); len(varyNames(w.Header())) != 0 {
+		t.Errorf("incompressible response has Vary %q, want none", varyNames(w.Header()))
+	}
+}
+
+func TestVaryPrecompressed(t *testing.T) {
+	setGlobal(t, &precompressed, []string{"gzip"})
+	store := newFakeStore()
+	store.put("app.js", "console.log('hello')")
+	store.put("app.js.gz", "\x1f\x8b compressed")
+	h := withVary(newTestS3(t, store))
+
+	w := serve(h, "/app.js", "Accept-Encoding", "gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", got)
+	}
+	if !hasVary(w.Header(), "Accept-Encoding") {
+		t.Errorf("got Vary %q, want Accept-Encoding", varyNames(w.Header()))
+	}
+}
+
+func TestVaryCORS(t *testing.T) {
+	store := newFakeStore()
+	store.put("data.json", "{}")
+	s3 := newTestS3(t, store)
+
+	for _, tc := range []struct {
+		origins     string
+		credentials bool
+		vary        bool
+	}{
+		{"https://example.com", false, true},
+		{"https://*.example.com", false, true},
+		{"*", true, true},
+		// Every origin gets the same "*".
+		{"*", false, false},
+	} {
+		p, err := newCORSPolicy(tc.origins, "GET", "", "", tc.credentials, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := withVary(withCORS(p, s3))
+		for _, origin := range []string{"https://example.com", "https://www.example.com", ""} {
+			w := serve(h, "/data.json", "Origin", origin)
+			if got := hasVary(w.Header(), "Origin"); got != tc.vary {
+				t.Errorf("%s credentials=%v, Origin %q: got Vary %q, want Origin %v",
+					tc.origins, tc.credentials, origin, varyNames(w.Header()), tc.vary)
+			}
+		}
+	}
+}
+
+func TestMergeVary(t *testing.T) {
+	for _, tc := range []struct {
+		existing []string
+		names    []string
+		want     []string
+	}{
+		{nil, []string{"accept-encoding", "Origin", "Accept-Encoding"}, []string{"Accept-Encoding", "Origin"}},
+		{[]string{"Origin"}, []string{"origin", "Accept"}, []string{"Origin", "Accept"}},
+		{[]string{"Accept, Cookie"}, []string{"cookie"}, []string{"Accept", "Cookie"}},
+		{[]string{"*"}, []string{"Origin"}, []string{"*"}},
+	} {
+		h := http.Header{}
+		for _, v := range tc.existing {
+			h.Add("Vary", v)
+		}
+		mergeVary(h, tc.names)
+		if got := varyNames(h); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("merging %q into %q: got %q, want %q", tc.names, tc.existing, got, tc.want)
+		}
+	}
+}
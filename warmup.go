@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// warmup reads the list of paths stored in object, one per line, and
+// primes the directory cache, and the body cache when enabled, for each
+// of them with at most concurrency lookups in flight. Empty lines and
+// lines starting with '#' are ignored. It returns the number of paths
+// primed.
+func warmup(ctx context.Context, s3 *S3, object string, concurrency int) (int, error) {
+	obj, err := s3.Client.GetObject(ctx, s3.bucket, object, minio.GetObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(obj)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		primed int64
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, concurrency)
+	)
+	for _, p := range paths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return int(primed), ctx.Err()
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if isDir, err := pathIsDir(ctx, s3, name); err == nil && !isDir && s3.bodyCache != nil {
+				if obj, err := getObject(ctx, s3, resolveKeys(strings.TrimPrefix(name, pathSeparator))); err == nil {
+					obj.Close()
+				}
+			}
+			if ctx.Err() == nil {
+				atomic.AddInt64(&primed, 1)
+			}
+		}(p)
+	}
+	wg.Wait()
+	return int(primed), ctx.Err()
+}
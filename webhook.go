@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// missEvent is the JSON document posted to the miss webhook.
+type missEvent struct {
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// missNotifier posts an event to a webhook for every object fetched from
+// S3. Events are sent asynchronously by at most cap(slots) goroutines,
+// any event beyond that is dropped so a slow webhook never holds up
+// serving.
+type missNotifier struct {
+	url    string
+	client *http.Client
+	slots  chan struct{}
+}
+
+func newMissNotifier(url string, timeout time.Duration, maxPending int) *missNotifier {
+	return &missNotifier{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		slots:  make(chan struct{}, maxPending),
+	}
+}
+
+// missStatus returns the HTTP status reported for a fetch that ended with
+// err, the status S3 answered with, or 502 when S3 was not reached.
+func missStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case err == errTooLarge:
+		return http.StatusRequestEntityTooLarge
+	}
+	if code := minio.ToErrorResponse(err).StatusCode; code != 0 {
+		return code
+	}
+	return http.StatusBadGateway
+}
+
+// notify reports the fetch of key, which ended with err, to the webhook.
+// It never blocks. A nil *missNotifier does nothing.
+func (m *missNotifier) notify(key string, err error) {
+	if m == nil {
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return
+	}
+
+	event := missEvent{Path: pathSeparator + key, Status: missStatus(err), Time: time.Now()}
+	go func() {
+		defer func() { <-m.slots }()
+		body, _ := json.Marshal(event)
+		resp, err := m.client.Post(m.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logWarn("Unable to post to the miss webhook", "err", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
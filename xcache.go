@@ -0,0 +1,47 @@
+package main
+
+import "net/http"
+
+// Values of the X-Cache header, telling where the body of a response
+// came from.
+const (
+	// cacheHit is a body served from the body or disk cache.
+	cacheHit = "HIT"
+	// cacheMiss is a body fetched from S3.
+	cacheMiss = "MISS"
+	// cacheRevalidated is a cached body whose ETag was checked
+	// against S3 first.
+	cacheRevalidated = "REVALIDATED"
+	// cacheStale is a cached body served past its expiry while S3 is
+	// failing.
+	cacheStale = "STALE"
+)
+
+// xCacheHeader enables the X-Cache response header.
+var xCacheHeader bool
+
+// cachedResult is implemented by objects served from a cache, reporting
+// how the cache served them.
+type cachedResult interface {
+	cacheStatus() string
+}
+
+// cacheStatusOf returns the X-Cache value of obj.
+func cacheStatusOf(obj s3Object) string {
+	if c, ok := obj.(cachedResult); ok {
+		return c.cacheStatus()
+	}
+	return cacheMiss
+}
+
+// setXCache sets the X-Cache header for a response serving obj, when
+// enabled with -x-cache-header, and counts the result in the metrics.
+func setXCache(w http.ResponseWriter, obj s3Object) {
+	status := cacheStatusOf(obj)
+	if metrics != nil {
+		metrics.cacheResult(status)
+	}
+	if xCacheHeader {
+		w.Header().Set("X-Cache", status)
+	}
+}